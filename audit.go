@@ -0,0 +1,100 @@
+package kuberos
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/negz/kuberos/audit"
+	"github.com/negz/kuberos/extractor"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Audit records the issuance of credentials to the supplied sink.
+func Audit(s audit.Sink) Option {
+	return func(h *Handlers) error {
+		h.audit = s
+		return nil
+	}
+}
+
+// newEvent returns an audit event describing the supplied request. The
+// event's outcome is determined by the supplied error.
+func (h *Handlers) newEvent(r *http.Request, action string, p *extractor.OIDCAuthenticationParams, err error) *audit.Event {
+	e := &audit.Event{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Outcome:   audit.OutcomeSuccess,
+		ClientIP:  h.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err != nil {
+		e.Outcome = audit.OutcomeFailure
+		e.Reason = err.Error()
+	}
+	if p != nil {
+		e.Subject = p.Subject
+		e.Email = p.Username
+		e.Groups = p.Groups
+		e.Issuer = p.IssuerURL
+	}
+	return e
+}
+
+// record records the supplied event, logging any failure to do so. Failing to
+// record an event does not prevent the issuance of credentials.
+func (h *Handlers) record(e *audit.Event) {
+	if err := h.audit.Record(e); err != nil {
+		h.log.Error("cannot record audit event", zap.String("action", e.Action), zap.Error(err))
+	}
+}
+
+// clusters returns the sorted names of the clusters in the kubecfg template,
+// if any, that the supplied parameters are eligible for.
+func (h *Handlers) clusters(p *extractor.OIDCAuthenticationParams) []string {
+	if h.template == nil {
+		return nil
+	}
+	cfg, err := h.kubeCfgTemplate(p)
+	if err != nil {
+		return nil
+	}
+	return clusterNames(cfg)
+}
+
+// clusterNames returns the sorted names of the clusters in the supplied
+// kubecfg.
+func clusterNames(cfg *api.Config) []string {
+	names := make([]string, 0, len(cfg.Clusters))
+	for name := range cfg.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unverifiedSubject returns the subject claimed by the supplied ID token
+// without verifying it. It is suitable only for auditing ID tokens that could
+// not be verified, e.g. because they have expired.
+func unverifiedSubject(idToken string) string {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	c := struct {
+		Subject string `json:"sub"`
+	}{}
+	// Unmarshal populates what claims it can even if others are malformed.
+	json.Unmarshal(b, &c) // nolint: errcheck
+	return c.Subject
+}
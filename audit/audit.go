@@ -0,0 +1,153 @@
+// Package audit records the issuance of credentials by Kuberos.
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultWebhookTimeout is the default time allowed for a webhook to accept
+// an event.
+const DefaultWebhookTimeout = 5 * time.Second
+
+// Actions that produce audit events.
+const (
+	// ActionKubeCfg records the exchange of an authorization code for
+	// authentication parameters.
+	ActionKubeCfg = "kubecfg"
+
+	// ActionTemplate records the generation of a kubecfg.
+	ActionTemplate = "template"
+
+	// ActionRefresh records a refresh via Kuberos' refresh endpoint.
+	ActionRefresh = "refresh"
+
+	// ActionToken records a refresh via Kuberos' token broker endpoint.
+	ActionToken = "token"
+
+	// ActionLogout records a logout.
+	ActionLogout = "logout"
+)
+
+// Outcomes of audited actions.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// An Event records an attempt to obtain or relinquish credentials. Its
+// identity is attested by a verified ID token unless Unverified is true, in
+// which case only the subject claimed by the ID token is recorded.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome"`
+	Reason     string    `json:"reason,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	Unverified bool      `json:"unverified,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	Groups     []string  `json:"groups,omitempty"`
+	Issuer     string    `json:"issuer,omitempty"`
+	ClientIP   string    `json:"clientIP,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Clusters   []string  `json:"clusters,omitempty"`
+}
+
+// A Sink records audit events.
+type Sink interface {
+	Record(e *Event) error
+}
+
+type discard struct{}
+
+func (d discard) Record(_ *Event) error { return nil }
+
+// Discard is a Sink that discards all events.
+var Discard Sink = discard{}
+
+type jsonLines struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+// JSONLines returns a Sink that writes each event to the supplied writer as a
+// single line of JSON.
+func JSONLines(w io.Writer) Sink {
+	return &jsonLines{w: w}
+}
+
+// File returns a Sink that appends each event to the supplied file as a single
+// line of JSON. The file is created if it does not exist.
+func File(filename string) (Sink, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open audit log %s", filename)
+	}
+	return JSONLines(f), nil
+}
+
+func (s *jsonLines) Record(e *Event) error {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal audit event")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err = s.w.Write(append(j, '\n'))
+	return errors.Wrap(err, "cannot write audit event")
+}
+
+type webhook struct {
+	url string
+	h   *http.Client
+}
+
+// Webhook returns a Sink that POSTs each event to the supplied URL as JSON.
+// Any response other than 2xx is considered a failure to record the event.
+func Webhook(url string, h *http.Client) Sink {
+	return &webhook{url: url, h: h}
+}
+
+func (s *webhook) Record(e *Event) error {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal audit event")
+	}
+	rsp, err := s.h.Post(s.url, "application/json", bytes.NewReader(j))
+	if err != nil {
+		return errors.Wrap(err, "cannot send audit event")
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body) // nolint: errcheck
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return errors.Errorf("cannot send audit event: %s", rsp.Status)
+	}
+	return nil
+}
+
+type multi []Sink
+
+// Multi returns a Sink that records each event to all of the supplied sinks.
+// It returns the first error encountered, but always tries every sink.
+func Multi(ss ...Sink) Sink {
+	return multi(ss)
+}
+
+func (m multi) Record(e *Event) error {
+	var first error
+	for _, s := range m {
+		if err := s.Record(e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
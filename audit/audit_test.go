@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+)
+
+var event = &Event{
+	Time:     time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+	Action:   ActionTemplate,
+	Outcome:  OutcomeSuccess,
+	Subject:  "1234",
+	Email:    "example@example.org",
+	Groups:   []string{"a", "b"},
+	ClientIP: "192.0.2.1",
+	Clusters: []string{"prod"},
+}
+
+const eventJSON = `{"time":"2018-01-01T00:00:00Z","action":"template","outcome":"success","subject":"1234","email":"example@example.org","groups":["a","b"],"clientIP":"192.0.2.1","clusters":["prod"]}`
+
+func TestJSONLines(t *testing.T) {
+	b := &bytes.Buffer{}
+	s := JSONLines(b)
+	for i := 0; i < 2; i++ {
+		if err := s.Record(event); err != nil {
+			t.Fatalf("s.Record(...): %v", err)
+		}
+	}
+	if diff := deep.Equal(b.String(), eventJSON+"\n"+eventJSON+"\n"); diff != nil {
+		t.Errorf("b.String(): got != want: %v", diff)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	cases := []struct {
+		name    string
+		code    int
+		wantErr error
+	}{
+		{
+			name: "Accepted",
+			code: http.StatusAccepted,
+		},
+		{
+			name:    "Rejected",
+			code:    http.StatusInternalServerError,
+			wantErr: errors.New("cannot send audit event: 500 Internal Server Error"),
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				got = string(b)
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			err := Webhook(srv.URL, srv.Client()).Record(event)
+			if diff := deep.Equal(err, tt.wantErr); diff != nil {
+				t.Errorf("Record(...): got != want: %v", diff)
+			}
+			if diff := deep.Equal(got, eventJSON); diff != nil {
+				t.Errorf("webhook body: got != want: %v", diff)
+			}
+		})
+	}
+}
+
+type failing struct{ err error }
+
+func (f failing) Record(_ *Event) error { return f.err }
+
+func TestMulti(t *testing.T) {
+	b := &bytes.Buffer{}
+	err := Multi(failing{errors.New("boom")}, JSONLines(b), failing{errors.New("bang")}).Record(event)
+	if diff := deep.Equal(err, errors.New("boom")); diff != nil {
+		t.Errorf("Record(...): got != want: %v", diff)
+	}
+	e := &Event{}
+	if err := json.Unmarshal(b.Bytes(), e); err != nil {
+		t.Fatalf("json.Unmarshal(...): %v", err)
+	}
+	if diff := deep.Equal(e, event); diff != nil {
+		t.Errorf("recorded event: got != want: %v", diff)
+	}
+}
@@ -0,0 +1,145 @@
+package kuberos
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	authParamACRValues = "acr_values"
+	authParamMaxAge    = "max_age"
+)
+
+// ACRValues requests that the OIDC provider authenticate users per one of the
+// supplied authentication context classes, in order of preference. Classes
+// are provider specific; many providers have one that requires multiple
+// factors.
+func ACRValues(v ...string) Option {
+	return func(h *Handlers) error {
+		h.acrValues = v
+		return nil
+	}
+}
+
+// MaxAge requests that the OIDC provider authenticate users again if they last
+// authenticated longer ago than the supplied duration.
+func MaxAge(d time.Duration) Option {
+	return func(h *Handlers) error {
+		if d < 0 {
+			return errors.New("maximum authentication age must not be negative")
+		}
+		h.maxAge = d
+		return nil
+	}
+}
+
+// ClusterAuthentication omits each of the named clusters from the kubecfgs
+// of users whose authentication does not satisfy its requirement. Kuberos
+// only checks how users authenticated when their ID token is verified;
+// clusters with requirements are omitted for ID tokens that fail
+// verification. TokenReviews for a named cluster, i.e. those POSTed to
+// /tokenreview?cluster=<name>, are refused for ID tokens that do not satisfy
+// its requirement.
+func ClusterAuthentication(r map[string]extractor.AuthenticationRequirement) Option {
+	return func(h *Handlers) error {
+		h.clusterAuth = r
+		return nil
+	}
+}
+
+// TokenReviewAuthentication refuses TokenReviews of ID tokens that do not
+// satisfy the supplied requirement. The OIDC extractor enforces its own
+// requirement only when users log in, so API servers that authenticate users
+// via the TokenReview webhook should be protected by the same requirement.
+// Unlike at login, MaxAge limits how long each authentication may be used to
+// access API servers, regardless of any ID token refreshes since.
+func TokenReviewAuthentication(r extractor.AuthenticationRequirement) Option {
+	return func(h *Handlers) error {
+		if r.MaxAge < 0 {
+			return errors.New("maximum authentication age must not be negative")
+		}
+		h.reviewAuth = r
+		return nil
+	}
+}
+
+// authCodeOptions returns the options with which to build the OIDC provider's
+// authorization URL.
+func (h *Handlers) authCodeOptions() []oauth2.AuthCodeOption {
+	oo := append([]oauth2.AuthCodeOption{}, h.oo...)
+	if len(h.acrValues) > 0 {
+		oo = append(oo, oauth2.SetAuthURLParam(authParamACRValues, strings.Join(h.acrValues, " ")))
+	}
+	if h.maxAge > 0 {
+		oo = append(oo, oauth2.SetAuthURLParam(authParamMaxAge, strconv.Itoa(int(h.maxAge/time.Second))))
+	}
+	return oo
+}
+
+// authenticate verifies the ID token of the supplied parameters, which were
+// decoded from a request rather than extracted by Kuberos, and sets the
+// username, subject, groups, and authentication it attests to. It returns the
+// verified parameters, or nil if the ID token cannot be verified, in which
+// case only the subject it claims is set.
+func (h *Handlers) authenticate(ctx context.Context, p *extractor.OIDCAuthenticationParams) *extractor.OIDCAuthenticationParams {
+	if h.e == nil {
+		p.Subject, p.Groups = unverifiedSubject(p.IDToken), nil
+		return nil
+	}
+	v, err := h.e.Verify(ctx, p.IDToken)
+	if err != nil {
+		p.Subject, p.Groups = unverifiedSubject(p.IDToken), nil
+		return nil
+	}
+	p.Username, p.Subject, p.Groups = v.Username, v.Subject, v.Groups
+	p.ACR, p.AMR, p.AuthTime = v.ACR, v.AMR, v.AuthTime
+	return v
+}
+
+// kubeCfgTemplate returns the kubecfg template, omitting any clusters whose
+// authentication requirements the supplied parameters do not satisfy.
+func (h *Handlers) kubeCfgTemplate(p *extractor.OIDCAuthenticationParams) (*api.Config, error) {
+	cfg, err := h.template.Get()
+	if err != nil {
+		return nil, err
+	}
+	if len(h.clusterAuth) == 0 {
+		return cfg, nil
+	}
+
+	// Templates may be shared, so we must not modify them.
+	filtered := *cfg
+	filtered.Clusters = map[string]*api.Cluster{}
+	now := time.Now()
+	for name, c := range cfg.Clusters {
+		if r, ok := h.clusterAuth[name]; ok && r.Check(p, now) != nil {
+			continue
+		}
+		filtered.Clusters[name] = c
+	}
+	if _, ok := filtered.Clusters[filtered.CurrentContext]; !ok {
+		filtered.CurrentContext = ""
+	}
+	return &filtered, nil
+}
+
+// reviewAuthentication returns an error if the supplied parameters do not
+// satisfy the TokenReview requirement, or that of the named cluster, if any.
+func (h *Handlers) reviewAuthentication(p *extractor.OIDCAuthenticationParams, cluster string) error {
+	now := time.Now()
+	if err := h.reviewAuth.Check(p, now); err != nil {
+		return err
+	}
+	if r, ok := h.clusterAuth[cluster]; ok {
+		return errors.Wrapf(r.Check(p, now), "cluster %s", cluster)
+	}
+	return nil
+}
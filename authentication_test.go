@@ -0,0 +1,72 @@
+package kuberos
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/template"
+)
+
+func TestClusterAuthentication(t *testing.T) {
+	tmpl := template.Static(&api.Config{
+		CurrentContext: "prod",
+		Clusters: map[string]*api.Cluster{
+			"dev":  &api.Cluster{Server: "https://dev.example.org"},
+			"prod": &api.Cluster{Server: "https://prod.example.org"},
+		},
+	})
+	require := map[string]extractor.AuthenticationRequirement{"prod": {ACR: []string{"mfa"}}}
+
+	cases := []struct {
+		name        string
+		e           extractor.OIDC
+		wantCluster []string
+		wantCurrent string
+	}{
+		{
+			name:        "Satisfied",
+			e:           &predictableExtractor{p: &extractor.OIDCAuthenticationParams{ACR: "mfa"}},
+			wantCluster: []string{"dev", "prod"},
+			wantCurrent: "prod",
+		},
+		{
+			name:        "TooWeak",
+			e:           &predictableExtractor{p: &extractor.OIDCAuthenticationParams{ACR: "pwd"}},
+			wantCluster: []string{"dev"},
+		},
+		{
+			name:        "Unverified",
+			e:           &predictableExtractor{err: errors.New("boom")},
+			wantCluster: []string{"dev"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandlers(&oauth2.Config{}, tt.e, KubeCfgTemplate(tmpl), ClusterAuthentication(require))
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+			w := httptest.NewRecorder()
+			h.Template(w, httptest.NewRequest("GET", "/kubecfg.yaml?email=example@example.org&idToken=token", nil))
+
+			cfg, err := clientcmd.Load(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("clientcmd.Load(...): %v", err)
+			}
+			if diff := deep.Equal(clusterNames(cfg), tt.wantCluster); diff != nil {
+				t.Errorf("h.Template(...): clusters: got != want: %v", diff)
+			}
+			if diff := deep.Equal(cfg.CurrentContext, tt.wantCurrent); diff != nil {
+				t.Errorf("h.Template(...): current context: got != want: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/negz/kuberos/audit"
+)
+
+const (
+	brokerTokenEndpoint = "token"
+
+	grantTypeRefreshToken = "refresh_token"
+	responseTypeCode      = "code"
+	subjectTypePublic     = "public"
+	tokenTypeBearer       = "Bearer"
+
+	formGrantType    = "grant_type"
+	formClientID     = "client_id"
+	formRefreshToken = "refresh_token"
+
+	oauth2ErrInvalidRequest       = "invalid_request"
+	oauth2ErrInvalidClient        = "invalid_client"
+	oauth2ErrInvalidGrant         = "invalid_grant"
+	oauth2ErrUnsupportedGrantType = "unsupported_grant_type"
+)
+
+// brokerIssuer returns the issuer URL kubectl should use to discover Kuberos'
+// token endpoint.
+func (h *Handlers) brokerIssuer(r *http.Request) string {
+	return fmt.Sprint(h.baseURL(r).ResolveReference(&url.URL{Path: "./"}))
+}
+
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	ResponseTypes         []string `json:"response_types_supported"`
+	SubjectTypes          []string `json:"subject_types_supported"`
+	SigningAlgorithms     []string `json:"id_token_signing_alg_values_supported"`
+	GrantTypes            []string `json:"grant_types_supported"`
+}
+
+// Discovery serves an OpenID Connect discovery document that names Kuberos'
+// token endpoint. kubectl uses this document to find the endpoint at which to
+// refresh its tokens when Kuberos is a token broker.
+func (h *Handlers) Discovery(w http.ResponseWriter, r *http.Request) {
+	if !h.broker {
+		http.NotFound(w, r)
+		return
+	}
+
+	d := &discovery{
+		Issuer:                h.brokerIssuer(r),
+		AuthorizationEndpoint: h.cfg.Endpoint.AuthURL,
+		TokenEndpoint:         fmt.Sprint(h.baseURL(r).ResolveReference(&url.URL{Path: brokerTokenEndpoint})),
+		ResponseTypes:         []string{responseTypeCode},
+		SubjectTypes:          []string{subjectTypePublic},
+		SigningAlgorithms:     []string{oidc.RS256},
+		GrantTypes:            []string{grantTypeRefreshToken},
+	}
+	j, err := json.Marshal(d)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot marshal JSON").Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(j); err != nil {
+		http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
+	}
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+}
+
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Token is an OAuth 2.0 token endpoint that supports only the refresh_token
+// grant. Refresh requests from kubectl are authenticated using Kuberos' client
+// secret and forwarded to the OIDC provider when Kuberos is a token broker.
+func (h *Handlers) Token(w http.ResponseWriter, r *http.Request) {
+	if !h.broker {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, oauth2ErrInvalidRequest, err.Error())
+		return
+	}
+	if gt := r.PostForm.Get(formGrantType); gt != grantTypeRefreshToken {
+		writeTokenError(w, http.StatusBadRequest, oauth2ErrUnsupportedGrantType, fmt.Sprintf("grant type %q is not supported", gt))
+		return
+	}
+
+	id := r.PostForm.Get(formClientID)
+	if u, _, ok := r.BasicAuth(); ok {
+		// OAuth 2.0 clients URL encode their basic auth credentials.
+		if uu, err := url.QueryUnescape(u); err == nil {
+			id = uu
+		}
+	}
+	if id != h.cfg.ClientID {
+		w.Header().Set("WWW-Authenticate", "Basic")
+		writeTokenError(w, http.StatusUnauthorized, oauth2ErrInvalidClient, "unknown client")
+		return
+	}
+
+	rt := r.PostForm.Get(formRefreshToken)
+	if rt == "" {
+		writeTokenError(w, http.StatusBadRequest, oauth2ErrInvalidRequest, ErrMissingRefreshToken.Error())
+		return
+	}
+
+	p, err := h.e.Refresh(r.Context(), h.cfg, rt)
+	h.record(h.newEvent(r, audit.ActionToken, p, err))
+	if err != nil {
+		h.log.Info("cannot refresh token", zap.Error(err))
+		writeTokenError(w, http.StatusBadRequest, oauth2ErrInvalidGrant, "cannot refresh token")
+		return
+	}
+
+	tr := &tokenResponse{
+		AccessToken:  p.AccessToken,
+		TokenType:    tokenTypeBearer,
+		RefreshToken: p.RefreshToken,
+		IDToken:      p.IDToken,
+	}
+	if !p.Expiry.IsZero() {
+		tr.ExpiresIn = int64(time.Until(p.Expiry) / time.Second)
+	}
+	writeToken(w, http.StatusOK, tr)
+}
+
+func writeTokenError(w http.ResponseWriter, code int, e, desc string) {
+	writeToken(w, code, &tokenError{Error: e, Description: desc})
+}
+
+func writeToken(w http.ResponseWriter, code int, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot marshal JSON").Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(code)
+	w.Write(j) // nolint: errcheck
+}
@@ -0,0 +1,319 @@
+// Package ca resolves the certificate authority data of the clusters in a
+// kubecfg template.
+package ca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultAPITokenMountPath is the default mount path for API tokens
+	DefaultAPITokenMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// DefaultFetchTimeout is the default timeout for fetching CA bundles.
+	DefaultFetchTimeout = 10 * time.Second
+
+	pinPrefixSHA256 = "sha256:"
+	pemTypeCert     = "CERTIFICATE"
+
+	sourceServiceAccount = "serviceaccount"
+	sourceFile           = "file:"
+	sourceInline         = "inline:"
+	schemeHTTPS          = "https"
+
+	maxBundleSize = 1 << 20 // 1MB
+)
+
+var (
+	// ErrNoCertificates indicates a CA bundle that contains no certificates.
+	ErrNoCertificates = errors.New("no certificates found")
+
+	// ErrNoPins indicates an attempt to fetch a CA bundle without pinning.
+	ErrNoPins = errors.New("at least one public key pin is required")
+
+	// ErrNoPinnedCertificates indicates a CA bundle that does not contain any
+	// certificate matching the supplied pins.
+	ErrNoPinnedCertificates = errors.New("no certificate matches the supplied public key pins")
+
+	// ErrUnknownSource indicates an unparseable CA source.
+	ErrUnknownSource = errors.New("unknown CA source")
+
+	appFs = afero.NewOsFs()
+)
+
+// A Source provides a PEM encoded CA bundle for the API server at the
+// supplied URL.
+type Source interface {
+	Get(server string) ([]byte, error)
+}
+
+type inline struct {
+	data []byte
+}
+
+// Inline returns a Source that always returns the supplied CA bundle.
+func Inline(data []byte) Source {
+	return &inline{data: data}
+}
+
+func (i *inline) Get(_ string) ([]byte, error) {
+	return i.data, nil
+}
+
+type file struct {
+	path string
+}
+
+// File returns a Source that reads a CA bundle from the supplied file.
+func File(path string) Source {
+	return &file{path: path}
+}
+
+func (f *file) Get(_ string) ([]byte, error) {
+	b, err := afero.ReadFile(appFs, f.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read CA file %s", f.path)
+	}
+	if _, err := parseCertificates(b); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse CA file %s", f.path)
+	}
+	return b, nil
+}
+
+// ServiceAccount returns a Source that reads the CA bundle of the cluster in
+// which Kuberos is running from its service account.
+func ServiceAccount() Source {
+	return File(filepath.Join(DefaultAPITokenMountPath, v1.ServiceAccountRootCAKey))
+}
+
+// A Pin is the SHA-256 hash of a certificate's DER encoded Subject Public Key
+// Info, as used by kubeadm's --discovery-token-ca-cert-hash.
+type Pin []byte
+
+// ParsePin parses a pin of the form sha256:<hex encoded hash>.
+func ParsePin(s string) (Pin, error) {
+	if !strings.HasPrefix(s, pinPrefixSHA256) {
+		return nil, errors.Errorf("pin %q must begin with %s", s, pinPrefixSHA256)
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(s, pinPrefixSHA256))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot decode pin %q", s)
+	}
+	if len(b) != sha256.Size {
+		return nil, errors.Errorf("pin %q must be a %d byte hash", s, sha256.Size)
+	}
+	return Pin(b), nil
+}
+
+// PinFor returns the Pin for the supplied certificate.
+func PinFor(c *x509.Certificate) Pin {
+	h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return Pin(h[:])
+}
+
+// String returns the pin in the form sha256:<hex encoded hash>.
+func (p Pin) String() string {
+	return pinPrefixSHA256 + hex.EncodeToString(p)
+}
+
+// pinned returns the PEM encoded certificates of the supplied bundle that
+// match any of the supplied pins.
+func pinned(bundle []byte, pins []Pin) ([]byte, error) {
+	certs, err := parseCertificates(bundle)
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	for _, c := range certs {
+		for _, p := range pins {
+			if bytes.Equal(PinFor(c), p) {
+				pem.Encode(b, &pem.Block{Type: pemTypeCert, Bytes: c.Raw}) // nolint: errcheck, gas
+				break
+			}
+		}
+	}
+	if b.Len() == 0 {
+		return nil, ErrNoPinnedCertificates
+	}
+	return b.Bytes(), nil
+}
+
+func parseCertificates(bundle []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var b *pem.Block
+		b, bundle = pem.Decode(bundle)
+		if b == nil {
+			break
+		}
+		if b.Type != pemTypeCert {
+			continue
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse certificate")
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	return certs, nil
+}
+
+type fetchOptions struct {
+	h *http.Client
+}
+
+// A FetchOption represents an option for a Source that fetches CA bundles.
+type FetchOption func(*fetchOptions)
+
+// HTTPClient allows the use of a bespoke HTTP client to fetch CA bundles.
+func HTTPClient(h *http.Client) FetchOption {
+	return func(f *fetchOptions) {
+		f.h = h
+	}
+}
+
+// insecureClient does not verify the TLS certificates of the servers from
+// which CA bundles are fetched. Trust is instead established by pinning.
+var insecureClient = &http.Client{
+	Timeout: DefaultFetchTimeout,
+	Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // nolint: gas
+	},
+}
+
+func newFetchOptions(oo ...FetchOption) *fetchOptions {
+	f := &fetchOptions{h: insecureClient}
+	for _, o := range oo {
+		o(f)
+	}
+	return f
+}
+
+func (f *fetchOptions) fetch(u string) ([]byte, error) {
+	rsp, err := f.h.Get(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot fetch %s", u)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot fetch %s: %s", u, rsp.Status)
+	}
+	b, err := ioutil.ReadAll(&io.LimitedReader{R: rsp.Body, N: maxBundleSize})
+	return b, errors.Wrapf(err, "cannot read %s", u)
+}
+
+type fetched struct {
+	*fetchOptions
+	url  string
+	pins []Pin
+}
+
+// URL returns a Source that fetches a CA bundle from the supplied URL. Only
+// certificates matching one of the supplied pins are returned; trust is
+// established by the pins rather than the fetched URL's TLS certificate.
+func URL(u string, pins []Pin, oo ...FetchOption) (Source, error) {
+	if len(pins) == 0 {
+		return nil, ErrNoPins
+	}
+	return &fetched{fetchOptions: newFetchOptions(oo...), url: u, pins: pins}, nil
+}
+
+func (f *fetched) Get(_ string) ([]byte, error) {
+	b, err := f.fetch(f.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch CA bundle")
+	}
+	p, err := pinned(b, f.pins)
+	return p, errors.Wrapf(err, "cannot verify CA bundle from %s", f.url)
+}
+
+// ParseSource parses a CA source specification. Supported specifications are:
+//
+//	serviceaccount                         The service account's CA bundle.
+//	file:/path/to/ca.crt                   A CA bundle read from a file.
+//	inline:<base64 encoded PEM>            A literal CA bundle.
+//	https://example.org/ca.crt#sha256:<h>  A pinned CA bundle fetched from a
+//	                                       URL. Separate multiple pins by ','.
+//	cluster-info#token:<id>.<secret>       A CA bundle discovered from the
+//	cluster-info#sha256:<h>                kube-public/cluster-info ConfigMap,
+//	                                       verified by bootstrap token and/or
+//	                                       pins. Separate them by ','.
+func ParseSource(spec string, oo ...FetchOption) (Source, error) {
+	switch {
+	case spec == sourceClusterInfo || strings.HasPrefix(spec, sourceClusterInfo+"#"):
+		pins, token, err := parseTrust(strings.TrimPrefix(strings.TrimPrefix(spec, sourceClusterInfo), "#"))
+		if err != nil {
+			return nil, err
+		}
+		return ClusterInfo(pins, token, oo...)
+	case spec == sourceServiceAccount:
+		return ServiceAccount(), nil
+	case strings.HasPrefix(spec, sourceFile):
+		return File(strings.TrimPrefix(spec, sourceFile)), nil
+	case strings.HasPrefix(spec, sourceInline):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(spec, sourceInline))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decode inline CA bundle")
+		}
+		if _, err := parseCertificates(b); err != nil {
+			return nil, errors.Wrap(err, "cannot parse inline CA bundle")
+		}
+		return Inline(b), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != schemeHTTPS {
+		return nil, errors.Wrapf(ErrUnknownSource, "%q", spec)
+	}
+	pins, token, err := parseTrust(u.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		return nil, errors.Errorf("bootstrap tokens cannot verify CA bundles fetched from %s", u.Host)
+	}
+	u.Fragment = ""
+	return URL(u.String(), pins, oo...)
+}
+
+// parseTrust parses a comma separated list of pins and bootstrap tokens.
+func parseTrust(s string) ([]Pin, string, error) {
+	pins := []Pin{}
+	token := ""
+	if s == "" {
+		return pins, token, nil
+	}
+	for _, t := range strings.Split(s, ",") {
+		if strings.HasPrefix(t, trustPrefixToken) {
+			token = strings.TrimPrefix(t, trustPrefixToken)
+			continue
+		}
+		p, err := ParsePin(t)
+		if err != nil {
+			return nil, "", err
+		}
+		pins = append(pins, p)
+	}
+	return pins, token, nil
+}
@@ -0,0 +1,263 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/template"
+)
+
+func newCA(t *testing.T, cn string) (*x509.Certificate, []byte) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(...): %v", err)
+	}
+	return c, pem.EncodeToMemory(&pem.Block{Type: pemTypeCert, Bytes: der})
+}
+
+func TestURL(t *testing.T) {
+	a, aPEM := newCA(t, "a")
+	b, bPEM := newCA(t, "b")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(append(aPEM, bPEM...)) // nolint: errcheck
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name    string
+		pins    []Pin
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "OnlyPinnedCertificates",
+			pins: []Pin{PinFor(b)},
+			want: bPEM,
+		},
+		{
+			name: "MultiplePins",
+			pins: []Pin{PinFor(a), PinFor(b)},
+			want: append(aPEM, bPEM...),
+		},
+		{
+			name:    "NoMatchingPins",
+			pins:    []Pin{Pin(make([]byte, 32))},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := URL(srv.URL, tt.pins)
+			if err != nil {
+				t.Fatalf("URL(...): %v", err)
+			}
+			got, err := s.Get("")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("s.Get(): want error %v, got %v", tt.wantErr, err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("s.Get(): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    string
+		wantErr bool
+	}{
+		{name: "ServiceAccount", spec: "serviceaccount"},
+		{name: "File", spec: "file:/ca.crt"},
+		{name: "URL", spec: "https://example.org/ca.crt#sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+		{name: "URLWithoutPin", spec: "https://example.org/ca.crt", wantErr: true},
+		{name: "URLWithBadPin", spec: "https://example.org/ca.crt#md5:00", wantErr: true},
+		{name: "InsecureURL", spec: "http://example.org/ca.crt#sha256:0000000000000000000000000000000000000000000000000000000000000000", wantErr: true},
+		{name: "InvalidInline", spec: "inline:UEVN", wantErr: true},
+		{name: "ClusterInfoToken", spec: "cluster-info#token:abcdef.0123456789abcdef"},
+		{name: "ClusterInfoPin", spec: "cluster-info#sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+		{name: "ClusterInfoInvalidToken", spec: "cluster-info#token:wat", wantErr: true},
+		{name: "ClusterInfoUnverified", spec: "cluster-info", wantErr: true},
+		{name: "URLWithToken", spec: "https://example.org/ca.crt#token:abcdef.0123456789abcdef", wantErr: true},
+		{name: "Unknown", spec: "wat", wantErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSource(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSource(%q): want error %v, got %v", tt.spec, tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestResolverTemplate(t *testing.T) {
+	_, saPEM := newCA(t, "serviceaccount")
+	_, filePEM := newCA(t, "file")
+	_, overridePEM := newCA(t, "override")
+
+	saPath := DefaultAPITokenMountPath + "/ca.crt"
+
+	cases := []struct {
+		name  string
+		files map[string][]byte
+		oo    []Option
+		cfg   *api.Config
+		want  map[string]*api.Cluster
+	}{
+		{
+			name:  "NoDefault",
+			files: map[string][]byte{saPath: saPEM},
+			cfg: &api.Config{Clusters: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org", CertificateAuthorityData: []byte("PEM")},
+				"b": &api.Cluster{Server: "https://b.example.org"},
+			}},
+			want: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org", CertificateAuthorityData: []byte("PEM")},
+				"b": &api.Cluster{Server: "https://b.example.org"},
+			},
+		},
+		{
+			name:  "DefaultServiceAccount",
+			files: map[string][]byte{saPath: saPEM},
+			oo:    []Option{Default(ServiceAccount())},
+			cfg: &api.Config{Clusters: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org", CertificateAuthorityData: []byte("PEM")},
+				"b": &api.Cluster{Server: "https://b.example.org"},
+			}},
+			want: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org", CertificateAuthorityData: []byte("PEM")},
+				"b": &api.Cluster{Server: "https://b.example.org", CertificateAuthorityData: saPEM},
+			},
+		},
+		{
+			name:  "MissingDefault",
+			files: map[string][]byte{},
+			oo:    []Option{Default(ServiceAccount())},
+			cfg: &api.Config{Clusters: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org"},
+			}},
+			want: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org"},
+			},
+		},
+		{
+			name:  "FileAndOverride",
+			files: map[string][]byte{"/ca.crt": filePEM},
+			oo:    []Option{ForCluster("b", Inline(overridePEM))},
+			cfg: &api.Config{Clusters: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org", CertificateAuthority: "/ca.crt"},
+				"b": &api.Cluster{Server: "https://b.example.org", CertificateAuthorityData: []byte("PEM")},
+			}},
+			want: map[string]*api.Cluster{
+				"a": &api.Cluster{Server: "https://a.example.org", CertificateAuthorityData: filePEM},
+				"b": &api.Cluster{Server: "https://b.example.org", CertificateAuthorityData: overridePEM},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			appFs = afero.NewMemMapFs()
+			for filename, content := range tt.files {
+				if err := afero.WriteFile(appFs, filename, content, 0644); err != nil {
+					t.Errorf("error writing file %q: %v", filename, err)
+				}
+			}
+
+			r, err := NewResolver(append(tt.oo, Logger(zap.NewNop()))...)
+			if err != nil {
+				t.Fatalf("NewResolver(...): %v", err)
+			}
+
+			orig := &api.Config{Clusters: map[string]*api.Cluster{}}
+			for name, c := range tt.cfg.Clusters {
+				cc := *c
+				orig.Clusters[name] = &cc
+			}
+
+			got, err := r.Template(template.Static(tt.cfg)).Get()
+			if err != nil {
+				t.Fatalf("r.Template(...).Get(): %v", err)
+			}
+			if diff := deep.Equal(got.Clusters, tt.want); diff != nil {
+				t.Errorf("r.Template(...).Get(): got != want: %v", diff)
+			}
+			if diff := deep.Equal(tt.cfg, orig); diff != nil {
+				t.Errorf("r.Template(...).Get(): modified template: %v", diff)
+			}
+		})
+	}
+}
+
+type countingSource struct {
+	data []byte
+	gets int
+}
+
+func (s *countingSource) Get(string) ([]byte, error) {
+	s.gets++
+	return s.data, nil
+}
+
+func TestResolverCacheExpiry(t *testing.T) {
+	src := &countingSource{data: []byte("PEM")}
+	r, err := NewResolver(Logger(zap.NewNop()), Default(src), CacheTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("NewResolver(...): %v", err)
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	c := &api.Cluster{Server: "https://a.example.org"}
+	for _, wantGets := range []int{1, 1} {
+		if _, err := r.Resolve("a", c); err != nil {
+			t.Fatalf("r.Resolve(...): %v", err)
+		}
+		if diff := deep.Equal(src.gets, wantGets); diff != nil {
+			t.Errorf("src.Get(...): calls: got != want: %v", diff)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := r.Resolve("a", c); err != nil {
+		t.Fatalf("r.Resolve(...): %v", err)
+	}
+	if diff := deep.Equal(src.gets, 2); diff != nil {
+		t.Errorf("src.Get(...): calls after expiry: got != want: %v", diff)
+	}
+}
@@ -0,0 +1,141 @@
+package ca
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	clusterInfoPath         = "/api/v1/namespaces/kube-public/configmaps/cluster-info"
+	clusterInfoKubeconfig   = "kubeconfig"
+	clusterInfoJWSPrefix    = "jws-kubeconfig-"
+	clusterInfoJWSAlgorithm = "HS256"
+
+	sourceClusterInfo = "cluster-info"
+	trustPrefixToken  = "token:"
+)
+
+var (
+	// ErrNoTrust indicates an attempt to fetch cluster-info without a way to
+	// verify it.
+	ErrNoTrust = errors.New("a bootstrap token or at least one public key pin is required")
+
+	// ErrInvalidToken indicates a malformed bootstrap token.
+	ErrInvalidToken = errors.New("bootstrap token must be of the form [a-z0-9]{6}.[a-z0-9]{16}")
+
+	// ErrInvalidSignature indicates a cluster-info ConfigMap whose kubeconfig
+	// was not signed by the supplied bootstrap token.
+	ErrInvalidSignature = errors.New("cluster-info kubeconfig signature is invalid")
+
+	tokenRegexp = regexp.MustCompile(`^([a-z0-9]{6})\.([a-z0-9]{16})$`)
+)
+
+type clusterInfo struct {
+	*fetchOptions
+	pins     []Pin
+	tokenID  string
+	tokenKey string
+}
+
+// ClusterInfo returns a Source that discovers the CA bundle of a cluster from
+// the anonymously readable kube-public/cluster-info ConfigMap, as kubeadm
+// does when joining a node. The ConfigMap is verified using either the JWS
+// signature made with the supplied bootstrap token, the supplied public key
+// pins, or both. When pins are supplied only certificates matching them are
+// returned.
+func ClusterInfo(pins []Pin, token string, oo ...FetchOption) (Source, error) {
+	if len(pins) == 0 && token == "" {
+		return nil, ErrNoTrust
+	}
+	ci := &clusterInfo{fetchOptions: newFetchOptions(oo...), pins: pins}
+	if token != "" {
+		m := tokenRegexp.FindStringSubmatch(token)
+		if m == nil {
+			return nil, ErrInvalidToken
+		}
+		ci.tokenID, ci.tokenKey = m[1], m[2]
+	}
+	return ci, nil
+}
+
+func (ci *clusterInfo) Get(server string) ([]byte, error) {
+	b, err := ci.fetch(strings.TrimSuffix(server, "/") + clusterInfoPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch cluster-info")
+	}
+	cm := &v1.ConfigMap{}
+	if err := json.Unmarshal(b, cm); err != nil {
+		return nil, errors.Wrap(err, "cannot parse cluster-info")
+	}
+	kc := cm.Data[clusterInfoKubeconfig]
+
+	if ci.tokenID != "" {
+		if err := verifyDetachedJWS(kc, cm.Data[clusterInfoJWSPrefix+ci.tokenID], ci.tokenID, ci.tokenKey); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg, err := clientcmd.Load([]byte(kc))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse cluster-info kubeconfig")
+	}
+	if len(cfg.Clusters) != 1 {
+		return nil, errors.Errorf("cluster-info kubeconfig contains %d clusters, expected 1", len(cfg.Clusters))
+	}
+	var bundle []byte
+	for _, c := range cfg.Clusters {
+		bundle = c.CertificateAuthorityData
+	}
+
+	if len(ci.pins) > 0 {
+		p, err := pinned(bundle, ci.pins)
+		return p, errors.Wrap(err, "cannot verify cluster-info CA bundle")
+	}
+	if _, err := parseCertificates(bundle); err != nil {
+		return nil, errors.Wrap(err, "cannot parse cluster-info CA bundle")
+	}
+	return bundle, nil
+}
+
+// verifyDetachedJWS verifies the detached JWS (i.e. header..signature) with
+// which Kubernetes' bootstrap signer signs the cluster-info kubeconfig.
+func verifyDetachedJWS(payload, jws, tokenID, tokenKey string) error {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return ErrInvalidSignature
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	h := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}{}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return ErrInvalidSignature
+	}
+	if h.Algorithm != clusterInfoJWSAlgorithm || (h.KeyID != "" && h.KeyID != tokenID) {
+		return ErrInvalidSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(tokenKey))
+	mac.Write([]byte(parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)))) // nolint: errcheck, gas
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
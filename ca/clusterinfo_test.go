@@ -0,0 +1,104 @@
+package ca
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func sign(payload, tokenID, tokenKey string) string {
+	h := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"` + tokenID + `"}`))
+	mac := hmac.New(sha256.New, []byte(tokenKey))
+	mac.Write([]byte(h + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)))) // nolint: errcheck
+	return h + ".." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestClusterInfo(t *testing.T) {
+	c, caPEM := newCA(t, "cluster")
+	other, _ := newCA(t, "other")
+
+	kc, err := clientcmd.Write(api.Config{Clusters: map[string]*api.Cluster{
+		"": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: caPEM},
+	}})
+	if err != nil {
+		t.Fatalf("clientcmd.Write(...): %v", err)
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != clusterInfoPath {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&v1.ConfigMap{Data: map[string]string{ // nolint: errcheck
+			clusterInfoKubeconfig:           string(kc),
+			clusterInfoJWSPrefix + "abcdef": sign(string(kc), "abcdef", "0123456789abcdef"),
+			clusterInfoJWSPrefix + "forged": sign(string(kc), "forged", "fedcba9876543210"),
+		}})
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name    string
+		pins    []Pin
+		token   string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:  "Token",
+			token: "abcdef.0123456789abcdef",
+			want:  caPEM,
+		},
+		{
+			name: "Pin",
+			pins: []Pin{PinFor(c)},
+			want: caPEM,
+		},
+		{
+			name:  "TokenAndPin",
+			pins:  []Pin{PinFor(c)},
+			token: "abcdef.0123456789abcdef",
+			want:  caPEM,
+		},
+		{
+			name:    "WrongTokenSecret",
+			token:   "abcdef.fedcba9876543210",
+			wantErr: true,
+		},
+		{
+			name:    "UnknownToken",
+			token:   "zzzzzz.0123456789abcdef",
+			wantErr: true,
+		},
+		{
+			name:    "WrongPin",
+			pins:    []Pin{PinFor(other)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ClusterInfo(tt.pins, tt.token)
+			if err != nil {
+				t.Fatalf("ClusterInfo(...): %v", err)
+			}
+			got, err := s.Get(srv.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("s.Get(%q): want error %v, got %v", srv.URL, tt.wantErr, err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("s.Get(%q): got != want: %v", srv.URL, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package ca
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/template"
+)
+
+// DefaultCacheTTL is the default time for which resolved CA bundles are
+// cached.
+const DefaultCacheTTL = 1 * time.Hour
+
+type cacheKey struct {
+	s      Source
+	server string
+}
+
+type cacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// A Resolver resolves the CA data of the clusters in a kubecfg template. Each
+// CA bundle is loaded once per source and server, then cached until it
+// expires.
+type Resolver struct {
+	log      *zap.Logger
+	clusters map[string]Source
+	fallback Source
+	ttl      time.Duration
+	now      func() time.Time
+
+	mx    sync.Mutex
+	files map[string]Source
+	cache map[cacheKey]cacheEntry
+}
+
+// An Option represents a Resolver option.
+type Option func(*Resolver) error
+
+// Logger allows the use of a bespoke Zap logger.
+func Logger(l *zap.Logger) Option {
+	return func(r *Resolver) error {
+		r.log = l
+		return nil
+	}
+}
+
+// ForCluster resolves the CA data of the named cluster using the supplied
+// source, regardless of any CA data specified by the template.
+func ForCluster(name string, s Source) Option {
+	return func(r *Resolver) error {
+		r.clusters[name] = s
+		return nil
+	}
+}
+
+// Default resolves the CA data of clusters that do not specify any using the
+// supplied source. Clusters without CA data are left as is by default.
+func Default(s Source) Option {
+	return func(r *Resolver) error {
+		r.fallback = s
+		return nil
+	}
+}
+
+// CacheTTL sets the time for which resolved CA bundles are cached, after which
+// they are loaded again. This allows rotated CAs to be picked up.
+func CacheTTL(d time.Duration) Option {
+	return func(r *Resolver) error {
+		if d <= 0 {
+			return errors.New("CA cache TTL must be positive")
+		}
+		r.ttl = d
+		return nil
+	}
+}
+
+// NewResolver returns a new CA resolver.
+func NewResolver(oo ...Option) (*Resolver, error) {
+	l, err := zap.NewProduction()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default logger")
+	}
+
+	r := &Resolver{
+		log:      l,
+		clusters: make(map[string]Source),
+		ttl:      DefaultCacheTTL,
+		now:      time.Now,
+		files:    make(map[string]Source),
+		cache:    make(map[cacheKey]cacheEntry),
+	}
+	for _, o := range oo {
+		if err := o(r); err != nil {
+			return nil, errors.Wrap(err, "cannot apply resolver option")
+		}
+	}
+	return r, nil
+}
+
+// source returns the Source from which the named cluster's CA data should be
+// resolved, or nil if the cluster's CA data should be left as is.
+func (r *Resolver) source(name string, c *api.Cluster) Source {
+	if s, ok := r.clusters[name]; ok {
+		return s
+	}
+	if len(c.CertificateAuthorityData) > 0 {
+		return nil
+	}
+	if c.CertificateAuthority != "" {
+		// The CA file exists on the Kuberos host, not the user's machine.
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		if _, ok := r.files[c.CertificateAuthority]; !ok {
+			r.files[c.CertificateAuthority] = File(c.CertificateAuthority)
+		}
+		return r.files[c.CertificateAuthority]
+	}
+	return r.fallback
+}
+
+func (r *Resolver) get(s Source, server string) ([]byte, error) {
+	k := cacheKey{s: s, server: server}
+
+	r.mx.Lock()
+	e, ok := r.cache[k]
+	r.mx.Unlock()
+	if ok && r.now().Before(e.expires) {
+		return e.data, nil
+	}
+
+	b, err := s.Get(server)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	now := r.now()
+	// Sweep expired bundles, e.g. of servers no longer in the template.
+	for k, e := range r.cache {
+		if !now.Before(e.expires) {
+			delete(r.cache, k)
+		}
+	}
+	r.cache[k] = cacheEntry{data: b, expires: now.Add(r.ttl)}
+	return b, nil
+}
+
+// Resolve returns a copy of the supplied cluster with its CA data resolved.
+// The supplied cluster is never modified.
+func (r *Resolver) Resolve(name string, c *api.Cluster) (*api.Cluster, error) {
+	rc := *c
+	s := r.source(name, c)
+	if s == nil {
+		return &rc, nil
+	}
+	b, err := r.get(s, c.Server)
+	if err != nil {
+		return &rc, errors.Wrapf(err, "cannot resolve CA data for cluster %s", name)
+	}
+	rc.CertificateAuthority = ""
+	rc.CertificateAuthorityData = b
+	return &rc, nil
+}
+
+type resolved struct {
+	r *Resolver
+	s template.Source
+}
+
+// Template returns a template.Source that resolves the CA data of each
+// cluster of the supplied Source. Clusters whose CA data cannot be resolved
+// are logged and returned as is.
+func (r *Resolver) Template(s template.Source) template.Source {
+	return &resolved{r: r, s: s}
+}
+
+func (rs *resolved) Get() (*api.Config, error) {
+	cfg, err := rs.s.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	c := *cfg
+	c.Clusters = make(map[string]*api.Cluster, len(cfg.Clusters))
+	for name, cluster := range cfg.Clusters {
+		rc, err := rs.r.Resolve(name, cluster)
+		if err != nil {
+			rs.r.log.Info("cannot resolve CA data", zap.String("cluster", name), zap.Error(err))
+		}
+		c.Clusters[name] = rc
+	}
+	return &c, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/negz/kuberos/config"
+)
+
+// Formats in which API server configuration may be printed.
+const (
+	formatAuthenticationConfig = "authentication-config"
+	formatFlags                = "flags"
+)
+
+type apiServerConfig struct {
+	cmd        *kingpin.CmdClause
+	issuerURL  *string
+	clientID   *string
+	format     *string
+	apiVersion *string
+}
+
+func addAPIServerConfig(app *kingpin.Application) *apiServerConfig {
+	cmd := app.Command("apiserver-config", "Print Kubernetes API server configuration that authenticates the ID tokens in kuberos' kubecfgs.")
+	return &apiServerConfig{
+		cmd:       cmd,
+		issuerURL: cmd.Arg("oidc-issuer-url", "OpenID Connect issuer URL.").String(),
+		clientID:  cmd.Arg("client-id", "OAuth2 client ID.").String(),
+		format: cmd.Flag("format", "Print an AuthenticationConfiguration for --authentication-config, or --oidc-* flags.").
+			Default(formatAuthenticationConfig).
+			Enum(formatAuthenticationConfig, formatFlags),
+		apiVersion: cmd.Flag("api-version", "API version of the AuthenticationConfiguration.").
+			Default(config.AuthenticationConfigurationV1Beta1).
+			Enum(config.AuthenticationConfigurationVersions...),
+	}
+}
+
+func (a *apiServerConfig) run(c *config.Config) {
+	if *a.issuerURL != "" {
+		c.Issuer.URL = *a.issuerURL
+	}
+	if *a.clientID != "" {
+		c.Client.ID = *a.clientID
+	}
+
+	if *a.format == formatFlags {
+		flags, err := c.APIServerFlags()
+		kingpin.FatalIfError(err, "")
+		if c.Policy.EmailDomain != "" {
+			fmt.Println("# --oidc-* flags cannot restrict users to an email domain. Use --format=" + formatAuthenticationConfig + ".")
+		}
+		fmt.Println(strings.Join(flags, "\n"))
+		return
+	}
+
+	ac, err := c.AuthenticationConfiguration(*a.apiVersion)
+	kingpin.FatalIfError(err, "")
+	y, err := yaml.Marshal(ac)
+	kingpin.FatalIfError(err, "cannot marshal AuthenticationConfiguration")
+	fmt.Print(string(y))
+}
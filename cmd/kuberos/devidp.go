@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/negz/kuberos/oidctest"
+
+	"go.uber.org/zap"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// devIdP runs a mock OpenID Connect provider for local development.
+type devIdP struct {
+	cmd *kingpin.CmdClause
+
+	issuer       *string
+	clientID     *string
+	clientSecret *string
+	subject      *string
+	email        *string
+	groups       *[]string
+	claims       *map[string]string
+	overage      *bool
+	scopes       *[]string
+	lifetime     *time.Duration
+	failures     *[]string
+}
+
+func addDevIdP(app *kingpin.Application) *devIdP {
+	failures := make([]string, 0, len(oidctest.Failures))
+	for _, f := range oidctest.Failures {
+		failures = append(failures, string(f))
+	}
+
+	c := app.Command("dev-idp", "Run a mock OpenID Connect provider that approves every login, for local development.")
+	return &devIdP{
+		cmd:          c,
+		issuer:       c.Flag("issuer", "Issuer URL at which to serve the provider. Kuberos must reach it at this URL.").Default("http://localhost:10004").String(),
+		clientID:     c.Flag("client-id", "OAuth2 client ID to accept.").Default(oidctest.DefaultClientID).String(),
+		clientSecret: c.Flag("client-secret", "OAuth2 client secret to accept.").Default(oidctest.DefaultClientSecret).String(),
+		subject:      c.Flag("subject", "Subject of issued ID tokens.").Default(oidctest.DefaultSubject).String(),
+		email:        c.Flag("email", "Email claim of issued ID tokens.").Default(oidctest.DefaultEmail).String(),
+		groups:       c.Flag("group", "Group claim of issued ID tokens. May be repeated.").Strings(),
+		claims:       c.Flag("claim", "Additional string claim of issued ID tokens. May be repeated.").PlaceHolder("CLAIM=VALUE").StringMap(),
+		overage:      c.Flag("group-overage", "Serve groups as a distributed claim, like Azure AD does for users in many groups.").Bool(),
+		scopes:       c.Flag("scopes-supported", "Scopes to advertise via discovery. Omit offline_access to mimic Google.").Default(oidctest.DefaultScopesSupported...).Strings(),
+		lifetime:     c.Flag("token-lifetime", "Lifetime of issued ID tokens.").Default(oidctest.DefaultTokenLifetime.String()).Duration(),
+		failures:     c.Flag("fail", "Inject a failure. May be repeated.").Enums(failures...),
+	}
+}
+
+func (d *devIdP) run(log *zap.Logger) {
+	u, err := url.Parse(*d.issuer)
+	kingpin.FatalIfError(err, "cannot parse issuer URL")
+	_, port, err := net.SplitHostPort(u.Host)
+	kingpin.FatalIfError(err, "issuer URL must include a port")
+
+	claims := map[string]interface{}{"email": *d.email}
+	if len(*d.groups) > 0 {
+		claims["groups"] = *d.groups
+	}
+	for k, v := range *d.claims {
+		claims[k] = v
+	}
+	ff := make([]oidctest.Failure, 0, len(*d.failures))
+	for _, f := range *d.failures {
+		ff = append(ff, oidctest.Failure(f))
+	}
+
+	oo := []oidctest.Option{
+		oidctest.ClientID(*d.clientID),
+		oidctest.ClientSecret(*d.clientSecret),
+		oidctest.Subject(*d.subject),
+		oidctest.Claims(claims),
+		oidctest.ScopesSupported(*d.scopes...),
+		oidctest.TokenLifetime(*d.lifetime),
+		oidctest.Fail(ff...),
+	}
+	if *d.overage {
+		oo = append(oo, oidctest.GroupOverage())
+	}
+	p, err := oidctest.New(*d.issuer, oo...)
+	kingpin.FatalIfError(err, "cannot create OIDC provider")
+
+	log.Info("serving mock OIDC provider",
+		zap.String("issuer", p.Issuer()),
+		zap.String("clientID", *d.clientID),
+		zap.String("subject", *d.subject),
+		zap.String("failures", strings.Join(*d.failures, ",")))
+	log.Info("shutdown", zap.Error(http.ListenAndServe(net.JoinHostPort("", port), logRequests(p, log))))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"github.com/negz/kuberos/config"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// A binder binds command-line flags to configuration fields. Flags take their
+// defaults from config.Default(), and override the configuration file only
+// when they are set explicitly, either on the command-line or via environment
+// variables.
+type binder struct {
+	defaults *config.Config
+	flags    []*binding
+}
+
+type binding struct {
+	flag  *kingpin.FlagClause
+	set   bool
+	apply func(*config.Config)
+}
+
+func newBinder() *binder {
+	return &binder{defaults: config.Default()}
+}
+
+func (b *binder) bind(f *kingpin.FlagClause, apply func(*config.Config)) {
+	fb := &binding{flag: f, apply: apply}
+	f.Action(func(_ *kingpin.ParseContext) error {
+		fb.set = true
+		return nil
+	})
+	b.flags = append(b.flags, fb)
+}
+
+// String binds a string flag to the supplied field.
+func (b *binder) String(f *kingpin.FlagClause, field func(*config.Config) *string) {
+	v := new(string)
+	if d := *field(b.defaults); d != "" {
+		f.Default(d)
+	}
+	f.StringVar(v)
+	b.bind(f, func(c *config.Config) { *field(c) = *v })
+}
+
+// Bool binds a boolean flag to the supplied field.
+func (b *binder) Bool(f *kingpin.FlagClause, field func(*config.Config) *bool) {
+	v := new(bool)
+	f.BoolVar(v)
+	b.bind(f, func(c *config.Config) { *field(c) = *v })
+}
+
+// Strings binds a repeatable string flag to the supplied field.
+func (b *binder) Strings(f *kingpin.FlagClause, field func(*config.Config) *[]string) {
+	v := new([]string)
+	if d := *field(b.defaults); len(d) > 0 {
+		f.Default(d...)
+	}
+	f.StringsVar(v)
+	b.bind(f, func(c *config.Config) { *field(c) = *v })
+}
+
+// StringMap binds a repeatable KEY=VALUE flag to the supplied field.
+func (b *binder) StringMap(f *kingpin.FlagClause, field func(*config.Config) *map[string]string) {
+	v := new(map[string]string)
+	*v = map[string]string{}
+	f.StringMapVar(v)
+	b.bind(f, func(c *config.Config) { *field(c) = *v })
+}
+
+// Duration binds a duration flag to the supplied field.
+func (b *binder) Duration(f *kingpin.FlagClause, field func(*config.Config) *config.Duration) {
+	v := new(time.Duration)
+	if d := time.Duration(*field(b.defaults)); d != 0 {
+		f.Default(d.String())
+	}
+	f.DurationVar(v)
+	b.bind(f, func(c *config.Config) { *field(c) = config.Duration(*v) })
+}
+
+// Apply the flags that were set explicitly to the supplied configuration.
+// It must be called after the command-line has been parsed.
+func (b *binder) Apply(c *config.Config) {
+	for _, fb := range b.flags {
+		if fb.set || fb.flag.HasEnvarValue() {
+			fb.apply(c)
+		}
+	}
+}
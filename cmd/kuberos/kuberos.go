@@ -2,27 +2,41 @@ package main
 
 import (
 	"context"
-	"io"
+	"crypto/x509"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/negz/kuberos"
+	"github.com/negz/kuberos/audit"
+	"github.com/negz/kuberos/ca"
+	"github.com/negz/kuberos/config"
 	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/health"
+	"github.com/negz/kuberos/metrics"
+	"github.com/negz/kuberos/redact"
+	"github.com/negz/kuberos/selftest"
+	"github.com/negz/kuberos/template"
+	"github.com/negz/kuberos/tlsconfig"
 	"github.com/rakyll/statik/fs"
 
 	_ "github.com/negz/kuberos/statik"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -33,7 +47,7 @@ func logRequests(h http.Handler, log *zap.Logger) http.Handler {
 		log.Info("request",
 			zap.String("host", r.Host),
 			zap.String("method", r.Method),
-			zap.String("url", r.URL.String()),
+			zap.String("url", redact.URL(r.URL)),
 			zap.String("agent", r.UserAgent()),
 			zap.String("addr", r.RemoteAddr))
 		log.Debug("request", zap.Any("headers", r.Header))
@@ -43,61 +57,319 @@ func logRequests(h http.Handler, log *zap.Logger) http.Handler {
 
 func main() {
 	var (
-		app         = kingpin.New(filepath.Base(os.Args[0]), "Provides OIDC authentication configuration for kubectl.").DefaultEnvars()
-		listen      = app.Flag("listen", "Address at which to expose HTTP webhook.").Default(":10003").String()
-		debug       = app.Flag("debug", "Run with debug logging.").Short('d').Bool()
-		scopes      = app.Flag("scopes", "List of additional scopes to provide in token.").Default("profile", "email").Strings()
-		emailDomain = app.Flag("email-domain", "The eamil domain to restrict access to.").String()
-
-		grace            = app.Flag("shutdown-grace-period", "Wait this long for sessions to end before shutting down.").Default("1m").Duration()
-		shutdownEndpoint = app.Flag("shutdown-endpoint", "Insecure HTTP endpoint path (e.g., /quitquitquit) that responds to a GET to shut down kuberos.").String()
-
-		issuerURL        = app.Arg("oidc-issuer-url", "OpenID Connect issuer URL.").URL()
-		clientID         = app.Arg("client-id", "OAuth2 client ID.").String()
-		clientSecretFile = app.Arg("client-secret-file", "File containing OAuth2 client secret.").ExistingFile()
-		templateFile     = app.Arg("kubecfg-template", "A kubecfg file containing clusters to populate with a user and contexts.").ExistingFile()
+		app = kingpin.New(filepath.Base(os.Args[0]), "Provides OIDC authentication configuration for kubectl.").DefaultEnvars()
+		cfg = app.Flag("config", "YAML configuration file. Flags and their environment variables take precedence over it.").ExistingFile()
+		b   = newBinder()
+
+		serveCmd         = app.Command("serve", "Serve kubecfgs to kubectl users.").Default()
+		issuerURL        = serveCmd.Arg("oidc-issuer-url", "OpenID Connect issuer URL.").String()
+		clientID         = serveCmd.Arg("client-id", "OAuth2 client ID.").String()
+		clientSecretFile = serveCmd.Arg("client-secret-file", "File containing OAuth2 client secret.").ExistingFile()
+		templateFile     = serveCmd.Arg("kubecfg-template", "A kubecfg file containing clusters to populate with a user and contexts.").ExistingFile()
+
+		configCmd   = app.Command("config", "Work with configuration files.")
+		validateCmd = configCmd.Command("validate", "Validate the configuration, including any flags, and exit.")
+
+		idp       = addDevIdP(app)
+		apiServer = addAPIServerConfig(app)
 	)
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	b.String(app.Flag("listen", "Address at which to expose HTTP webhook."), func(c *config.Config) *string { return &c.Listeners.Listen })
+	b.Bool(app.Flag("debug", "Run with debug logging.").Short('d'), func(c *config.Config) *bool { return &c.Logging.Debug })
+	b.Strings(app.Flag("scopes", "List of additional scopes to provide in token."), func(c *config.Config) *[]string { return &c.Client.Scopes })
+	b.String(app.Flag("username-claim", "ID token claim to use as the username. Should match the API servers' --oidc-username-claim."), func(c *config.Config) *string { return &c.Claims.Username })
+	b.String(app.Flag("groups-claim", "ID token claim to use as the user's groups. Should match the API servers' --oidc-groups-claim."), func(c *config.Config) *string { return &c.Claims.Groups })
+	b.String(app.Flag("username-expression", "CEL expression over claims from which to derive usernames (e.g. claims.email.split('@')[0]). Overrides --username-claim."), func(c *config.Config) *string { return &c.Claims.UsernameExpression })
+	b.String(app.Flag("groups-expression", "CEL expression over claims from which to derive groups. Overrides --groups-claim."), func(c *config.Config) *string { return &c.Claims.GroupsExpression })
+	b.Bool(app.Flag("userinfo", "Merge claims from the OIDC provider's UserInfo endpoint into ID token claims."), func(c *config.Config) *bool { return &c.Claims.UserInfo.Enabled })
+	b.Bool(app.Flag("distributed-claims", "Resolve distributed claims, such as Azure AD's groups claim for users in many groups."), func(c *config.Config) *bool { return &c.Claims.DistributedClaims.Enabled })
+	b.String(app.Flag("graph-url", "Microsoft Graph API against which to resolve Azure AD group overage claims."), func(c *config.Config) *string { return &c.Claims.DistributedClaims.GraphURL })
+	b.String(app.Flag("username-prefix", "Prefix API servers prepend to usernames (e.g. oidc:). Should match the API servers' --oidc-username-prefix."), func(c *config.Config) *string { return &c.Claims.UsernamePrefix })
+	b.String(app.Flag("groups-prefix", "Prefix API servers prepend to groups (e.g. oidc:). Should match the API servers' --oidc-groups-prefix."), func(c *config.Config) *string { return &c.Claims.GroupsPrefix })
+	b.String(app.Flag("email-domain", "The eamil domain to restrict access to."), func(c *config.Config) *string { return &c.Policy.EmailDomain })
+	b.String(app.Flag("post-logout-redirect-url", "URL to which the OIDC provider should redirect users after logout. Must be registered with the provider."), func(c *config.Config) *string { return &c.Policy.PostLogoutRedirectURL })
+	b.String(app.Flag("base-path", "Path under which to serve kuberos (e.g. /auth/k8s/)."), func(c *config.Config) *string { return &c.Listeners.BasePath })
+	b.String(app.Flag("callback-path", "Path, relative to --base-path, to which the OIDC provider redirects users after login. Must be registered with the provider."), func(c *config.Config) *string { return &c.Listeners.CallbackPath })
+	b.String(app.Flag("public-url", "URL at which clients reach kuberos (e.g. https://kuberos.example.org/). Overrides the request and any forwarded headers."), func(c *config.Config) *string { return &c.Listeners.PublicURL })
+	b.Strings(app.Flag("trusted-proxy", "CIDR or IP address of a proxy whose Forwarded and X-Forwarded-* headers should be trusted. May be repeated."), func(c *config.Config) *[]string { return &c.Listeners.TrustedProxies })
+	b.Strings(app.Flag("acr-values", "Authentication context class to request of the OIDC provider at login, in order of preference. May be repeated."), func(c *config.Config) *[]string { return &c.Policy.Authentication.ACRValues })
+	b.Duration(app.Flag("max-age", "Ask the OIDC provider to reauthenticate users who authenticated longer ago than this."), func(c *config.Config) *config.Duration { return &c.Policy.Authentication.MaxAge })
+	b.Strings(app.Flag("require-acr", "Authentication context class users must have authenticated with. May be repeated to accept any of several."), func(c *config.Config) *[]string { return &c.Policy.Authentication.Require.ACR })
+	b.Strings(app.Flag("require-amr", "Authentication method users must have authenticated with (e.g. mfa). May be repeated to require several."), func(c *config.Config) *[]string { return &c.Policy.Authentication.Require.AMR })
+	b.Duration(app.Flag("require-max-age", "Refuse to issue credentials to users who authenticated longer ago than this."), func(c *config.Config) *config.Duration { return &c.Policy.Authentication.Require.MaxAge })
+	b.Bool(app.Flag("token-broker", "Refresh tokens via kuberos, keeping the client secret out of generated kubecfgs."), func(c *config.Config) *bool { return &c.Policy.TokenBroker })
+	b.Bool(app.Flag("self-test", "Allow users to test their ID token against each cluster before downloading a kubecfg."), func(c *config.Config) *bool { return &c.Policy.SelfTest.Enabled })
+	b.Duration(app.Flag("self-test-timeout", "Wait this long for each cluster to respond to a self-test."), func(c *config.Config) *config.Duration { return &c.Policy.SelfTest.Timeout })
+	b.Bool(app.Flag("token-review-webhook", "Serve a TokenReview webhook at /tokenreview, allowing API servers to authenticate ID tokens via kuberos."), func(c *config.Config) *bool { return &c.Policy.TokenReview.Enabled })
+	b.Strings(app.Flag("self-test-namespace", "Namespace in which to review the actions users may perform in each cluster. May be repeated."), func(c *config.Config) *[]string { return &c.Policy.SelfTest.Namespaces })
+
+	b.String(app.Flag("tls-cert-file", "File containing a PEM encoded certificate with which to serve HTTPS. Reloaded when it changes."), func(c *config.Config) *string { return &c.Listeners.TLS.CertFile })
+	b.String(app.Flag("tls-key-file", "File containing the PEM encoded private key of --tls-cert-file. Reloaded when it changes."), func(c *config.Config) *string { return &c.Listeners.TLS.KeyFile })
+	b.String(app.Flag("tls-min-version", "Minimum TLS version to serve (1.0, 1.1, 1.2, or 1.3)."), func(c *config.Config) *string { return &c.Listeners.TLS.MinVersion })
+	b.Strings(app.Flag("tls-cipher-suite", "Cipher suite to allow (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). May be repeated. Defaults to Go's defaults."), func(c *config.Config) *[]string { return &c.Listeners.TLS.CipherSuites })
+	b.String(app.Flag("tls-client-ca-file", "File containing PEM encoded CA certificates. When set, admin endpoints require a client certificate signed by one of them."), func(c *config.Config) *string { return &c.Listeners.TLS.ClientCAFile })
+	b.Duration(app.Flag("tls-reload-interval", "Check the TLS certificate and key files for changes this often."), func(c *config.Config) *config.Duration { return &c.Listeners.TLS.ReloadInterval })
+	b.String(app.Flag("http-redirect-listen", "Address at which to redirect HTTP requests to HTTPS."), func(c *config.Config) *string { return &c.Listeners.HTTPRedirectListen })
+
+	b.String(app.Flag("audit-log", "File to which to append audit events as JSON lines, or - for stdout."), func(c *config.Config) *string { return &c.Logging.Audit.File })
+	b.Strings(app.Flag("audit-webhook-url", "URL to which to POST audit events as JSON. May be repeated."), func(c *config.Config) *[]string { return &c.Logging.Audit.Webhooks })
+	b.Duration(app.Flag("audit-webhook-timeout", "Wait this long for an audit webhook to accept an event."), func(c *config.Config) *config.Duration { return &c.Logging.Audit.WebhookTimeout })
+
+	b.Bool(app.Flag("kubernetes-clusters", "Discover clusters from labelled ConfigMaps and Secrets."), func(c *config.Config) *bool { return &c.Templates.Kubernetes.Enabled })
+	b.String(app.Flag("cluster-namespace", "Namespace in which to discover clusters. Defaults to all namespaces."), func(c *config.Config) *string { return &c.Templates.Kubernetes.Namespace })
+	b.String(app.Flag("cluster-selector", "Label selector matching ConfigMaps and Secrets that describe clusters."), func(c *config.Config) *string { return &c.Templates.Kubernetes.Selector })
+	b.Bool(app.Flag("cluster-api-clusters", "Discover clusters from Cluster API kubeconfig Secrets."), func(c *config.Config) *bool { return &c.Templates.ClusterAPI.Enabled })
+	b.String(app.Flag("cluster-api-namespace", "Namespace in which to discover Cluster API clusters. Defaults to all namespaces."), func(c *config.Config) *string { return &c.Templates.ClusterAPI.Namespace })
+	b.String(app.Flag("cluster-api-selector", "Label selector matching Cluster API kubeconfig Secrets to include."), func(c *config.Config) *string { return &c.Templates.ClusterAPI.Selector })
+	b.String(app.Flag("cluster-api-exclude", "Label selector matching Cluster API kubeconfig Secrets to exclude."), func(c *config.Config) *string { return &c.Templates.ClusterAPI.Exclude })
+	b.StringMap(app.Flag("cluster-ca", "Source of a named cluster's CA data (e.g. prod=file:/ca.crt), overriding the template. May be repeated.").PlaceHolder("CLUSTER=SOURCE"), func(c *config.Config) *map[string]string { return &c.Templates.ClusterCAs })
+	b.String(app.Flag("default-cluster-ca", "Source of CA data for clusters that do not specify any (e.g. serviceaccount).").PlaceHolder("SOURCE"), func(c *config.Config) *string { return &c.Templates.DefaultClusterCA })
+	b.Duration(app.Flag("cluster-ca-cache-ttl", "Cache each resolved cluster CA bundle for this long."), func(c *config.Config) *config.Duration { return &c.Templates.ClusterCACacheTTL })
+	b.String(app.Flag("kubeconfig", "Kubecfg file used to discover clusters. Defaults to in-cluster configuration."), func(c *config.Config) *string { return &c.Templates.Kubeconfig })
+
+	b.Duration(app.Flag("health-check-timeout", "Wait this long for readiness checks to complete."), func(c *config.Config) *config.Duration { return &c.Listeners.HealthCheckTimeout })
+	b.Duration(app.Flag("shutdown-grace-period", "Wait this long for sessions to end before shutting down."), func(c *config.Config) *config.Duration { return &c.Listeners.ShutdownGracePeriod })
+	b.String(app.Flag("shutdown-endpoint", "Insecure HTTP endpoint path (e.g., /quitquitquit) that responds to a GET to shut down kuberos."), func(c *config.Config) *string { return &c.Listeners.ShutdownEndpoint })
+
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	if cmd == idp.cmd.FullCommand() {
+		c := config.Default()
+		b.Apply(c)
+		idp.run(newLogger(c.Logging.Debug))
+		return
+	}
+
+	// Precedence, highest first: flags and their environment variables, the
+	// configuration file, then defaults. The positional arguments predate
+	// the configuration file, and are treated as flags.
+	c := config.Default()
+	if *cfg != "" {
+		var err error
+		c, err = config.Load(*cfg)
+		kingpin.FatalIfError(err, "cannot load configuration")
+	}
+	b.Apply(c)
+	if *issuerURL != "" {
+		c.Issuer.URL = *issuerURL
+	}
+	if *clientID != "" {
+		c.Client.ID = *clientID
+	}
+	if *clientSecretFile != "" {
+		c.Client.Secret, c.Client.SecretFile = "", *clientSecretFile
+	}
+	if *templateFile != "" {
+		c.Templates.File = *templateFile
+	}
 
-	var log *zap.Logger
+	// API server configuration requires only the issuer, client, and claims.
+	if cmd == apiServer.cmd.FullCommand() {
+		apiServer.run(c)
+		return
+	}
+
+	kingpin.FatalIfError(c.Validate(), "")
+
+	switch cmd {
+	case validateCmd.FullCommand():
+		_, err := c.ClientSecret()
+		kingpin.FatalIfError(err, "")
+		fmt.Println("configuration is valid")
+	case serveCmd.FullCommand():
+		serve(c)
+	}
+}
+
+func newLogger(debug bool) *zap.Logger {
 	log, err := zap.NewProduction()
-	if *debug {
+	if debug {
 		log, err = zap.NewDevelopment()
 	}
 	kingpin.FatalIfError(err, "cannot create log")
+	return log.WithOptions(zap.WrapCore(redact.Core))
+}
+
+func serve(c *config.Config) {
+	log := newLogger(c.Logging.Debug)
 
-	clientSecret, err := ioutil.ReadFile(*clientSecretFile)
-	kingpin.FatalIfError(err, "cannot read client secret file")
+	clientSecret, err := c.ClientSecret()
+	kingpin.FatalIfError(err, "cannot read client secret")
 
 	ctx := oidc.ClientContext(context.Background(), http.DefaultClient)
-	provider, err := oidc.NewProvider(ctx, (*issuerURL).String())
-	kingpin.FatalIfError(err, "cannot create OIDC provider from issuer %v", *issuerURL)
+	provider, err := oidc.NewProvider(ctx, c.Issuer.URL)
+	kingpin.FatalIfError(err, "cannot create OIDC provider from issuer %v", c.Issuer.URL)
 	log.Debug("established OIDC provider", zap.String("url", provider.Endpoint().TokenURL))
 
-	sr := kuberos.ScopeRequests{OfflineAsScope: kuberos.OfflineAsScope(provider), Scopes: *scopes}
-	cfg := &oauth2.Config{
-		ClientID:     *clientID,
-		ClientSecret: strings.TrimSpace(string(clientSecret)),
+	sr := kuberos.ScopeRequests{OfflineAsScope: kuberos.OfflineAsScope(provider), Scopes: c.Client.Scopes}
+	oc := &oauth2.Config{
+		ClientID:     c.Client.ID,
+		ClientSecret: clientSecret,
 		Endpoint:     provider.Endpoint(),
 		Scopes:       sr.Get(),
 	}
-	e, err := extractor.NewOIDC(provider.Verifier(&oidc.Config{ClientID: *clientID}), extractor.Logger(log), extractor.EmailDomain(*emailDomain))
+	eo := append([]extractor.Option{extractor.Logger(log), extractor.EmailDomain(c.Policy.EmailDomain)}, c.Claims.Options()...)
+	if c.Claims.UserInfo.Enabled {
+		eo = append(eo, extractor.UserInfo(provider))
+	}
+	if d := c.Claims.DistributedClaims; d.Enabled {
+		eo = append(eo, extractor.DistributedClaims(d.GraphURL))
+	}
+	eo = append(eo, extractor.RequireAuthentication(c.Policy.Authentication.Require.Requirement()))
+	e, err := extractor.NewOIDC(provider.Verifier(&oidc.Config{ClientID: c.Client.ID}), eo...)
 	kingpin.FatalIfError(err, "cannot setup OIDC extractor")
 
-	h, err := kuberos.NewHandlers(cfg, e, kuberos.Logger(log))
-	kingpin.FatalIfError(err, "cannot setup HTTP handlers")
+	stop := make(chan struct{})
+	sources := []template.Source{}
+	if c.Templates.File != "" {
+		f, err := template.File(c.Templates.File)
+		kingpin.FatalIfError(err, "cannot load kubecfg template")
+		sources = append(sources, f)
+	}
+	var client kubernetes.Interface
+	if c.Templates.Kubernetes.Enabled || c.Templates.ClusterAPI.Enabled {
+		rc, err := clientcmd.BuildConfigFromFlags("", c.Templates.Kubeconfig)
+		kingpin.FatalIfError(err, "cannot create Kubernetes client configuration")
+		client, err = kubernetes.NewForConfig(rc)
+		kingpin.FatalIfError(err, "cannot create Kubernetes client")
+	}
+	if d := c.Templates.Kubernetes; d.Enabled {
+		k, err := template.NewKubernetes(client,
+			template.Logger(log),
+			template.Namespace(d.Namespace),
+			template.Selector(d.Selector))
+		kingpin.FatalIfError(err, "cannot setup Kubernetes cluster discovery")
+		kingpin.FatalIfError(k.Start(stop), "cannot discover clusters from Kubernetes")
+		sources = append(sources, k)
+	}
+	if d := c.Templates.ClusterAPI; d.Enabled {
+		oo := []template.WatchOption{
+			template.Logger(log),
+			template.Namespace(d.Namespace),
+			template.Selector(d.Selector),
+		}
+		if d.Exclude != "" {
+			oo = append(oo, template.Exclude(d.Exclude))
+		}
+		capi, err := template.NewClusterAPI(client, oo...)
+		kingpin.FatalIfError(err, "cannot setup Cluster API cluster discovery")
+		kingpin.FatalIfError(capi.Start(stop), "cannot discover clusters from Cluster API")
+		sources = append(sources, capi)
+	}
+	if len(sources) == 0 {
+		kingpin.Fatalf("a kubecfg template or cluster discovery is required")
+	}
+
+	ro := []ca.Option{ca.Logger(log), ca.CacheTTL(time.Duration(c.Templates.ClusterCACacheTTL))}
+	for name, spec := range c.Templates.ClusterCAs {
+		src, err := ca.ParseSource(spec)
+		kingpin.FatalIfError(err, "cannot parse CA source for cluster %s", name)
+		ro = append(ro, ca.ForCluster(name, src))
+	}
+	if c.Templates.DefaultClusterCA != "" {
+		src, err := ca.ParseSource(c.Templates.DefaultClusterCA)
+		kingpin.FatalIfError(err, "cannot parse default CA source")
+		ro = append(ro, ca.Default(src))
+	}
+	resolver, err := ca.NewResolver(ro...)
+	kingpin.FatalIfError(err, "cannot setup CA resolver")
+	tmpl := resolver.Template(template.Merge(sources...))
 
-	tmpl, err := clientcmd.LoadFromFile(*templateFile)
-	kingpin.FatalIfError(err, "cannot load kubecfg template %s", *templateFile)
+	endSession, revocation := kuberos.LogoutEndpoints(provider)
+	ho := []kuberos.Option{
+		kuberos.Logger(log),
+		kuberos.BasePath(c.Listeners.BasePath),
+		kuberos.KubeCfgEndpoint(c.Listeners.CallbackPath),
+		kuberos.KubeCfgTemplate(tmpl),
+		kuberos.EndSessionEndpoint(endSession),
+		kuberos.RevocationEndpoint(revocation),
+		kuberos.PostLogoutRedirect(c.Policy.PostLogoutRedirectURL),
+		kuberos.ACRValues(c.Policy.Authentication.ACRValues...),
+		kuberos.MaxAge(time.Duration(c.Policy.Authentication.MaxAge)),
+		kuberos.ClusterAuthentication(c.Policy.Authentication.ClusterRequirements()),
+	}
+	if c.Policy.TokenBroker {
+		ho = append(ho, kuberos.TokenBroker())
+	}
+	if c.Policy.TokenReview.Enabled {
+		ho = append(ho,
+			kuberos.TokenReviewWebhook(c.Claims.UsernamePrefix, c.Claims.GroupsPrefix),
+			kuberos.TokenReviewAuthentication(c.Policy.Authentication.Require.Requirement()))
+	}
+	if c.Policy.SelfTest.Enabled {
+		st, err := selftest.New(
+			selftest.Timeout(time.Duration(c.Policy.SelfTest.Timeout)),
+			selftest.Namespaces(c.Policy.SelfTest.Namespaces...),
+		)
+		kingpin.FatalIfError(err, "cannot create self-tester")
+		ho = append(ho, kuberos.SelfTest(st))
+	}
+	if c.Listeners.PublicURL != "" {
+		u, err := url.Parse(c.Listeners.PublicURL)
+		kingpin.FatalIfError(err, "cannot parse public URL")
+		ho = append(ho, kuberos.PublicURL(u))
+	}
+	trusted, err := kuberos.ParseTrustedProxies(c.Listeners.TrustedProxies)
+	kingpin.FatalIfError(err, "cannot parse trusted proxies")
+	ho = append(ho, kuberos.TrustedProxies(trusted))
+	sinks := []audit.Sink{}
+	switch c.Logging.Audit.File {
+	case "":
+	case "-":
+		sinks = append(sinks, audit.JSONLines(os.Stdout))
+	default:
+		f, err := audit.File(c.Logging.Audit.File)
+		kingpin.FatalIfError(err, "cannot open audit log")
+		sinks = append(sinks, f)
+	}
+	for _, u := range c.Logging.Audit.Webhooks {
+		sinks = append(sinks, audit.Webhook(u, &http.Client{Timeout: time.Duration(c.Logging.Audit.WebhookTimeout)}))
+	}
+	if len(sinks) > 0 {
+		ho = append(ho, kuberos.Audit(audit.Multi(sinks...)))
+	}
+	h, err := kuberos.NewHandlers(oc, e, ho...)
+	kingpin.FatalIfError(err, "cannot setup HTTP handlers")
 
 	r := httprouter.New()
-	s := &http.Server{Addr: *listen, Handler: logRequests(r, log)}
+	s := &http.Server{Addr: c.Listeners.Listen, Handler: logRequests(r, log)}
+	admin := func(h http.Handler) http.Handler { return h }
+
+	t := c.Listeners.TLS
+	serveTLS := t.Enabled()
+	var redirect *http.Server
+	if serveTLS {
+		rl, err := tlsconfig.NewReloader(t.CertFile, t.KeyFile, tlsconfig.Logger(log), tlsconfig.ReloadInterval(time.Duration(t.ReloadInterval)))
+		kingpin.FatalIfError(err, "cannot load TLS certificate")
+		rl.Start(stop)
+		v, err := tlsconfig.ParseVersion(t.MinVersion)
+		kingpin.FatalIfError(err, "cannot parse minimum TLS version")
+		cs, err := tlsconfig.ParseCipherSuites(t.CipherSuites)
+		kingpin.FatalIfError(err, "cannot parse TLS cipher suites")
+		var pool *x509.CertPool
+		if t.ClientCAFile != "" {
+			pool, err = tlsconfig.ClientCAs(t.ClientCAFile)
+			kingpin.FatalIfError(err, "cannot load client CA certificates")
+			admin = tlsconfig.RequireClientCertificate
+		}
+		s.TLSConfig = tlsconfig.Config(rl, v, cs, pool)
+
+		if c.Listeners.HTTPRedirectListen != "" {
+			_, port, err := net.SplitHostPort(c.Listeners.Listen)
+			kingpin.FatalIfError(err, "cannot determine HTTPS port")
+			redirect = &http.Server{Addr: c.Listeners.HTTPRedirectListen, Handler: tlsconfig.Redirect(port)}
+			go func() { log.Info("shutdown", zap.Error(redirect.ListenAndServe())) }()
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Listeners.ShutdownGracePeriod))
 	done := make(chan struct{})
 	shutdown := func() {
+		if redirect != nil {
+			log.Info("shutdown", zap.Error(redirect.Shutdown(ctx)))
+		}
 		log.Info("shutdown", zap.Error(s.Shutdown(ctx)))
+		close(stop)
 		close(done)
 	}
 
@@ -108,33 +380,46 @@ func main() {
 		shutdown()
 	}()
 
+	kingpin.FatalIfError(metrics.Register(prometheus.DefaultRegisterer), "cannot register metrics")
+
 	frontend, err := fs.New()
 	kingpin.FatalIfError(err, "cannot load frontend")
 
-	index, err := frontend.Open(indexPath)
+	f, err := frontend.Open(indexPath)
 	kingpin.FatalIfError(err, "cannot open frontend index %s", indexPath)
+	index, err := ioutil.ReadAll(f)
+	kingpin.FatalIfError(err, "cannot read frontend index %s", indexPath)
 
-	r.ServeFiles("/dist/*filepath", frontend)
-	r.HandlerFunc("GET", "/ui", content(index, filepath.Base(indexPath)))
-	r.HandlerFunc("GET", "/", h.Login)
-	r.HandlerFunc("GET", "/kubecfg", h.KubeCfg)
-	r.HandlerFunc("GET", "/kubecfg.yaml", kuberos.Template(tmpl))
-	r.HandlerFunc("GET", "/healthz", ping())
+	// Routes used by browsers and kubectl are served under the base path.
+	// Operational endpoints are always served at the root path.
+	h.Routes(r, frontend, index)
+	timeout := time.Duration(c.Listeners.HealthCheckTimeout)
+	r.HandlerFunc("GET", "/healthz", health.Handler(timeout))
+	r.HandlerFunc("GET", "/livez", health.Handler(timeout))
+	r.HandlerFunc("GET", "/readyz", health.Handler(timeout,
+		health.OIDCProvider(c.Issuer.URL, http.DefaultClient),
+		health.Template(tmpl),
+		health.ClientSecret(oc.ClientSecret)))
+	r.Handler("GET", "/metrics", admin(promhttp.Handler()))
 
-	if *shutdownEndpoint != "" {
-		r.HandlerFunc("GET", *shutdownEndpoint, run(shutdown))
+	// API servers call the TokenReview webhook directly. Like other
+	// operational endpoints it is served at the root path, and may require a
+	// client certificate.
+	if c.Policy.TokenReview.Enabled {
+		r.Handler("POST", "/tokenreview", admin(http.HandlerFunc(h.TokenReview)))
 	}
 
-	log.Info("shutdown", zap.Error(s.ListenAndServe()))
-	<-done
-	cancel()
-}
+	if c.Listeners.ShutdownEndpoint != "" {
+		r.Handler("GET", c.Listeners.ShutdownEndpoint, admin(run(shutdown)))
+	}
 
-func content(c io.ReadSeeker, filename string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		http.ServeContent(w, r, filename, time.Unix(0, 0), c)
-		r.Body.Close()
+	if serveTLS {
+		log.Info("shutdown", zap.Error(s.ListenAndServeTLS("", "")))
+	} else {
+		log.Info("shutdown", zap.Error(s.ListenAndServe()))
 	}
+	<-done
+	cancel()
 }
 
 func run(fn func()) http.HandlerFunc {
@@ -144,11 +429,3 @@ func run(fn func()) http.HandlerFunc {
 		r.Body.Close()
 	}
 }
-
-func ping() http.HandlerFunc {
-	// TODO(negz): Check kuberos health?
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		r.Body.Close()
-	}
-}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// API versions at which Kubernetes API servers accept structured
+// authentication configuration. v1beta1 is served by Kubernetes 1.30 and
+// later, and v1 by Kubernetes 1.34 and later.
+const (
+	AuthenticationConfigurationV1Beta1 = "apiserver.config.k8s.io/v1beta1"
+	AuthenticationConfigurationV1      = "apiserver.config.k8s.io/v1"
+)
+
+// AuthenticationConfigurationVersions lists the supported API versions of
+// AuthenticationConfiguration.
+var AuthenticationConfigurationVersions = []string{AuthenticationConfigurationV1Beta1, AuthenticationConfigurationV1}
+
+const (
+	// usernamePrefixNone disables the --oidc-username-prefix the API server
+	// would otherwise derive from the issuer URL.
+	usernamePrefixNone = "-"
+
+	claimEmail   = "email"
+	prefixSystem = "system:"
+)
+
+// An AuthenticationConfiguration configures how a Kubernetes API server
+// authenticates requests. It is passed to the API server's
+// --authentication-config flag. Only the fields Kuberos uses are modelled.
+type AuthenticationConfiguration struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	JWT        []JWTAuthenticator `json:"jwt"`
+}
+
+// A JWTAuthenticator authenticates JWTs issued by an OIDC provider.
+type JWTAuthenticator struct {
+	Issuer               JWTIssuer        `json:"issuer"`
+	ClaimValidationRules []ValidationRule `json:"claimValidationRules,omitempty"`
+	ClaimMappings        ClaimMappings    `json:"claimMappings"`
+	UserValidationRules  []ValidationRule `json:"userValidationRules,omitempty"`
+}
+
+// A JWTIssuer is an OIDC provider trusted by the API server.
+type JWTIssuer struct {
+	URL       string   `json:"url"`
+	Audiences []string `json:"audiences"`
+}
+
+// A ValidationRule is a CEL expression that must evaluate to true.
+type ValidationRule struct {
+	Expression string `json:"expression"`
+	Message    string `json:"message,omitempty"`
+}
+
+// ClaimMappings map JWT claims to user attributes.
+type ClaimMappings struct {
+	Username PrefixedClaim  `json:"username"`
+	Groups   *PrefixedClaim `json:"groups,omitempty"`
+	UID      *Claim         `json:"uid,omitempty"`
+	Extra    []ExtraMapping `json:"extra,omitempty"`
+}
+
+// A PrefixedClaim maps a claim, with a prefix, or an expression to a user
+// attribute. The API server requires the prefix whenever the claim is set,
+// even if it is empty, and forbids it when the expression is set.
+type PrefixedClaim struct {
+	Claim      string  `json:"claim,omitempty"`
+	Prefix     *string `json:"prefix,omitempty"`
+	Expression string  `json:"expression,omitempty"`
+}
+
+func prefixedClaim(claim, prefix, expression string) *PrefixedClaim {
+	if expression != "" {
+		return &PrefixedClaim{Expression: expression}
+	}
+	return &PrefixedClaim{Claim: claim, Prefix: &prefix}
+}
+
+// A Claim maps a claim to a user attribute.
+type Claim struct {
+	Claim string `json:"claim"`
+}
+
+func (c *Config) validateAPIServer() error {
+	var problems []string
+	if c.Issuer.URL == "" {
+		problems = append(problems, "issuer.url is required")
+	}
+	if c.Client.ID == "" {
+		problems = append(problems, "client.id is required")
+	}
+	if c.Claims.Username == "" && c.Claims.UsernameExpression == "" {
+		problems = append(problems, "claims.username or claims.usernameExpression is required")
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// APIServerFlags returns the Kubernetes API server --oidc-* flags that
+// authenticate the ID tokens Kuberos issues kubecfgs for.
+func (c *Config) APIServerFlags() ([]string, error) {
+	if err := c.validateAPIServer(); err != nil {
+		return nil, err
+	}
+	if c.Claims.expressions() {
+		return nil, errors.New("claim expressions and validation rules require an AuthenticationConfiguration")
+	}
+	flags := []string{
+		"--oidc-issuer-url=" + c.Issuer.URL,
+		"--oidc-client-id=" + c.Client.ID,
+		"--oidc-username-claim=" + c.Claims.Username,
+	}
+
+	// Unless the username claim is email, the API server prefixes usernames
+	// with the issuer URL by default. Kuberos does not.
+	switch {
+	case c.Claims.UsernamePrefix != "":
+		flags = append(flags, "--oidc-username-prefix="+c.Claims.UsernamePrefix)
+	case c.Claims.Username != claimEmail:
+		flags = append(flags, "--oidc-username-prefix="+usernamePrefixNone)
+	}
+	if c.Claims.Groups != "" {
+		flags = append(flags, "--oidc-groups-claim="+c.Claims.Groups)
+	}
+	if c.Claims.Groups != "" && c.Claims.GroupsPrefix != "" {
+		flags = append(flags, "--oidc-groups-prefix="+c.Claims.GroupsPrefix)
+	}
+	return flags, nil
+}
+
+// AuthenticationConfiguration returns a Kubernetes API server authentication
+// configuration at the supplied API version that authenticates the ID tokens
+// Kuberos issues kubecfgs for. Unlike the --oidc-* flags it can restrict
+// users to the configured email domain.
+func (c *Config) AuthenticationConfiguration(apiVersion string) (*AuthenticationConfiguration, error) {
+	if err := c.validateAPIServer(); err != nil {
+		return nil, err
+	}
+	if !contains(AuthenticationConfigurationVersions, apiVersion) {
+		return nil, errors.Errorf("unsupported AuthenticationConfiguration API version %s", apiVersion)
+	}
+
+	a := JWTAuthenticator{
+		Issuer: JWTIssuer{URL: c.Issuer.URL, Audiences: []string{c.Client.ID}},
+		ClaimMappings: ClaimMappings{
+			Username: *prefixedClaim(c.Claims.Username, c.Claims.UsernamePrefix, c.Claims.UsernameExpression),
+			UID:      &Claim{Claim: "sub"},
+			Extra:    c.Claims.Extra,
+		},
+
+		// Reserved usernames and groups grant privileges no OIDC user should
+		// have. The API server does not prevent them without a prefix.
+		UserValidationRules: []ValidationRule{
+			{
+				Expression: fmt.Sprintf("!user.username.startsWith('%s')", prefixSystem),
+				Message:    fmt.Sprintf("username must not begin with %s", prefixSystem),
+			},
+			{
+				Expression: fmt.Sprintf("user.groups.all(g, !g.startsWith('%s'))", prefixSystem),
+				Message:    fmt.Sprintf("groups must not begin with %s", prefixSystem),
+			},
+		},
+	}
+	if c.Claims.Groups != "" || c.Claims.GroupsExpression != "" {
+		a.ClaimMappings.Groups = prefixedClaim(c.Claims.Groups, c.Claims.GroupsPrefix, c.Claims.GroupsExpression)
+	}
+	a.ClaimValidationRules = append(a.ClaimValidationRules, c.Claims.ValidationRules...)
+	if d := c.Policy.EmailDomain; d != "" {
+		a.ClaimValidationRules = append(a.ClaimValidationRules, ValidationRule{
+			Expression: fmt.Sprintf("has(claims.email) && claims.email.endsWith('@%s')", d),
+			Message:    fmt.Sprintf("email must be in domain %s", d),
+		})
+	}
+
+	return &AuthenticationConfiguration{
+		APIVersion: apiVersion,
+		Kind:       "AuthenticationConfiguration",
+		JWT:        []JWTAuthenticator{a},
+	}, nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
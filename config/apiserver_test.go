@@ -0,0 +1,217 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-test/deep"
+)
+
+func TestAPIServerFlags(t *testing.T) {
+	cases := []struct {
+		name    string
+		modify  func(c *Config)
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "Defaults",
+			want: []string{
+				"--oidc-issuer-url=https://accounts.example.org",
+				"--oidc-client-id=kuberos",
+				"--oidc-username-claim=email",
+				"--oidc-groups-claim=groups",
+			},
+		},
+		{
+			name: "Prefixes",
+			modify: func(c *Config) {
+				c.Claims.UsernamePrefix = "oidc:"
+				c.Claims.GroupsPrefix = "oidc:"
+			},
+			want: []string{
+				"--oidc-issuer-url=https://accounts.example.org",
+				"--oidc-client-id=kuberos",
+				"--oidc-username-claim=email",
+				"--oidc-username-prefix=oidc:",
+				"--oidc-groups-claim=groups",
+				"--oidc-groups-prefix=oidc:",
+			},
+		},
+		{
+			name: "NonEmailUsernameClaim",
+			modify: func(c *Config) {
+				c.Claims.Username = "preferred_username"
+				c.Claims.Groups = ""
+				c.Claims.GroupsPrefix = "ignored:"
+			},
+			want: []string{
+				"--oidc-issuer-url=https://accounts.example.org",
+				"--oidc-client-id=kuberos",
+				"--oidc-username-claim=preferred_username",
+				"--oidc-username-prefix=-",
+			},
+		},
+		{
+			name: "Invalid",
+			modify: func(c *Config) {
+				c.Issuer.URL = ""
+				c.Client.ID = ""
+			},
+			wantErr: "issuer.url is required; client.id is required",
+		},
+		{
+			name:    "Expressions",
+			modify:  func(c *Config) { c.Claims.ValidationRules = []ValidationRule{{Expression: "claims.email_verified"}} },
+			wantErr: "require an AuthenticationConfiguration",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			if tt.modify != nil {
+				tt.modify(c)
+			}
+			got, err := c.APIServerFlags()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("c.APIServerFlags(): want error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("c.APIServerFlags(): %v", err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("c.APIServerFlags(): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestAuthenticationConfiguration(t *testing.T) {
+	cases := []struct {
+		name       string
+		modify     func(c *Config)
+		apiVersion string
+		want       string
+		wantErr    string
+	}{
+		{
+			name:       "Defaults",
+			apiVersion: AuthenticationConfigurationV1Beta1,
+			want: `
+apiVersion: apiserver.config.k8s.io/v1beta1
+kind: AuthenticationConfiguration
+jwt:
+- issuer:
+    url: https://accounts.example.org
+    audiences: [kuberos]
+  claimMappings:
+    username: {claim: email, prefix: ""}
+    groups: {claim: groups, prefix: ""}
+    uid: {claim: sub}
+  userValidationRules:
+  - expression: "!user.username.startsWith('system:')"
+    message: "username must not begin with system:"
+  - expression: "user.groups.all(g, !g.startsWith('system:'))"
+    message: "groups must not begin with system:"
+`,
+		},
+		{
+			name: "EmailDomainAndPrefixes",
+			modify: func(c *Config) {
+				c.Claims.Username = "preferred_username"
+				c.Claims.UsernamePrefix = "oidc:"
+				c.Claims.Groups = ""
+				c.Policy.EmailDomain = "example.org"
+			},
+			apiVersion: AuthenticationConfigurationV1,
+			want: `
+apiVersion: apiserver.config.k8s.io/v1
+kind: AuthenticationConfiguration
+jwt:
+- issuer:
+    url: https://accounts.example.org
+    audiences: [kuberos]
+  claimValidationRules:
+  - expression: "has(claims.email) && claims.email.endsWith('@example.org')"
+    message: "email must be in domain example.org"
+  claimMappings:
+    username: {claim: preferred_username, prefix: "oidc:"}
+    uid: {claim: sub}
+  userValidationRules:
+  - expression: "!user.username.startsWith('system:')"
+    message: "username must not begin with system:"
+  - expression: "user.groups.all(g, !g.startsWith('system:'))"
+    message: "groups must not begin with system:"
+`,
+		},
+		{
+			name: "Expressions",
+			modify: func(c *Config) {
+				c.Claims.UsernameExpression = "claims.email.split('@')[0]"
+				c.Claims.GroupsExpression = "claims.roles"
+				c.Claims.Extra = []ExtraMapping{{Key: "example.org/team", ValueExpression: "claims.team"}}
+				c.Claims.ValidationRules = []ValidationRule{{Expression: "claims.email_verified", Message: "email must be verified"}}
+			},
+			apiVersion: AuthenticationConfigurationV1,
+			want: `
+apiVersion: apiserver.config.k8s.io/v1
+kind: AuthenticationConfiguration
+jwt:
+- issuer:
+    url: https://accounts.example.org
+    audiences: [kuberos]
+  claimValidationRules:
+  - expression: "claims.email_verified"
+    message: "email must be verified"
+  claimMappings:
+    username: {expression: "claims.email.split('@')[0]"}
+    groups: {expression: "claims.roles"}
+    uid: {claim: sub}
+    extra:
+    - key: example.org/team
+      valueExpression: claims.team
+  userValidationRules:
+  - expression: "!user.username.startsWith('system:')"
+    message: "username must not begin with system:"
+  - expression: "user.groups.all(g, !g.startsWith('system:'))"
+    message: "groups must not begin with system:"
+`,
+		},
+		{
+			name:       "UnsupportedVersion",
+			apiVersion: "apiserver.config.k8s.io/v1alpha1",
+			wantErr:    "unsupported AuthenticationConfiguration API version",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			if tt.modify != nil {
+				tt.modify(c)
+			}
+			got, err := c.AuthenticationConfiguration(tt.apiVersion)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("c.AuthenticationConfiguration(...): want error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("c.AuthenticationConfiguration(...): %v", err)
+			}
+			want := &AuthenticationConfiguration{}
+			if err := yaml.Unmarshal([]byte(tt.want), want); err != nil {
+				t.Fatalf("yaml.Unmarshal(...): %v", err)
+			}
+			if diff := deep.Equal(got, want); diff != nil {
+				t.Errorf("c.AuthenticationConfiguration(...): got != want: %v", diff)
+			}
+		})
+	}
+}
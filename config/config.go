@@ -0,0 +1,576 @@
+// Package config loads and validates Kuberos configuration files.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"github.com/negz/kuberos"
+	"github.com/negz/kuberos/audit"
+	"github.com/negz/kuberos/ca"
+	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/health"
+	"github.com/negz/kuberos/selftest"
+	"github.com/negz/kuberos/template"
+	"github.com/negz/kuberos/tlsconfig"
+)
+
+// APIVersion is the version of the configuration file format.
+const APIVersion = "kuberos/v1alpha1"
+
+// Kind is the kind of the configuration file.
+const Kind = "Config"
+
+// Defaults for configuration that is not otherwise specified.
+const (
+	DefaultListen              = ":10003"
+	DefaultBasePath            = "/"
+	DefaultShutdownGracePeriod = time.Minute
+)
+
+// DefaultScopes are the default additional scopes to request.
+var DefaultScopes = []string{"profile", "email"}
+
+// envRegexp matches environment variable references of the form ${VAR}.
+var envRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// A Duration is a time.Duration that is represented in configuration files as
+// a string, e.g. 1m30s.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrap(err, "duration must be a string, e.g. 1m30s")
+	}
+	p, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse duration %q", s)
+	}
+	*d = Duration(p)
+	return nil
+}
+
+// MarshalJSON formats a duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config is the configuration of Kuberos.
+type Config struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Issuer     Issuer    `json:"issuer"`
+	Client     Client    `json:"client"`
+	Claims     Claims    `json:"claims"`
+	Policy     Policy    `json:"policy"`
+	Templates  Templates `json:"templates"`
+	Listeners  Listeners `json:"listeners"`
+	Logging    Logging   `json:"logging"`
+}
+
+// Issuer configures the OpenID Connect provider.
+type Issuer struct {
+	// URL of the OpenID Connect issuer.
+	URL string `json:"url"`
+}
+
+// Client configures the OAuth 2.0 client with which Kuberos authenticates to
+// the OpenID Connect provider.
+type Client struct {
+	ID string `json:"id"`
+
+	// Secret and SecretFile are mutually exclusive. Use ${VAR} to read Secret
+	// from an environment variable.
+	Secret     string `json:"secret,omitempty"`
+	SecretFile string `json:"secretFile,omitempty"`
+
+	// Scopes to request in addition to openid and offline access.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Claims configures how users' identities are extracted from ID tokens. They
+// should match the claims the Kubernetes API servers are configured to use.
+type Claims struct {
+	Username string `json:"username,omitempty"`
+	Groups   string `json:"groups,omitempty"`
+
+	// Prefixes are prepended to usernames and groups authenticated by API
+	// servers, to prevent clashes with other authenticators. They are not
+	// applied to the usernames in generated kubecfgs.
+	UsernamePrefix string `json:"usernamePrefix,omitempty"`
+	GroupsPrefix   string `json:"groupsPrefix,omitempty"`
+
+	// CEL expressions over the claims variable derive usernames and groups
+	// instead of the above claims, and extra attributes. Validation rules
+	// must hold for credentials to be issued. They match the claimMappings
+	// and claimValidationRules of a Kubernetes AuthenticationConfiguration.
+	UsernameExpression string           `json:"usernameExpression,omitempty"`
+	GroupsExpression   string           `json:"groupsExpression,omitempty"`
+	Extra              []ExtraMapping   `json:"extra,omitempty"`
+	ValidationRules    []ValidationRule `json:"validationRules,omitempty"`
+
+	// UserInfo merges claims from the provider's UserInfo endpoint into ID
+	// token claims before they are mapped and validated.
+	UserInfo UserInfo `json:"userInfo,omitempty"`
+
+	// DistributedClaims resolves claims that ID tokens refer to rather than
+	// include, such as Azure AD's groups claim for users in many groups.
+	DistributedClaims DistributedClaims `json:"distributedClaims,omitempty"`
+}
+
+// UserInfo configures requesting claims from the provider's UserInfo
+// endpoint, for providers that omit claims such as groups from ID tokens.
+type UserInfo struct {
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// DistributedClaims configures resolving distributed claims.
+type DistributedClaims struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// GraphURL is the Microsoft Graph API against which Azure AD group
+	// overage claims are resolved.
+	GraphURL string `json:"graphURL,omitempty"`
+}
+
+// An ExtraMapping derives an extra attribute of a user from their claims.
+type ExtraMapping struct {
+	Key             string `json:"key"`
+	ValueExpression string `json:"valueExpression"`
+}
+
+// Options returns the extractor options that implement the claim mapping.
+func (c *Claims) Options() []extractor.Option {
+	oo := []extractor.Option{extractor.GroupsClaim(c.Groups)}
+	if c.Username != "" {
+		oo = append(oo, extractor.UsernameClaim(c.Username))
+	}
+	if c.UsernameExpression != "" {
+		oo = append(oo, extractor.UsernameExpression(c.UsernameExpression))
+	}
+	if c.GroupsExpression != "" {
+		oo = append(oo, extractor.GroupsExpression(c.GroupsExpression))
+	}
+	for _, x := range c.Extra {
+		oo = append(oo, extractor.ExtraExpression(x.Key, x.ValueExpression))
+	}
+	for _, r := range c.ValidationRules {
+		oo = append(oo, extractor.ClaimValidationRule(r.Expression, r.Message))
+	}
+	return oo
+}
+
+// expressions returns true if the claim mapping uses any CEL expressions.
+func (c *Claims) expressions() bool {
+	return c.UsernameExpression != "" || c.GroupsExpression != "" || len(c.Extra) > 0 || len(c.ValidationRules) > 0
+}
+
+// Policy configures who may obtain credentials, and how.
+type Policy struct {
+	EmailDomain           string      `json:"emailDomain,omitempty"`
+	TokenBroker           bool        `json:"tokenBroker,omitempty"`
+	PostLogoutRedirectURL string      `json:"postLogoutRedirectURL,omitempty"`
+	SelfTest              SelfTest    `json:"selfTest,omitempty"`
+	TokenReview           TokenReview `json:"tokenReview,omitempty"`
+
+	Authentication Authentication `json:"authentication,omitempty"`
+}
+
+// Authentication configures how strongly users must authenticate.
+type Authentication struct {
+	// ACRValues and MaxAge are requested of the OIDC provider at login.
+	ACRValues []string `json:"acrValues,omitempty"`
+	MaxAge    Duration `json:"maxAge,omitempty"`
+
+	// Require must be satisfied at login for Kuberos to issue credentials.
+	// Clusters must also be satisfied for the named clusters to be included
+	// in kubecfgs.
+	Require  AuthenticationRequirement            `json:"require,omitempty"`
+	Clusters map[string]AuthenticationRequirement `json:"clusters,omitempty"`
+}
+
+// An AuthenticationRequirement describes how strongly users must have
+// authenticated. Any of the ACR values, and all of the AMR values, must be
+// claimed by the ID token. Its auth_time must be within MaxAge, if set.
+type AuthenticationRequirement struct {
+	ACR    []string `json:"acr,omitempty"`
+	AMR    []string `json:"amr,omitempty"`
+	MaxAge Duration `json:"maxAge,omitempty"`
+}
+
+// Requirement returns the extractor requirement equivalent to r.
+func (r AuthenticationRequirement) Requirement() extractor.AuthenticationRequirement {
+	return extractor.AuthenticationRequirement{ACR: r.ACR, AMR: r.AMR, MaxAge: time.Duration(r.MaxAge)}
+}
+
+// ClusterRequirements returns the extractor requirements of each named
+// cluster.
+func (a *Authentication) ClusterRequirements() map[string]extractor.AuthenticationRequirement {
+	rr := make(map[string]extractor.AuthenticationRequirement, len(a.Clusters))
+	for name, r := range a.Clusters {
+		rr[name] = r.Requirement()
+	}
+	return rr
+}
+
+// SelfTest configures testing ID tokens against each cluster before users
+// download a kubecfg.
+type SelfTest struct {
+	Enabled bool     `json:"enabled,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// Namespaces in which to review the actions users may perform.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// TokenReview configures a webhook token authenticator, for Kubernetes API
+// servers that cannot be configured to authenticate ID tokens themselves.
+type TokenReview struct {
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// Templates configures the sources of the kubecfg template.
+type Templates struct {
+	File              string            `json:"file,omitempty"`
+	Kubeconfig        string            `json:"kubeconfig,omitempty"`
+	Kubernetes        Discovery         `json:"kubernetes,omitempty"`
+	ClusterAPI        Discovery         `json:"clusterAPI,omitempty"`
+	ClusterCAs        map[string]string `json:"clusterCAs,omitempty"`
+	DefaultClusterCA  string            `json:"defaultClusterCA,omitempty"`
+	ClusterCACacheTTL Duration          `json:"clusterCACacheTTL,omitempty"`
+}
+
+// Discovery configures the discovery of clusters from Kubernetes.
+type Discovery struct {
+	Enabled   bool   `json:"enabled,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Selector  string `json:"selector,omitempty"`
+	Exclude   string `json:"exclude,omitempty"`
+}
+
+// Listeners configures how Kuberos serves HTTP.
+type Listeners struct {
+	Listen              string   `json:"listen,omitempty"`
+	BasePath            string   `json:"basePath,omitempty"`
+	CallbackPath        string   `json:"callbackPath,omitempty"`
+	PublicURL           string   `json:"publicURL,omitempty"`
+	TrustedProxies      []string `json:"trustedProxies,omitempty"`
+	TLS                 TLS      `json:"tls,omitempty"`
+	HTTPRedirectListen  string   `json:"httpRedirectListen,omitempty"`
+	ShutdownEndpoint    string   `json:"shutdownEndpoint,omitempty"`
+	ShutdownGracePeriod Duration `json:"shutdownGracePeriod,omitempty"`
+	HealthCheckTimeout  Duration `json:"healthCheckTimeout,omitempty"`
+}
+
+// TLS configures how Kuberos serves HTTPS.
+type TLS struct {
+	CertFile       string   `json:"certFile,omitempty"`
+	KeyFile        string   `json:"keyFile,omitempty"`
+	MinVersion     string   `json:"minVersion,omitempty"`
+	CipherSuites   []string `json:"cipherSuites,omitempty"`
+	ClientCAFile   string   `json:"clientCAFile,omitempty"`
+	ReloadInterval Duration `json:"reloadInterval,omitempty"`
+}
+
+// Enabled returns true if Kuberos should serve HTTPS.
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Logging configures logging and auditing.
+type Logging struct {
+	Debug bool  `json:"debug,omitempty"`
+	Audit Audit `json:"audit,omitempty"`
+}
+
+// Audit configures the audit log.
+type Audit struct {
+	File           string   `json:"file,omitempty"`
+	Webhooks       []string `json:"webhooks,omitempty"`
+	WebhookTimeout Duration `json:"webhookTimeout,omitempty"`
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		APIVersion: APIVersion,
+		Kind:       Kind,
+		Client:     Client{Scopes: append([]string{}, DefaultScopes...)},
+		Claims: Claims{
+			Username:          extractor.DefaultUsernameClaim,
+			Groups:            extractor.DefaultGroupsClaim,
+			DistributedClaims: DistributedClaims{GraphURL: extractor.DefaultGraphURL},
+		},
+		Policy: Policy{SelfTest: SelfTest{
+			Timeout:    Duration(selftest.DefaultTimeout),
+			Namespaces: append([]string{}, selftest.DefaultNamespaces...),
+		}},
+		Templates: Templates{
+			Kubernetes:        Discovery{Selector: template.DefaultSelector},
+			ClusterAPI:        Discovery{Selector: template.DefaultClusterAPISelector},
+			ClusterCACacheTTL: Duration(ca.DefaultCacheTTL),
+		},
+		Listeners: Listeners{
+			Listen:              DefaultListen,
+			BasePath:            DefaultBasePath,
+			CallbackPath:        kuberos.DefaultKubeCfgEndpoint,
+			ShutdownGracePeriod: Duration(DefaultShutdownGracePeriod),
+			HealthCheckTimeout:  Duration(health.DefaultTimeout),
+			TLS: TLS{
+				MinVersion:     tlsconfig.DefaultMinVersion,
+				ReloadInterval: Duration(tlsconfig.DefaultReloadInterval),
+			},
+		},
+		Logging: Logging{Audit: Audit{WebhookTimeout: Duration(audit.DefaultWebhookTimeout)}},
+	}
+}
+
+// Load the configuration file at the supplied path. Unspecified values take
+// their defaults.
+func Load(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read config file %s", filename)
+	}
+	c, err := Parse(b, os.LookupEnv)
+	return c, errors.Wrapf(err, "cannot parse config file %s", filename)
+}
+
+// Parse the supplied YAML configuration. References to environment variables
+// of the form ${VAR} in string values are replaced with the value returned by
+// the supplied lookup function. Unspecified values take their defaults.
+func Parse(y []byte, lookup func(string) (string, bool)) (*Config, error) {
+	j, err := yaml.YAMLToJSON(y)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse YAML")
+	}
+
+	// Interpolate after parsing YAML, so that environment variables cannot
+	// change the structure of the configuration.
+	var generic interface{}
+	if err := json.Unmarshal(j, &generic); err != nil {
+		return nil, errors.Wrap(err, "cannot parse YAML")
+	}
+	generic, err = interpolate(generic, lookup)
+	if err != nil {
+		return nil, err
+	}
+	j, err = json.Marshal(generic)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal interpolated config")
+	}
+
+	c := Default()
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
+	return c, nil
+}
+
+func interpolate(v interface{}, lookup func(string) (string, bool)) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		var missing []string
+		s := envRegexp.ReplaceAllStringFunc(t, func(ref string) string {
+			name := envRegexp.FindStringSubmatch(ref)[1]
+			value, ok := lookup(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return nil, errors.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+		}
+		return s, nil
+	case []interface{}:
+		for i := range t {
+			iv, err := interpolate(t[i], lookup)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = iv
+		}
+		return t, nil
+	case map[string]interface{}:
+		for k := range t {
+			iv, err := interpolate(t[k], lookup)
+			if err != nil {
+				return nil, errors.Wrap(err, k)
+			}
+			t[k] = iv
+		}
+		return t, nil
+	}
+	return v, nil
+}
+
+// ClientSecret returns the OAuth 2.0 client secret, reading it from the
+// secret file if necessary.
+func (c *Config) ClientSecret() (string, error) {
+	if c.Client.SecretFile == "" {
+		return c.Client.Secret, nil
+	}
+	b, err := ioutil.ReadFile(c.Client.SecretFile)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read client secret file")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Validate returns an error describing every problem with the configuration,
+// if any.
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.APIVersion != APIVersion {
+		invalid("apiVersion must be %s", APIVersion)
+	}
+	if c.Kind != Kind {
+		invalid("kind must be %s", Kind)
+	}
+
+	if c.Issuer.URL == "" {
+		invalid("issuer.url is required")
+	} else if !absolute(c.Issuer.URL) {
+		invalid("issuer.url must be an absolute URL")
+	}
+
+	if c.Client.ID == "" {
+		invalid("client.id is required")
+	}
+	switch {
+	case c.Client.Secret != "" && c.Client.SecretFile != "":
+		invalid("client.secret and client.secretFile are mutually exclusive")
+	case c.Client.Secret == "" && c.Client.SecretFile == "":
+		invalid("one of client.secret or client.secretFile is required")
+	}
+
+	if c.Claims.Username == "" && c.Claims.UsernameExpression == "" {
+		invalid("claims.username or claims.usernameExpression is required")
+	}
+	if c.Claims.UsernameExpression != "" && c.Claims.UsernamePrefix != "" {
+		invalid("claims.usernamePrefix cannot be used with claims.usernameExpression")
+	}
+	if c.Claims.GroupsExpression != "" && c.Claims.GroupsPrefix != "" {
+		invalid("claims.groupsPrefix cannot be used with claims.groupsExpression")
+	}
+	if _, err := extractor.NewOIDC(nil, c.Claims.Options()...); err != nil {
+		invalid("claims: %v", err)
+	}
+	if !absolute(c.Claims.DistributedClaims.GraphURL) {
+		invalid("claims.distributedClaims.graphURL must be an absolute URL")
+	}
+
+	if c.Policy.PostLogoutRedirectURL != "" && !absolute(c.Policy.PostLogoutRedirectURL) {
+		invalid("policy.postLogoutRedirectURL must be an absolute URL")
+	}
+	if c.Policy.SelfTest.Timeout <= 0 {
+		invalid("policy.selfTest.timeout must be positive")
+	}
+	if len(c.Policy.SelfTest.Namespaces) == 0 {
+		invalid("policy.selfTest.namespaces must not be empty")
+	}
+	a := c.Policy.Authentication
+	if a.MaxAge < 0 {
+		invalid("policy.authentication.maxAge must not be negative")
+	}
+	if a.Require.MaxAge < 0 {
+		invalid("policy.authentication.require.maxAge must not be negative")
+	}
+	for name, r := range a.Clusters {
+		if r.MaxAge < 0 {
+			invalid("policy.authentication.clusters.%s.maxAge must not be negative", name)
+		}
+	}
+
+	t := c.Templates
+	if t.File == "" && !t.Kubernetes.Enabled && !t.ClusterAPI.Enabled {
+		invalid("one of templates.file, templates.kubernetes, or templates.clusterAPI is required")
+	}
+	for name, spec := range t.ClusterCAs {
+		if _, err := ca.ParseSource(spec); err != nil {
+			invalid("templates.clusterCAs.%s: %v", name, err)
+		}
+	}
+	if t.DefaultClusterCA != "" {
+		if _, err := ca.ParseSource(t.DefaultClusterCA); err != nil {
+			invalid("templates.defaultClusterCA: %v", err)
+		}
+	}
+	if t.ClusterCACacheTTL <= 0 {
+		invalid("templates.clusterCACacheTTL must be positive")
+	}
+
+	l := c.Listeners
+	if l.Listen == "" {
+		invalid("listeners.listen is required")
+	}
+	if err := kuberos.KubeCfgEndpoint(l.CallbackPath)(&kuberos.Handlers{}); err != nil {
+		invalid("listeners.callbackPath must be a path relative to listeners.basePath")
+	}
+	if l.PublicURL != "" && !absolute(l.PublicURL) {
+		invalid("listeners.publicURL must be an absolute URL")
+	}
+	if _, err := kuberos.ParseTrustedProxies(l.TrustedProxies); err != nil {
+		invalid("listeners.trustedProxies: %v", err)
+	}
+	if l.ShutdownGracePeriod < 0 {
+		invalid("listeners.shutdownGracePeriod must not be negative")
+	}
+	if l.HealthCheckTimeout <= 0 {
+		invalid("listeners.healthCheckTimeout must be positive")
+	}
+
+	if (l.TLS.CertFile == "") != (l.TLS.KeyFile == "") {
+		invalid("listeners.tls.certFile and listeners.tls.keyFile must be specified together")
+	}
+	if !l.TLS.Enabled() && (l.TLS.ClientCAFile != "" || l.HTTPRedirectListen != "") {
+		invalid("listeners.tls.clientCAFile and listeners.httpRedirectListen require listeners.tls.certFile and listeners.tls.keyFile")
+	}
+	if _, err := tlsconfig.ParseVersion(l.TLS.MinVersion); err != nil {
+		invalid("listeners.tls.minVersion: %v", err)
+	}
+	if _, err := tlsconfig.ParseCipherSuites(l.TLS.CipherSuites); err != nil {
+		invalid("listeners.tls.cipherSuites: %v", err)
+	}
+	if l.TLS.ReloadInterval <= 0 {
+		invalid("listeners.tls.reloadInterval must be positive")
+	}
+
+	for _, u := range c.Logging.Audit.Webhooks {
+		if !absolute(u) {
+			invalid("logging.audit.webhooks: %q must be an absolute URL", u)
+		}
+	}
+	if c.Logging.Audit.WebhookTimeout <= 0 {
+		invalid("logging.audit.webhookTimeout must be positive")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func absolute(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.IsAbs() && u.Host != ""
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func lookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func valid() *Config {
+	c := Default()
+	c.Issuer.URL = "https://accounts.example.org"
+	c.Client.ID = "kuberos"
+	c.Client.Secret = "secret"
+	c.Templates.File = "/cfg/template"
+	return c
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		want    func() *Config
+		wantErr bool
+	}{
+		{
+			name: "Minimal",
+			yaml: `
+apiVersion: kuberos/v1alpha1
+kind: Config
+issuer:
+  url: https://accounts.example.org
+client:
+  id: kuberos
+  secret: secret
+templates:
+  file: /cfg/template
+`,
+			want: valid,
+		},
+		{
+			name: "Interpolated",
+			yaml: `
+apiVersion: kuberos/v1alpha1
+kind: Config
+issuer:
+  url: https://${DOMAIN}
+client:
+  id: kuberos
+  secret: ${SECRET}
+  scopes: [groups]
+templates:
+  file: /cfg/template
+listeners:
+  shutdownGracePeriod: 10s
+logging:
+  audit:
+    webhooks: ["https://audit.${DOMAIN}/events"]
+`,
+			env: map[string]string{"DOMAIN": "accounts.example.org", "SECRET": "secret"},
+			want: func() *Config {
+				c := valid()
+				c.Client.Scopes = []string{"groups"}
+				c.Listeners.ShutdownGracePeriod = Duration(10 * time.Second)
+				c.Logging.Audit.Webhooks = []string{"https://audit.accounts.example.org/events"}
+				return c
+			},
+		},
+		{
+			name:    "UnsetEnvironmentVariable",
+			yaml:    "client:\n  secret: ${SECRET}\n",
+			wantErr: true,
+		},
+		{
+			name:    "UnknownField",
+			yaml:    "issuer:\n  uri: https://accounts.example.org\n",
+			wantErr: true,
+		},
+		{
+			name:    "InvalidDuration",
+			yaml:    "listeners:\n  shutdownGracePeriod: soon\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.yaml), lookup(tt.env))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(...): want error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(...): %v", err)
+			}
+			if diff := deep.Equal(got, tt.want()); diff != nil {
+				t.Errorf("Parse(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "Valid",
+			mutate: func(c *Config) {},
+		},
+		{
+			name: "MissingRequired",
+			mutate: func(c *Config) {
+				c.Issuer.URL = ""
+				c.Client = Client{}
+				c.Templates.File = ""
+			},
+			want: []string{"issuer.url", "client.id", "client.secret", "templates.file"},
+		},
+		{
+			name: "SecretAndSecretFile",
+			mutate: func(c *Config) {
+				c.Client.SecretFile = "/cfg/secret"
+			},
+			want: []string{"mutually exclusive"},
+		},
+		{
+			name: "InvalidListeners",
+			mutate: func(c *Config) {
+				c.Listeners.CallbackPath = "//evil.example.org/ui"
+				c.Listeners.PublicURL = "/kuberos"
+				c.Listeners.TrustedProxies = []string{"10.0.0.0/33"}
+			},
+			want: []string{"listeners.callbackPath", "listeners.publicURL", "listeners.trustedProxies"},
+		},
+		{
+			name: "InvalidTLS",
+			mutate: func(c *Config) {
+				c.Listeners.TLS.CertFile = "/tls/tls.crt"
+				c.Listeners.TLS.MinVersion = "0.9"
+				c.Listeners.TLS.CipherSuites = []string{"TLS_NULL"}
+			},
+			want: []string{"listeners.tls.certFile", "listeners.tls.minVersion", "listeners.tls.cipherSuites"},
+		},
+		{
+			name: "ClientCARequiresTLS",
+			mutate: func(c *Config) {
+				c.Listeners.TLS.ClientCAFile = "/tls/ca.crt"
+			},
+			want: []string{"listeners.tls.clientCAFile"},
+		},
+		{
+			name: "InvalidSources",
+			mutate: func(c *Config) {
+				c.Templates.ClusterCAs = map[string]string{"prod": "ftp://example.org/ca.crt"}
+				c.Templates.ClusterCACacheTTL = 0
+				c.Logging.Audit.Webhooks = []string{"audit"}
+			},
+			want: []string{"templates.clusterCAs.prod", "templates.clusterCACacheTTL", "logging.audit.webhooks"},
+		},
+		{
+			name: "ValidExpressions",
+			mutate: func(c *Config) {
+				c.Claims.Username = ""
+				c.Claims.UsernameExpression = "claims.email.split('@')[0]"
+				c.Claims.ValidationRules = []ValidationRule{{Expression: "claims.email_verified"}}
+			},
+		},
+		{
+			name: "InvalidExpressions",
+			mutate: func(c *Config) {
+				c.Claims.UsernameExpression = "claims.email.("
+				c.Claims.UsernamePrefix = "oidc:"
+			},
+			want: []string{"claims.usernamePrefix", "invalid username expression"},
+		},
+		{
+			name: "InvalidDistributedClaims",
+			mutate: func(c *Config) {
+				c.Claims.DistributedClaims = DistributedClaims{Enabled: true, GraphURL: "graph.microsoft.com"}
+			},
+			want: []string{"claims.distributedClaims.graphURL"},
+		},
+		{
+			name: "InvalidAuthentication",
+			mutate: func(c *Config) {
+				c.Policy.Authentication = Authentication{
+					MaxAge:   Duration(-time.Minute),
+					Clusters: map[string]AuthenticationRequirement{"prod": {MaxAge: Duration(-time.Minute)}},
+				}
+			},
+			want: []string{"policy.authentication.maxAge", "policy.authentication.clusters.prod.maxAge"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.mutate(c)
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("c.Validate(): %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("c.Validate(): want error")
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("c.Validate(): want error mentioning %q, got %v", w, err)
+				}
+			}
+		})
+	}
+}
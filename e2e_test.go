@@ -0,0 +1,443 @@
+package kuberos
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/go-test/deep"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	// Register the OIDC auth provider used by generated kubecfgs.
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
+
+	"github.com/negz/kuberos/audit"
+	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/oidctest"
+	"github.com/negz/kuberos/selftest"
+	"github.com/negz/kuberos/template"
+)
+
+const (
+	e2eCluster = "e2e"
+	e2eEmail   = "alice@example.org"
+	e2eVersion = "v1.17.0"
+
+	// Tokens that expire within ten seconds are refreshed by kubectl before
+	// use, but are still valid when Kuberos verifies them.
+	e2eShortLifetime = 5 * time.Second
+)
+
+// e2eRules are the actions every authenticated user may perform.
+var e2eRules = []authorizationv1.ResourceRule{{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}}}
+
+// A fakeAPIServer is a Kubernetes API server that authenticates requests
+// bearing OIDC ID tokens, and serves only its version, SelfSubjectReviews, and
+// SelfSubjectRulesReviews.
+type fakeAPIServer struct {
+	*httptest.Server
+	verifier *oidc.IDTokenVerifier
+
+	mx    sync.Mutex
+	users []string
+}
+
+func newFakeAPIServer(v *oidc.IDTokenVerifier) *fakeAPIServer {
+	a := &fakeAPIServer{verifier: v}
+	a.Server = httptest.NewTLSServer(a)
+	return a
+}
+
+func (a *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	idt, err := a.verifier.Verify(r.Context(), strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint: errcheck
+			"kind": "Status", "apiVersion": "v1", "status": "Failure",
+			"reason": "Unauthorized", "message": "Unauthorized", "code": http.StatusUnauthorized,
+		})
+		return
+	}
+	var c struct {
+		Email string `json:"email"`
+	}
+	idt.Claims(&c) // nolint: errcheck
+	a.mx.Lock()
+	a.users = append(a.users, c.Email)
+	a.mx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/version":
+		json.NewEncoder(w).Encode(map[string]string{"major": "1", "minor": "17", "gitVersion": e2eVersion}) // nolint: errcheck
+	case "/apis/authentication.k8s.io/v1/selfsubjectreviews":
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint: errcheck
+			"apiVersion": "authentication.k8s.io/v1", "kind": "SelfSubjectReview",
+			"status": map[string]interface{}{"userInfo": selftest.UserInfo{Username: c.Email}},
+		})
+	case "/apis/authorization.k8s.io/v1/selfsubjectrulesreviews":
+		review := &authorizationv1.SelfSubjectRulesReview{}
+		json.NewDecoder(r.Body).Decode(review) // nolint: errcheck
+		review.Status.ResourceRules = e2eRules
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review) // nolint: errcheck
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *fakeAPIServer) authenticated() []string {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return append([]string{}, a.users...)
+}
+
+// An e2e environment consists of Kuberos, an OIDC provider, and a Kubernetes
+// API server that trusts the OIDC provider.
+type e2e struct {
+	t       *testing.T
+	dir     string
+	idp     *oidctest.Server
+	api     *fakeAPIServer
+	kuberos *httptest.Server
+	audit   *recordingSink
+	base    string
+}
+
+type e2eOptions struct {
+	idp         []oidctest.Option
+	kuberos     []Option
+	basePath    string
+	apiClientID string
+}
+
+func newE2E(t *testing.T, o e2eOptions) *e2e {
+	e := &e2e{t: t, audit: &recordingSink{}}
+
+	dir, err := ioutil.TempDir("", "kuberos-e2e")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(...): %v", err)
+	}
+	e.dir = dir
+
+	e.idp, err = oidctest.NewServer(append([]oidctest.Option{oidctest.Claims(map[string]interface{}{"email": e2eEmail})}, o.idp...)...)
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, e.idp.URL)
+	if err != nil {
+		t.Fatalf("oidc.NewProvider(...): %v", err)
+	}
+
+	apiClientID := oidctest.DefaultClientID
+	if o.apiClientID != "" {
+		apiClientID = o.apiClientID
+	}
+	e.api = newFakeAPIServer(provider.Verifier(&oidc.Config{ClientID: apiClientID}))
+
+	sr := ScopeRequests{OfflineAsScope: OfflineAsScope(provider)}
+	cfg := &oauth2.Config{
+		ClientID:     oidctest.DefaultClientID,
+		ClientSecret: oidctest.DefaultClientSecret,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       sr.Get(),
+	}
+	x, err := extractor.NewOIDC(provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}), extractor.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("extractor.NewOIDC(...): %v", err)
+	}
+	tmpl := template.Static(&api.Config{
+		CurrentContext: e2eCluster,
+		Clusters: map[string]*api.Cluster{e2eCluster: {
+			Server:                   e.api.URL,
+			CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: e.api.Certificate().Raw}),
+		}},
+	})
+	oo := append([]Option{Logger(zap.NewNop()), KubeCfgTemplate(tmpl), Audit(e.audit)}, o.kuberos...)
+	h, err := NewHandlers(cfg, x, oo...)
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	r := httprouter.New()
+	h.Routes(r, http.Dir(dir), []byte("<html>\n<head>\n</head>\n</html>\n"))
+	e.kuberos = httptest.NewServer(r)
+	e.base = e.kuberos.URL + withTrailingSlash(o.basePath)
+	return e
+}
+
+func (e *e2e) Close() {
+	e.kuberos.Close()
+	e.api.Close()
+	e.idp.Close()
+	os.RemoveAll(e.dir) // nolint: errcheck
+}
+
+// login logs in as a browser would, returning the authentication parameters
+// the frontend would receive.
+func (e *e2e) login() *extractor.OIDCAuthenticationParams {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		e.t.Fatalf("cookiejar.New(nil): %v", err)
+	}
+	browser := &http.Client{Jar: jar}
+
+	// Kuberos redirects to the OIDC provider, which redirects back to the
+	// frontend served at Kuberos' kubecfg endpoint.
+	rsp, err := browser.Get(e.base)
+	if err != nil {
+		e.t.Fatalf("browser.Get(%s): %v", e.base, err)
+	}
+	page, _ := ioutil.ReadAll(rsp.Body) // nolint: errcheck
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || !strings.Contains(string(page), "<base href=") {
+		e.t.Fatalf("login: want frontend, got %d: %s", rsp.StatusCode, page)
+	}
+
+	// The frontend passes its URL parameters on to the KubeCfg handler.
+	u := e.base + "kubecfg?" + rsp.Request.URL.RawQuery
+	rsp, err = browser.Get(u)
+	if err != nil {
+		e.t.Fatalf("browser.Get(%s): %v", u, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(rsp.Body) // nolint: errcheck
+		e.t.Fatalf("kubecfg: want %d, got %d: %s", http.StatusOK, rsp.StatusCode, b)
+	}
+	p := &extractor.OIDCAuthenticationParams{}
+	if err := json.NewDecoder(rsp.Body).Decode(p); err != nil {
+		e.t.Fatalf("cannot decode authentication parameters: %v", err)
+	}
+	return p
+}
+
+// download the kubecfg for the supplied parameters, as the frontend's
+// download link would, returning the file to which it was written.
+func (e *e2e) download(p *extractor.OIDCAuthenticationParams) string {
+	q := url.Values{
+		"email":        {p.Username},
+		"clientID":     {p.ClientID},
+		"clientSecret": {p.ClientSecret},
+		"idToken":      {p.IDToken},
+		"refreshToken": {p.RefreshToken},
+		"issuer":       {p.IssuerURL},
+	}
+	rsp, err := http.Get(e.base + "kubecfg.yaml?" + q.Encode())
+	if err != nil {
+		e.t.Fatalf("http.Get(kubecfg.yaml): %v", err)
+	}
+	defer rsp.Body.Close()
+	b, err := ioutil.ReadAll(rsp.Body)
+	if err != nil || rsp.StatusCode != http.StatusOK {
+		e.t.Fatalf("kubecfg.yaml: want %d, got %d: %s %v", http.StatusOK, rsp.StatusCode, b, err)
+	}
+	f := filepath.Join(e.dir, "kubeconfig")
+	if err := ioutil.WriteFile(f, b, 0600); err != nil {
+		e.t.Fatalf("ioutil.WriteFile(%s): %v", f, err)
+	}
+	return f
+}
+
+// selfTest tests the supplied ID token against each cluster, as the
+// frontend's cluster access check would.
+func (e *e2e) selfTest(idToken string) []selftest.Result {
+	r := &selfTestResponse{}
+	e.post("selftest", idToken, r)
+	return r.Clusters
+}
+
+// rules reviews the actions the supplied ID token may perform in each
+// cluster.
+func (e *e2e) rules(idToken string) []selftest.Rules {
+	r := &rulesResponse{}
+	e.post("rules", idToken, r)
+	return r.Clusters
+}
+
+func (e *e2e) post(endpoint, idToken string, into interface{}) {
+	rsp, err := http.PostForm(e.base+endpoint, url.Values{urlParamIDToken: {idToken}})
+	if err != nil {
+		e.t.Fatalf("http.PostForm(%s): %v", endpoint, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(rsp.Body) // nolint: errcheck
+		e.t.Fatalf("%s: want %d, got %d: %s", endpoint, http.StatusOK, rsp.StatusCode, b)
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(into); err != nil {
+		e.t.Fatalf("cannot decode %s response: %v", endpoint, err)
+	}
+}
+
+func idToken(t *testing.T, kubeconfig string) string {
+	cfg, err := clientcmd.LoadFromFile(kubeconfig)
+	if err != nil {
+		t.Fatalf("clientcmd.LoadFromFile(%s): %v", kubeconfig, err)
+	}
+	return cfg.AuthInfos[cfg.Contexts[cfg.CurrentContext].AuthInfo].AuthProvider.Config[templateOIDCIDToken]
+}
+
+func newSelfTester(t *testing.T) *selftest.Tester {
+	st, err := selftest.New()
+	if err != nil {
+		t.Fatalf("selftest.New(): %v", err)
+	}
+	return st
+}
+
+func TestEndToEnd(t *testing.T) {
+	cases := []struct {
+		name        string
+		o           e2eOptions
+		wantAuthn   bool
+		wantRefresh bool
+		wantBroker  bool
+
+		// Test the ID token via Kuberos instead of using the kubecfg.
+		selfTest bool
+	}{
+		{
+			name:      "Default",
+			wantAuthn: true,
+		},
+		{
+			name: "BasePath",
+			o: e2eOptions{
+				kuberos:  []Option{BasePath("/auth/k8s"), KubeCfgEndpoint("callback")},
+				basePath: "/auth/k8s",
+			},
+			wantAuthn: true,
+		},
+		{
+			name:        "Refresh",
+			o:           e2eOptions{idp: []oidctest.Option{oidctest.TokenLifetime(e2eShortLifetime)}},
+			wantAuthn:   true,
+			wantRefresh: true,
+		},
+		{
+			name: "TokenBroker",
+			o: e2eOptions{
+				idp:     []oidctest.Option{oidctest.TokenLifetime(e2eShortLifetime)},
+				kuberos: []Option{TokenBroker()},
+			},
+			wantAuthn:   true,
+			wantRefresh: true,
+			wantBroker:  true,
+		},
+		{
+			// The API server expects ID tokens issued to a different client.
+			name:      "Unauthenticated",
+			o:         e2eOptions{apiClientID: "kubernetes"},
+			wantAuthn: false,
+		},
+		{
+			name:      "SelfTest",
+			o:         e2eOptions{kuberos: []Option{SelfTest(newSelfTester(t))}},
+			wantAuthn: true,
+			selfTest:  true,
+		},
+		{
+			name:      "SelfTestUnauthenticated",
+			o:         e2eOptions{kuberos: []Option{SelfTest(newSelfTester(t))}, apiClientID: "kubernetes"},
+			wantAuthn: false,
+			selfTest:  true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newE2E(t, tt.o)
+			defer e.Close()
+
+			p := e.login()
+			if diff := deep.Equal(p.Username, e2eEmail); diff != nil {
+				t.Errorf("p.Username: got != want: %v", diff)
+			}
+			if tt.selfTest {
+				results := e.selfTest(p.IDToken)
+				if len(results) != 1 {
+					t.Fatalf("e.selfTest(...): want 1 result, got %d", len(results))
+				}
+				want := selftest.Result{Cluster: e2eCluster, Server: e.api.URL, Reachable: true, Authenticated: tt.wantAuthn}
+				if tt.wantAuthn {
+					want.Version, want.User = e2eVersion, &selftest.UserInfo{Username: e2eEmail}
+				} else {
+					want.Error = "API server did not authenticate the ID token"
+				}
+				if diff := deep.Equal(results[0], want); diff != nil {
+					t.Errorf("e.selfTest(...): got != want: %v", diff)
+				}
+
+				wantRules := []selftest.Rules{{Cluster: e2eCluster, Server: e.api.URL, Error: want.Error}}
+				if tt.wantAuthn {
+					wantRules[0].Namespaces = []selftest.NamespaceRules{{Namespace: "default", ResourceRules: e2eRules}}
+				}
+				if diff := deep.Equal(e.rules(p.IDToken), wantRules); diff != nil {
+					t.Errorf("e.rules(...): got != want: %v", diff)
+				}
+				return
+			}
+
+			kubeconfig := e.download(p)
+			before := idToken(t, kubeconfig)
+
+			rc, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+			if err != nil {
+				t.Fatalf("clientcmd.BuildConfigFromFlags(...): %v", err)
+			}
+			client, err := kubernetes.NewForConfig(rc)
+			if err != nil {
+				t.Fatalf("kubernetes.NewForConfig(...): %v", err)
+			}
+			v, err := client.Discovery().ServerVersion()
+			if (err == nil) != tt.wantAuthn {
+				t.Fatalf("ServerVersion(): want success %v, got error %v", tt.wantAuthn, err)
+			}
+			if !tt.wantAuthn {
+				return
+			}
+			if diff := deep.Equal(v.GitVersion, e2eVersion); diff != nil {
+				t.Errorf("ServerVersion(): got != want: %v", diff)
+			}
+			if diff := deep.Equal(e.api.authenticated(), []string{e2eEmail}); diff != nil {
+				t.Errorf("API server authenticated users: got != want: %v", diff)
+			}
+
+			// kubectl persists refreshed tokens to the kubecfg.
+			refreshed := idToken(t, kubeconfig) != before
+			if diff := deep.Equal(refreshed, tt.wantRefresh); diff != nil {
+				t.Errorf("refreshed ID token: got != want: %v", diff)
+			}
+			brokered := false
+			for _, a := range e.audit.actions() {
+				brokered = brokered || a == audit.ActionToken
+			}
+			if diff := deep.Equal(brokered, tt.wantBroker); diff != nil {
+				t.Errorf("refreshed via Kuberos: got != want: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package extractor
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Claims that describe how a user authenticated, per OpenID Connect Core
+// section 2.
+const (
+	claimACR      = "acr"
+	claimAMR      = "amr"
+	claimAuthTime = "auth_time"
+)
+
+// An AuthenticationRequirement describes how strongly a user must have
+// authenticated, e.g. using multiple factors. The zero value is satisfied by
+// any authentication.
+type AuthenticationRequirement struct {
+	// ACR values, any of which satisfies the requirement.
+	ACR []string
+
+	// AMR values, all of which must be present.
+	AMR []string
+
+	// MaxAge is the maximum time since the user last authenticated. Zero
+	// allows any age.
+	MaxAge time.Duration
+}
+
+// Check returns an error if the supplied parameters, extracted from a
+// verified ID token, do not satisfy the requirement at the supplied time.
+func (r AuthenticationRequirement) Check(p *OIDCAuthenticationParams, now time.Time) error {
+	if len(r.ACR) > 0 && !contains(r.ACR, p.ACR) {
+		return errors.Errorf("authentication context class %q is not one of %v", p.ACR, r.ACR)
+	}
+	for _, m := range r.AMR {
+		if !contains(p.AMR, m) {
+			return errors.Errorf("authentication methods %v do not include %q", p.AMR, m)
+		}
+	}
+	if r.MaxAge > 0 {
+		if p.AuthTime.IsZero() {
+			return errors.Errorf("ID token missing %s claim", claimAuthTime)
+		}
+		if now.Sub(p.AuthTime) > r.MaxAge {
+			return errors.Errorf("authenticated more than %v ago", r.MaxAge)
+		}
+	}
+	return nil
+}
+
+// RequireAuthentication refuses to process authorization codes for ID tokens
+// that do not satisfy the supplied requirement. It does not apply to refreshed
+// or verified ID tokens. Refreshing does not reauthenticate the user, so
+// refreshed ID tokens carry the auth_time of the original authentication;
+// checking MaxAge when refreshing would fail users' sessions once it elapsed
+// rather than prompt them to log in again.
+func RequireAuthentication(r AuthenticationRequirement) Option {
+	return func(o *oidcExtractor) error {
+		if r.MaxAge < 0 {
+			return errors.New("maximum authentication age must not be negative")
+		}
+		o.require = r
+		return nil
+	}
+}
+
+// mapAuthentication sets how the user authenticated on the supplied
+// parameters. Each claim is optional.
+func mapAuthentication(params *OIDCAuthenticationParams, claims map[string]interface{}) error {
+	if acr, ok := claims[claimACR]; ok {
+		s, ok := acr.(string)
+		if !ok {
+			return errors.Errorf("%s claim must be a string", claimACR)
+		}
+		params.ACR = s
+	}
+	if amr, ok := claims[claimAMR]; ok {
+		l, ok := amr.([]interface{})
+		if !ok {
+			return errors.Errorf("%s claim must be an array of strings", claimAMR)
+		}
+		params.AMR = make([]string, 0, len(l))
+		for _, m := range l {
+			s, ok := m.(string)
+			if !ok {
+				return errors.Errorf("%s claim must be an array of strings", claimAMR)
+			}
+			params.AMR = append(params.AMR, s)
+		}
+	}
+	if at, ok := claims[claimAuthTime]; ok {
+		n, ok := at.(float64)
+		if !ok {
+			return errors.Errorf("%s claim must be a number", claimAuthTime)
+		}
+		params.AuthTime = time.Unix(int64(n), 0)
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package extractor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/oidctest"
+)
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	mfa := &OIDCAuthenticationParams{ACR: "mfa", AMR: []string{"pwd", "otp"}, AuthTime: now.Add(-5 * time.Minute)}
+
+	cases := []struct {
+		name    string
+		r       AuthenticationRequirement
+		p       *OIDCAuthenticationParams
+		wantErr bool
+	}{
+		{
+			name: "ZeroRequirement",
+			p:    &OIDCAuthenticationParams{},
+		},
+		{
+			name: "Satisfied",
+			r:    AuthenticationRequirement{ACR: []string{"phr", "mfa"}, AMR: []string{"otp"}, MaxAge: time.Hour},
+			p:    mfa,
+		},
+		{
+			name:    "WrongACR",
+			r:       AuthenticationRequirement{ACR: []string{"phr"}},
+			p:       mfa,
+			wantErr: true,
+		},
+		{
+			name:    "MissingAMR",
+			r:       AuthenticationRequirement{AMR: []string{"otp", "hwk"}},
+			p:       mfa,
+			wantErr: true,
+		},
+		{
+			name:    "TooOld",
+			r:       AuthenticationRequirement{MaxAge: time.Minute},
+			p:       mfa,
+			wantErr: true,
+		},
+		{
+			name:    "MissingAuthTime",
+			r:       AuthenticationRequirement{MaxAge: time.Hour},
+			p:       &OIDCAuthenticationParams{ACR: "mfa"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.r.Check(tt.p, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("r.Check(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticationClaims(t *testing.T) {
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	cases := []struct {
+		name       string
+		claims     map[string]interface{}
+		want       *OIDCAuthenticationParams
+		wantReason string
+	}{
+		{
+			name:   "Claimed",
+			claims: map[string]interface{}{"acr": "mfa", "amr": []string{"pwd", "otp"}, "auth_time": authTime.Unix()},
+			want:   &OIDCAuthenticationParams{ACR: "mfa", AMR: []string{"pwd", "otp"}, AuthTime: authTime},
+		},
+		{
+			name:   "Unclaimed",
+			claims: map[string]interface{}{},
+			want:   &OIDCAuthenticationParams{},
+		},
+		{
+			name:       "InvalidAMR",
+			claims:     map[string]interface{}{"amr": "otp"},
+			wantReason: ReasonInvalidClaims,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := oidctest.NewServer(oidctest.Claims(tt.claims))
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			e, _ := newTestExtractor(t, s)
+			idt, err := s.Provider.IDToken()
+			if err != nil {
+				t.Fatalf("s.Provider.IDToken(): %v", err)
+			}
+
+			got, err := e.Verify(context.Background(), idt)
+			if tt.wantReason != "" {
+				if diff := deep.Equal(Reason(err), tt.wantReason); diff != nil {
+					t.Errorf("e.Verify(...): want error with reason %q, got %v", tt.wantReason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("e.Verify(...): %v", err)
+			}
+			if diff := deep.Equal(&OIDCAuthenticationParams{ACR: got.ACR, AMR: got.AMR, AuthTime: got.AuthTime}, tt.want); diff != nil {
+				t.Errorf("e.Verify(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestRequireAuthentication(t *testing.T) {
+	mfa := oauth2.SetAuthURLParam("acr_values", "mfa phr")
+	maxAge := oauth2.SetAuthURLParam("max_age", "3600")
+
+	cases := []struct {
+		name       string
+		r          AuthenticationRequirement
+		oo         []oauth2.AuthCodeOption
+		wantReason string
+	}{
+		{
+			name: "Satisfied",
+			r:    AuthenticationRequirement{ACR: []string{"mfa"}, MaxAge: time.Hour},
+			oo:   []oauth2.AuthCodeOption{mfa, maxAge},
+		},
+		{
+			name:       "WrongACR",
+			r:          AuthenticationRequirement{ACR: []string{"phr"}},
+			oo:         []oauth2.AuthCodeOption{mfa},
+			wantReason: ReasonAuthenticationTooWeak,
+		},
+		{
+			name:       "MissingAuthTime",
+			r:          AuthenticationRequirement{MaxAge: time.Hour},
+			oo:         []oauth2.AuthCodeOption{mfa},
+			wantReason: ReasonAuthenticationTooWeak,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := oidctest.NewServer()
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			e, cfg := newTestExtractor(t, s, RequireAuthentication(tt.r))
+			_, err = e.Process(context.Background(), cfg, authorize(t, cfg, tt.oo...))
+			if tt.wantReason != "" {
+				if diff := deep.Equal(Reason(err), tt.wantReason); diff != nil {
+					t.Errorf("e.Process(...): want error with reason %q, got %v", tt.wantReason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("e.Process(...): %v", err)
+			}
+		})
+	}
+}
+
+func TestRequireAuthenticationRefresh(t *testing.T) {
+	s, err := oidctest.NewServer()
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	e, cfg := newTestExtractor(t, s, RequireAuthentication(AuthenticationRequirement{MaxAge: time.Hour}))
+	cfg.Scopes = append(cfg.Scopes, "offline_access")
+	p, err := e.Process(ctx, cfg, authorize(t, cfg, oauth2.SetAuthURLParam("max_age", "3600")))
+	if err != nil {
+		t.Fatalf("e.Process(...): %v", err)
+	}
+
+	// Refreshing does not reauthenticate the user, so MaxAge is not checked
+	// even once it has elapsed.
+	e.require.MaxAge = time.Nanosecond
+	refreshed, err := e.Refresh(ctx, cfg, p.RefreshToken)
+	if err != nil {
+		t.Fatalf("e.Refresh(...): %v", err)
+	}
+	if diff := deep.Equal(refreshed.AuthTime, p.AuthTime); diff != nil {
+		t.Errorf("e.Refresh(...): auth time: got != want: %v", diff)
+	}
+}
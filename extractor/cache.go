@@ -0,0 +1,60 @@
+package extractor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+// A claimCache caches claims that were resolved for an ID token or its subject,
+// such that they may be used when an ID token is verified without the access
+// token issued alongside it.
+type claimCache struct {
+	now func() time.Time
+
+	mx      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newClaimCache() *claimCache {
+	return &claimCache{now: time.Now, entries: map[string]cacheEntry{}}
+}
+
+// tokenKey returns the key under which claims resolved for the supplied raw ID
+// token are cached. ID tokens are hashed to avoid holding them in memory.
+func tokenKey(idToken string) string {
+	h := sha256.Sum256([]byte(idToken))
+	return hex.EncodeToString(h[:])
+}
+
+// get returns the claims cached under the supplied key, if they have not
+// expired.
+func (c *claimCache) get(key string) (map[string]interface{}, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !c.now().Before(e.expires) {
+		return nil, false
+	}
+	return e.claims, true
+}
+
+// put caches claims under the supplied key until the supplied time, evicting
+// any expired entries.
+func (c *claimCache) put(key string, claims map[string]interface{}, expires time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{claims: claims, expires: expires}
+}
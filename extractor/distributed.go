@@ -0,0 +1,189 @@
+package extractor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+
+	"github.com/negz/kuberos/metrics"
+)
+
+// DefaultGraphURL is the Microsoft Graph API against which Azure AD group
+// overage claims are resolved.
+const DefaultGraphURL = "https://graph.microsoft.com/v1.0"
+
+const (
+	claimNames   = "_claim_names"
+	claimSources = "_claim_sources"
+
+	// Azure AD refers group overage claims to the retired Azure AD Graph API's
+	// getMemberObjects action, which Microsoft Graph also serves.
+	aadGraphHost     = "graph.windows.net"
+	getMemberObjects = "/getMemberObjects"
+)
+
+// A claimSource is an endpoint that serves distributed claims, per OpenID
+// Connect Core section 5.6.2.
+type claimSource struct {
+	Endpoint    string `json:"endpoint"`
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+type distributedClaims struct {
+	graphURL string
+	cache    *claimCache
+}
+
+// DistributedClaims resolves distributed claims, which ID tokens reference via
+// their _claim_names and _claim_sources claims rather than including them.
+// Azure AD does this for the groups claim of users in too many groups. Claims
+// are requested using the access token of their source, or else the access
+// token issued alongside each ID token, and cached until the ID token expires.
+// ID tokens that are verified without an access token, and whose distributed
+// claims are not cached, are rejected.
+//
+// Sources that refer to Azure AD Graph's getMemberObjects action are resolved
+// via the same action of the supplied Microsoft Graph API URL instead. Other
+// sources must respond with a JSON object that includes the claim.
+func DistributedClaims(graphURL string) Option {
+	return func(o *oidcExtractor) error {
+		if _, err := url.Parse(graphURL); err != nil {
+			return errors.Wrap(err, "invalid Microsoft Graph URL")
+		}
+		o.distributed = &distributedClaims{graphURL: strings.TrimSuffix(graphURL, "/"), cache: newClaimCache()}
+		return nil
+	}
+}
+
+// resolve returns the distributed claims referenced by the supplied claims of
+// the supplied verified ID token that the claims do not already include.
+func (d *distributedClaims) resolve(ctx context.Context, h *http.Client, idToken string, idt *oidc.IDToken, accessToken string, claims map[string]interface{}) (map[string]interface{}, error) {
+	names := map[string]string{}
+	sources := map[string]claimSource{}
+	if err := reclaim(claims[claimNames], &names); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s claim", claimNames)
+	}
+	if err := reclaim(claims[claimSources], &sources); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s claim", claimSources)
+	}
+	for name := range names {
+		if _, ok := claims[name]; ok {
+			delete(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	key := tokenKey(idToken)
+	if cached, ok := d.cache.get(key); ok {
+		return cached, nil
+	}
+
+	resolved := map[string]interface{}{}
+	for name, src := range names {
+		s, ok := sources[src]
+		if !ok {
+			return nil, errors.Errorf("claim %s refers to unknown source %q", name, src)
+		}
+		token := s.AccessToken
+		if token == "" {
+			token = accessToken
+		}
+		if token == "" {
+			return nil, errors.Errorf("no access token with which to resolve distributed claim %s", name)
+		}
+		t := time.Now()
+		v, err := d.request(ctx, h, name, s.Endpoint, token)
+		metrics.IdPRequestDuration.WithLabelValues(metrics.OperationDistributedClaims, metrics.Result(err)).Observe(time.Since(t).Seconds())
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot resolve distributed claim %s", name)
+		}
+		resolved[name] = v
+	}
+	d.cache.put(key, resolved, idt.Expiry)
+	return resolved, nil
+}
+
+// request the supplied claim from the supplied endpoint.
+func (d *distributedClaims) request(ctx context.Context, h *http.Client, name, endpoint, token string) (interface{}, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse endpoint")
+	}
+
+	// The access token issued alongside an Azure AD ID token is for Microsoft
+	// Graph, not the Azure AD Graph endpoint the token refers to.
+	if u.Host == aadGraphHost {
+		i := strings.Index(u.Path, "/users/")
+		if i < 0 {
+			return nil, errors.Errorf("unsupported Azure AD Graph endpoint %s", endpoint)
+		}
+		if u, err = url.Parse(d.graphURL + u.Path[i:]); err != nil {
+			return nil, errors.Wrap(err, "cannot parse Microsoft Graph endpoint")
+		}
+	}
+
+	if strings.HasSuffix(u.Path, getMemberObjects) {
+		rsp := struct {
+			Value []interface{} `json:"value"`
+		}{}
+		body := bytes.NewBufferString(`{"securityEnabledOnly":false}`)
+		if err := do(ctx, h, http.MethodPost, u.String(), token, body, &rsp); err != nil {
+			return nil, err
+		}
+		return rsp.Value, nil
+	}
+
+	rsp := map[string]interface{}{}
+	if err := do(ctx, h, http.MethodGet, u.String(), token, nil, &rsp); err != nil {
+		return nil, err
+	}
+	v, ok := rsp[name]
+	if !ok {
+		return nil, errors.Errorf("response from %s does not include claim", u.Host)
+	}
+	return v, nil
+}
+
+// do makes an authenticated HTTP request, and decodes its JSON response.
+func do(ctx context.Context, h *http.Client, method, endpoint, token string, body io.Reader, into interface{}) error {
+	r, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return errors.Wrap(err, "cannot create request")
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := h.Do(r.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "cannot make request")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 512)) // nolint: errcheck
+		return errors.Errorf("%s %s: %s", rsp.Status, r.URL.Host, strings.TrimSpace(string(b)))
+	}
+	return errors.Wrap(json.NewDecoder(rsp.Body).Decode(into), "cannot decode response")
+}
+
+// reclaim converts a claim decoded from JSON into the supplied type.
+func reclaim(claim, into interface{}) error {
+	if claim == nil {
+		return nil
+	}
+	b, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, into)
+}
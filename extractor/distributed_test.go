@@ -0,0 +1,164 @@
+package extractor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/go-test/deep"
+
+	"github.com/negz/kuberos/oidctest"
+)
+
+func TestGroupOverage(t *testing.T) {
+	cases := []struct {
+		name         string
+		fail         []oidctest.Failure
+		wantGroups   []string
+		wantReason   string
+		wantRequests int
+	}{
+		{
+			name:         "Resolved",
+			wantGroups:   []string{"admins", "devs"},
+			wantRequests: 1,
+		},
+		{
+			name:       "SourceFailed",
+			fail:       []oidctest.Failure{oidctest.FailMemberObjects},
+			wantReason: ReasonDistributedClaimsFailed,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := oidctest.NewServer(
+				oidctest.Subject("1234"),
+				oidctest.Claims(map[string]interface{}{"groups": []string{"admins", "devs"}}),
+				oidctest.GroupOverage(),
+				oidctest.Fail(tt.fail...))
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			ctx := context.Background()
+			e, cfg := newTestExtractor(t, s, DistributedClaims(DefaultGraphURL))
+			got, err := e.Process(ctx, cfg, authorize(t, cfg))
+			if tt.wantReason != "" {
+				if diff := deep.Equal(Reason(err), tt.wantReason); diff != nil {
+					t.Errorf("e.Process(...): want error with reason %q, got %v", tt.wantReason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("e.Process(...): %v", err)
+			}
+			if diff := deep.Equal(got.Groups, tt.wantGroups); diff != nil {
+				t.Errorf("e.Process(...): got != want: %v", diff)
+			}
+
+			// Verify has no access token, but should use the cached claims
+			// until the ID token expires.
+			now := got.Expiry.Add(-time.Second)
+			e.distributed.cache.now = func() time.Time { return now }
+			verified, err := e.Verify(ctx, got.IDToken)
+			if err != nil {
+				t.Fatalf("e.Verify(...): %v", err)
+			}
+			if diff := deep.Equal(verified.Groups, tt.wantGroups); diff != nil {
+				t.Errorf("e.Verify(...): got != want: %v", diff)
+			}
+			if diff := deep.Equal(s.Provider.MemberObjectsRequests(), tt.wantRequests); diff != nil {
+				t.Errorf("s.Provider.MemberObjectsRequests(): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestGroupOverageNotCached(t *testing.T) {
+	s, err := oidctest.NewServer(
+		oidctest.Subject("1234"),
+		oidctest.Claims(map[string]interface{}{"groups": []string{"admins", "devs"}}),
+		oidctest.GroupOverage())
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+	defer s.Close()
+
+	// An ID token Kuberos did not issue has no cached distributed claims, and
+	// Verify has no access token with which to resolve them.
+	e, _ := newTestExtractor(t, s, DistributedClaims(DefaultGraphURL))
+	idt, err := s.Provider.IDToken()
+	if err != nil {
+		t.Fatalf("s.Provider.IDToken(): %v", err)
+	}
+	_, err = e.Verify(context.Background(), idt)
+	if diff := deep.Equal(Reason(err), ReasonDistributedClaimsFailed); diff != nil {
+		t.Errorf("e.Verify(...): want error with reason %q, got %v", ReasonDistributedClaimsFailed, err)
+	}
+}
+
+func TestClaimSources(t *testing.T) {
+	var gotMethod, gotPath, gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod, gotPath, gotAuth = r.Method, r.URL.Path, r.Header.Get("Authorization")
+		rsp := map[string]interface{}{"groups": []string{"from-claims"}}
+		if r.Method == http.MethodPost {
+			rsp = map[string]interface{}{"value": []string{"from-graph"}}
+		}
+		json.NewEncoder(w).Encode(rsp) // nolint: errcheck
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name       string
+		source     map[string]interface{}
+		wantMethod string
+		wantPath   string
+		wantAuth   string
+		wantGroups interface{}
+	}{
+		{
+			name:       "ClaimsEndpoint",
+			source:     map[string]interface{}{"endpoint": srv.URL + "/claims", "access_token": "source"},
+			wantMethod: http.MethodGet,
+			wantPath:   "/claims",
+			wantAuth:   "Bearer source",
+			wantGroups: []interface{}{"from-claims"},
+		},
+		{
+			name:       "AzureADGraph",
+			source:     map[string]interface{}{"endpoint": "https://graph.windows.net/tenant/users/1234/getMemberObjects"},
+			wantMethod: http.MethodPost,
+			wantPath:   "/v1.0/users/1234/getMemberObjects",
+			wantAuth:   "Bearer user",
+			wantGroups: []interface{}{"from-graph"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &distributedClaims{graphURL: srv.URL + "/v1.0", cache: newClaimCache()}
+			claims := map[string]interface{}{
+				claimNames:   map[string]interface{}{"groups": "src1"},
+				claimSources: map[string]interface{}{"src1": tt.source},
+			}
+			idt := &oidc.IDToken{Subject: "1234", Expiry: time.Now().Add(time.Hour)}
+			got, err := d.resolve(context.Background(), http.DefaultClient, "token", idt, "user", claims)
+			if err != nil {
+				t.Fatalf("d.resolve(...): %v", err)
+			}
+			if diff := deep.Equal(got, map[string]interface{}{"groups": tt.wantGroups}); diff != nil {
+				t.Errorf("d.resolve(...): got != want: %v", diff)
+			}
+			if diff := deep.Equal([]string{gotMethod, gotPath, gotAuth}, []string{tt.wantMethod, tt.wantPath, tt.wantAuth}); diff != nil {
+				t.Errorf("request: got != want: %v", diff)
+			}
+		})
+	}
+}
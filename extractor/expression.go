@@ -0,0 +1,182 @@
+package extractor
+
+import (
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	"github.com/pkg/errors"
+)
+
+// varClaims is the variable via which expressions access ID token claims, as
+// in Kubernetes structured authentication configuration.
+const varClaims = "claims"
+
+// An expression is a compiled CEL expression.
+type expression struct {
+	source string
+	p      cel.Program
+}
+
+// A rule is a CEL expression that must evaluate to true.
+type rule struct {
+	expression
+	message string
+}
+
+// An extra derives an extra attribute of a user from their claims.
+type extra struct {
+	key string
+	expression
+}
+
+var (
+	typeStringList = reflect.TypeOf([]string{})
+	typeString     = reflect.TypeOf("")
+
+	// Claims are dynamically typed, so lists derived from them may be too.
+	stringOrList = []*cel.Type{cel.StringType, cel.ListType(cel.StringType), cel.ListType(cel.DynType)}
+)
+
+// compile the supplied CEL expression. Expressions may access the ID token's
+// claims via the claims variable (e.g. claims.email), and use the CEL string
+// extension library. The expression must be of one of the supplied types, or
+// dynamically typed.
+func compile(source string, want ...*cel.Type) (expression, error) {
+	env, err := cel.NewEnv(
+		cel.Variable(varClaims, cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings())
+	if err != nil {
+		return expression{}, errors.Wrap(err, "cannot create CEL environment")
+	}
+	ast, iss := env.Compile(source)
+	if iss.Err() != nil {
+		return expression{}, errors.Wrapf(iss.Err(), "cannot compile expression %q", source)
+	}
+	ok := ast.OutputType().IsExactType(cel.DynType)
+	for _, t := range want {
+		ok = ok || ast.OutputType().IsExactType(t)
+	}
+	if !ok {
+		return expression{}, errors.Errorf("expression %q must evaluate to %v, not %v", source, want, ast.OutputType())
+	}
+	p, err := env.Program(ast)
+	if err != nil {
+		return expression{}, errors.Wrapf(err, "cannot create program for expression %q", source)
+	}
+	return expression{source: source, p: p}, nil
+}
+
+func (e expression) eval(claims map[string]interface{}) (ref.Val, error) {
+	v, _, err := e.p.Eval(map[string]interface{}{varClaims: claims})
+	return v, errors.Wrapf(err, "cannot evaluate expression %q", e.source)
+}
+
+// evalString evaluates an expression that must produce a string.
+func (e expression) evalString(claims map[string]interface{}) (string, error) {
+	v, err := e.eval(claims)
+	if err != nil {
+		return "", err
+	}
+	s, err := v.ConvertToNative(typeString)
+	if err != nil {
+		return "", errors.Errorf("expression %q did not evaluate to a string", e.source)
+	}
+	return s.(string), nil
+}
+
+// evalStrings evaluates an expression that must produce a string or a list of
+// strings.
+func (e expression) evalStrings(claims map[string]interface{}) ([]string, error) {
+	v, err := e.eval(claims)
+	if err != nil {
+		return nil, err
+	}
+	if v.Type() == types.StringType {
+		return []string{v.Value().(string)}, nil
+	}
+	ss, err := v.ConvertToNative(typeStringList)
+	if err != nil {
+		return nil, errors.Errorf("expression %q did not evaluate to a string or list of strings", e.source)
+	}
+	return ss.([]string), nil
+}
+
+// evalBool evaluates an expression that must produce a bool.
+func (e expression) evalBool(claims map[string]interface{}) (bool, error) {
+	v, err := e.eval(claims)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.Value().(bool)
+	if !ok {
+		return false, errors.Errorf("expression %q did not evaluate to a bool", e.source)
+	}
+	return b, nil
+}
+
+// UsernameExpression derives usernames from ID token claims using the
+// supplied CEL expression (e.g. claims.email.split('@')[0]), rather than from
+// the username claim.
+func UsernameExpression(source string) Option {
+	return func(o *oidcExtractor) error {
+		e, err := compile(source, cel.StringType)
+		if err != nil {
+			return errors.Wrap(err, "invalid username expression")
+		}
+		o.username = &e
+		return nil
+	}
+}
+
+// GroupsExpression derives groups from ID token claims using the supplied CEL
+// expression, which must produce a string or a list of strings, rather than
+// from the groups claim.
+func GroupsExpression(source string) Option {
+	return func(o *oidcExtractor) error {
+		e, err := compile(source, stringOrList...)
+		if err != nil {
+			return errors.Wrap(err, "invalid groups expression")
+		}
+		o.groups = &e
+		return nil
+	}
+}
+
+// ExtraExpression derives the supplied extra attribute of a user from ID
+// token claims using the supplied CEL expression, which must produce a string
+// or a list of strings. Kubernetes expects keys to be domain-prefixed paths
+// (e.g. example.org/team).
+func ExtraExpression(key, source string) Option {
+	return func(o *oidcExtractor) error {
+		if key == "" {
+			return errors.New("extra key must not be empty")
+		}
+		e, err := compile(source, stringOrList...)
+		if err != nil {
+			return errors.Wrapf(err, "invalid expression for extra %s", key)
+		}
+		o.extra = append(o.extra, extra{key: key, expression: e})
+		return nil
+	}
+}
+
+// ClaimValidationRule refuses to issue credentials for ID tokens whose claims
+// do not satisfy the supplied CEL expression (e.g. claims.email_verified). The
+// supplied message explains failures. Rules are evaluated in the order they
+// are supplied.
+func ClaimValidationRule(source, message string) Option {
+	return func(o *oidcExtractor) error {
+		e, err := compile(source, cel.BoolType)
+		if err != nil {
+			return errors.Wrap(err, "invalid claim validation rule")
+		}
+		if message == "" {
+			message = "claims failed validation rule " + source
+		}
+		o.rules = append(o.rules, rule{expression: e, message: message})
+		return nil
+	}
+}
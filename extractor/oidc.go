@@ -4,19 +4,69 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/pkg/errors"
+
+	"github.com/negz/kuberos/metrics"
 )
 
 const tokenFieldIDToken = "id_token"
 
+// Default claims from which users' identities are extracted. These match the
+// conventional values of the Kubernetes API server's --oidc-username-claim and
+// --oidc-groups-claim flags.
+const (
+	DefaultUsernameClaim = "email"
+	DefaultGroupsClaim   = "groups"
+)
+
+const claimEmail = "email"
+
+// Reasons an OIDC extractor may fail to process a token.
+const (
+	ReasonExchangeFailed          = "exchange_failed"
+	ReasonMissingIDToken          = "missing_id_token"
+	ReasonVerifyFailed            = "verify_failed"
+	ReasonInvalidClaims           = "invalid_claims"
+	ReasonDomainRejected          = "domain_rejected"
+	ReasonClaimRejected           = "claim_rejected"
+	ReasonUserInfoFailed          = "userinfo_failed"
+	ReasonDistributedClaimsFailed = "distributed_claims_failed"
+	ReasonAuthenticationTooWeak   = "authentication_too_weak"
+	ReasonUnknown                 = "unknown"
+)
+
 // ErrMissingIDToken indicates a response that does not contain an id_token.
 var ErrMissingIDToken = errors.New("response missing ID token")
 
+type failure struct {
+	error
+	reason string
+}
+
+func fail(reason string, err error) error {
+	return &failure{error: err, reason: reason}
+}
+
+// Cause returns the underlying cause of the failure.
+func (f *failure) Cause() error {
+	return f.error
+}
+
+// Reason returns the reason an OIDC extractor returned the supplied error, or
+// ReasonUnknown if the error was not returned by an OIDC extractor.
+func Reason(err error) string {
+	if f, ok := err.(*failure); ok {
+		return f.reason
+	}
+	return ReasonUnknown
+}
+
 // OIDCAuthenticationParams are the parameters required for kubectl to
 // authenticate to Kubernetes via OIDC.
 type OIDCAuthenticationParams struct {
@@ -26,19 +76,57 @@ type OIDCAuthenticationParams struct {
 	IDToken      string `json:"idToken" schema:"idToken"`
 	RefreshToken string `json:"refreshToken" schema:"refreshToken"`
 	IssuerURL    string `json:"issuer" schema:"issuer"`
+
+	// AccessToken and Expiry are used by Kuberos, but not required by kubectl.
+	AccessToken string    `json:"-" schema:"-"`
+	Expiry      time.Time `json:"-" schema:"-"`
+
+	// Subject and Groups identify the user for auditing purposes.
+	Subject string   `json:"-" schema:"-"`
+	Groups  []string `json:"-" schema:"-"`
+
+	// Extra attributes of the user, derived from claims by expressions.
+	Extra map[string][]string `json:"-" schema:"-"`
+
+	// ACR, AMR, and AuthTime describe how the user authenticated.
+	ACR      string    `json:"-" schema:"-"`
+	AMR      []string  `json:"-" schema:"-"`
+	AuthTime time.Time `json:"-" schema:"-"`
 }
 
 // An OIDC extractor performs OIDC validation, extracting and storing the
 // information required for Kubernetes authentication along the way.
 type OIDC interface {
+	// Process exchanges an OAuth 2.0 authorization code for tokens.
 	Process(ctx context.Context, cfg *oauth2.Config, code string) (*OIDCAuthenticationParams, error)
+
+	// Refresh exchanges an OAuth 2.0 refresh token for new tokens.
+	Refresh(ctx context.Context, cfg *oauth2.Config, refreshToken string) (*OIDCAuthenticationParams, error)
+
+	// Verify verifies an ID token, returning the identity it asserts. Only
+	// the IDToken, IssuerURL, Expiry, Subject, Username, Groups, and Extra of
+	// the returned parameters are set.
+	Verify(ctx context.Context, idToken string) (*OIDCAuthenticationParams, error)
 }
 
 type oidcExtractor struct {
-	log         *zap.Logger
-	v           *oidc.IDTokenVerifier
-	h           *http.Client
-	emailDomain string
+	log           *zap.Logger
+	v             *oidc.IDTokenVerifier
+	h             *http.Client
+	emailDomain   string
+	usernameClaim string
+	groupsClaim   string
+
+	// Expressions take precedence over the username and groups claims.
+	username *expression
+	groups   *expression
+	extra    []extra
+	rules    []rule
+
+	userInfo    *userInfoCache
+	distributed *distributedClaims
+
+	require AuthenticationRequirement
 }
 
 // An Option represents a OIDC extractor option.
@@ -68,6 +156,26 @@ func EmailDomain(domain string) Option {
 	}
 }
 
+// UsernameClaim sets the ID token claim from which usernames are extracted.
+func UsernameClaim(c string) Option {
+	return func(o *oidcExtractor) error {
+		if c == "" {
+			return errors.New("username claim must not be empty")
+		}
+		o.usernameClaim = c
+		return nil
+	}
+}
+
+// GroupsClaim sets the ID token claim from which groups are extracted. The
+// claim may be a string or an array of strings.
+func GroupsClaim(c string) Option {
+	return func(o *oidcExtractor) error {
+		o.groupsClaim = c
+		return nil
+	}
+}
+
 // NewOIDC creates a new OIDC extractor.
 func NewOIDC(v *oidc.IDTokenVerifier, oo ...Option) (OIDC, error) {
 	l, err := zap.NewProduction()
@@ -75,7 +183,13 @@ func NewOIDC(v *oidc.IDTokenVerifier, oo ...Option) (OIDC, error) {
 		return nil, errors.Wrap(err, "cannot create default logger")
 	}
 
-	oe := &oidcExtractor{log: l, v: v, h: http.DefaultClient}
+	oe := &oidcExtractor{
+		log:           l,
+		v:             v,
+		h:             http.DefaultClient,
+		usernameClaim: DefaultUsernameClaim,
+		groupsClaim:   DefaultGroupsClaim,
+	}
 
 	for _, o := range oo {
 		if err := o(oe); err != nil {
@@ -86,22 +200,51 @@ func NewOIDC(v *oidc.IDTokenVerifier, oo ...Option) (OIDC, error) {
 }
 
 func (o *oidcExtractor) Process(ctx context.Context, cfg *oauth2.Config, code string) (*OIDCAuthenticationParams, error) {
-	o.log.Debug("exchange ", zap.String("code", code))
+	o.log.Debug("exchange")
 	octx := oidc.ClientContext(ctx, o.h)
+	t := time.Now()
 	token, err := cfg.Exchange(octx, code)
+	metrics.IdPRequestDuration.WithLabelValues(metrics.OperationExchange, metrics.Result(err)).Observe(time.Since(t).Seconds())
+	if err != nil {
+		return nil, fail(ReasonExchangeFailed, errors.Wrap(err, "cannot exchange code for token"))
+	}
+
+	p, err := o.params(ctx, cfg, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.require.Check(p, time.Now()); err != nil {
+		return nil, fail(ReasonAuthenticationTooWeak, err)
+	}
+	return p, nil
+}
+
+func (o *oidcExtractor) Refresh(ctx context.Context, cfg *oauth2.Config, refreshToken string) (*OIDCAuthenticationParams, error) {
+	octx := oidc.ClientContext(ctx, o.h)
+	t := time.Now()
+	token, err := cfg.TokenSource(octx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	metrics.IdPRequestDuration.WithLabelValues(metrics.OperationRefresh, metrics.Result(err)).Observe(time.Since(t).Seconds())
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot exchange code for token")
+		return nil, fail(ReasonExchangeFailed, errors.Wrap(err, "cannot refresh token"))
 	}
+	return o.params(ctx, cfg, token)
+}
 
+// params verifies the ID token of the supplied OAuth 2.0 token, and extracts
+// the parameters required for Kubernetes authentication.
+func (o *oidcExtractor) params(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token) (*OIDCAuthenticationParams, error) {
 	id, ok := token.Extra(tokenFieldIDToken).(string)
 	if !ok {
-		return nil, ErrMissingIDToken
+		return nil, fail(ReasonMissingIDToken, ErrMissingIDToken)
 	}
-	o.log.Debug("token", zap.String("id", id), zap.Any("token", token))
+	o.log.Debug("token",
+		zap.String("type", token.TokenType),
+		zap.Time("expiry", token.Expiry),
+		zap.Bool("refreshable", token.RefreshToken != ""))
 
 	idt, err := o.v.Verify(ctx, id)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot verify ID token")
+		return nil, fail(ReasonVerifyFailed, errors.Wrap(err, "cannot verify ID token"))
 	}
 
 	params := &OIDCAuthenticationParams{
@@ -109,15 +252,135 @@ func (o *oidcExtractor) Process(ctx context.Context, cfg *oauth2.Config, code st
 		ClientSecret: cfg.ClientSecret,
 		IDToken:      id,
 		RefreshToken: token.RefreshToken,
-		IssuerURL:    idt.Issuer,
+		AccessToken:  token.AccessToken,
 	}
-	if err := idt.Claims(params); err != nil {
-		return nil, errors.Wrap(err, "cannot extract claims from ID token")
+	if err := o.identify(ctx, params, idt, token.AccessToken); err != nil {
+		return nil, err
 	}
+	return params, nil
+}
 
-	if o.emailDomain != "" && !strings.HasSuffix(params.Username, "@"+o.emailDomain) {
-		return nil, errors.New("Invalid email domain, expecting " + o.emailDomain)
+func (o *oidcExtractor) Verify(ctx context.Context, idToken string) (*OIDCAuthenticationParams, error) {
+	idt, err := o.v.Verify(ctx, idToken)
+	if err != nil {
+		return nil, fail(ReasonVerifyFailed, errors.Wrap(err, "cannot verify ID token"))
+	}
+	params := &OIDCAuthenticationParams{IDToken: idToken}
+	if err := o.identify(ctx, params, idt, ""); err != nil {
+		return nil, err
 	}
-
 	return params, nil
 }
+
+// identify sets the identity asserted by the supplied verified ID token on
+// the supplied parameters, per the configured claim mapping. The supplied
+// access token, if any, is used to request UserInfo and distributed claims,
+// which are cached until the ID token expires.
+func (o *oidcExtractor) identify(ctx context.Context, params *OIDCAuthenticationParams, idt *oidc.IDToken, accessToken string) error {
+	claims := map[string]interface{}{}
+	if err := idt.Claims(&claims); err != nil {
+		return fail(ReasonInvalidClaims, errors.Wrap(err, "cannot extract claims from ID token"))
+	}
+	if o.userInfo != nil {
+		ui, err := o.userInfo.get(oidc.ClientContext(ctx, o.h), idt, accessToken)
+		if err != nil {
+			return fail(ReasonUserInfoFailed, err)
+		}
+		merge(claims, ui)
+	}
+	if o.distributed != nil {
+		dc, err := o.distributed.resolve(ctx, o.h, params.IDToken, idt, accessToken, claims)
+		if err != nil {
+			return fail(ReasonDistributedClaimsFailed, err)
+		}
+		merge(claims, dc)
+	}
+	params.IssuerURL = idt.Issuer
+	params.Expiry = idt.Expiry
+	params.Subject = idt.Subject
+
+	for _, r := range o.rules {
+		ok, err := r.evalBool(claims)
+		if err != nil {
+			return fail(ReasonInvalidClaims, err)
+		}
+		if !ok {
+			return fail(ReasonClaimRejected, errors.New(r.message))
+		}
+	}
+
+	if err := o.mapUsername(params, claims); err != nil {
+		return fail(ReasonInvalidClaims, err)
+	}
+	if err := o.mapGroups(params, claims); err != nil {
+		return fail(ReasonInvalidClaims, err)
+	}
+	if err := mapAuthentication(params, claims); err != nil {
+		return fail(ReasonInvalidClaims, err)
+	}
+	for _, x := range o.extra {
+		v, err := x.evalStrings(claims)
+		if err != nil {
+			return fail(ReasonInvalidClaims, err)
+		}
+		// Like Kubernetes, omit extra attributes with no values.
+		if len(v) == 0 {
+			continue
+		}
+		if params.Extra == nil {
+			params.Extra = map[string][]string{}
+		}
+		params.Extra[x.key] = v
+	}
+
+	if o.emailDomain != "" {
+		email, _ := claims[claimEmail].(string) // nolint: errcheck
+		if !strings.HasSuffix(email, "@"+o.emailDomain) {
+			return fail(ReasonDomainRejected, errors.New("Invalid email domain, expecting "+o.emailDomain))
+		}
+	}
+	return nil
+}
+
+func (o *oidcExtractor) mapUsername(params *OIDCAuthenticationParams, claims map[string]interface{}) error {
+	if o.username != nil {
+		u, err := o.username.evalString(claims)
+		params.Username = u
+		return err
+	}
+
+	// A missing username claim is tolerated; generated kubecfgs name such
+	// users after Kuberos. Callers that authenticate users must check for it.
+	u, ok := claims[o.usernameClaim]
+	if !ok {
+		return nil
+	}
+	s, ok := u.(string)
+	if !ok {
+		return errors.Errorf("claim %s is not a string", o.usernameClaim)
+	}
+	params.Username = s
+	return nil
+}
+
+func (o *oidcExtractor) mapGroups(params *OIDCAuthenticationParams, claims map[string]interface{}) error {
+	if o.groups != nil {
+		g, err := o.groups.evalStrings(claims)
+		params.Groups = g
+		return err
+	}
+
+	// Groups are optional, and may be a single string. Like Kubernetes, we
+	// ignore groups claims of any other type.
+	switch g := claims[o.groupsClaim].(type) {
+	case string:
+		params.Groups = []string{g}
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				params.Groups = append(params.Groups, s)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package extractor
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/go-test/deep"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/oidctest"
+)
+
+// testProvider returns the OIDC provider served by the supplied server.
+func testProvider(t *testing.T, s *oidctest.Server) *oidc.Provider {
+	p, err := oidc.NewProvider(context.Background(), s.Provider.Issuer())
+	if err != nil {
+		t.Fatalf("oidc.NewProvider(...): %v", err)
+	}
+	return p
+}
+
+// newTestExtractor returns an OIDC extractor with the supplied options that
+// verifies ID tokens issued by the supplied server, and an OAuth 2.0 config
+// for the server's client.
+func newTestExtractor(t *testing.T, s *oidctest.Server, oo ...Option) (*oidcExtractor, *oauth2.Config) {
+	p := testProvider(t, s)
+	e, err := NewOIDC(p.Verifier(&oidc.Config{ClientID: oidctest.DefaultClientID}), append([]Option{Logger(zap.NewNop())}, oo...)...)
+	if err != nil {
+		t.Fatalf("NewOIDC(...): %v", err)
+	}
+	cfg := &oauth2.Config{
+		ClientID:     oidctest.DefaultClientID,
+		ClientSecret: oidctest.DefaultClientSecret,
+		Endpoint:     p.Endpoint(),
+		RedirectURL:  "https://kuberos.example.org/ui",
+		Scopes:       []string{oidc.ScopeOpenID},
+	}
+	return e.(*oidcExtractor), cfg
+}
+
+// authorize follows the authorization flow for the supplied config, returning
+// the authorization code.
+func authorize(t *testing.T, c *oauth2.Config, oo ...oauth2.AuthCodeOption) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	rsp, err := client.Get(c.AuthCodeURL("state", oo...))
+	if err != nil {
+		t.Fatalf("client.Get(...): %v", err)
+	}
+	rsp.Body.Close()
+	u, err := rsp.Location()
+	if err != nil {
+		t.Fatalf("rsp.Location(): %v", err)
+	}
+	return u.Query().Get("code")
+}
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		name       string
+		claims     map[string]interface{}
+		oo         []Option
+		fail       []oidctest.Failure
+		wantUser   string
+		wantGroups []string
+		wantReason string
+	}{
+		{
+			name:       "Defaults",
+			claims:     map[string]interface{}{"email": "alice@example.org", "groups": []string{"admins", "devs"}},
+			wantUser:   "alice@example.org",
+			wantGroups: []string{"admins", "devs"},
+		},
+		{
+			name:       "CustomClaims",
+			claims:     map[string]interface{}{"email": "alice@example.org", "preferred_username": "alice", "roles": "admins"},
+			oo:         []Option{UsernameClaim("preferred_username"), GroupsClaim("roles")},
+			wantUser:   "alice",
+			wantGroups: []string{"admins"},
+		},
+		{
+			name: "MissingClaims",
+			oo:   []Option{UsernameClaim("preferred_username")},
+		},
+		{
+			name:       "InvalidUsername",
+			claims:     map[string]interface{}{"email": 42},
+			wantReason: ReasonInvalidClaims,
+		},
+		{
+			name:       "DomainRejected",
+			claims:     map[string]interface{}{"email": "mallory@example.net"},
+			oo:         []Option{EmailDomain("example.org")},
+			wantReason: ReasonDomainRejected,
+		},
+		{
+			name:     "DomainCheckedAgainstEmail",
+			claims:   map[string]interface{}{"email": "alice@example.org", "preferred_username": "alice"},
+			oo:       []Option{UsernameClaim("preferred_username"), EmailDomain("example.org")},
+			wantUser: "alice",
+		},
+		{
+			name:       "BadSignature",
+			claims:     map[string]interface{}{"email": "alice@example.org"},
+			fail:       []oidctest.Failure{oidctest.FailBadSignature},
+			wantReason: ReasonVerifyFailed,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := oidctest.NewServer(oidctest.Subject("1234"), oidctest.Claims(tt.claims), oidctest.Fail(tt.fail...))
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			e, _ := newTestExtractor(t, s, tt.oo...)
+			idt, err := s.Provider.IDToken()
+			if err != nil {
+				t.Fatalf("s.Provider.IDToken(): %v", err)
+			}
+
+			got, err := e.Verify(context.Background(), idt)
+			if tt.wantReason != "" {
+				if diff := deep.Equal(Reason(err), tt.wantReason); diff != nil {
+					t.Errorf("e.Verify(...): want error with reason %q, got %v", tt.wantReason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("e.Verify(...): %v", err)
+			}
+			want := &OIDCAuthenticationParams{
+				Username:  tt.wantUser,
+				IDToken:   idt,
+				IssuerURL: s.Provider.Issuer(),
+				Expiry:    got.Expiry,
+				Subject:   "1234",
+				Groups:    tt.wantGroups,
+			}
+			if diff := deep.Equal(got, want); diff != nil {
+				t.Errorf("e.Verify(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	claims := map[string]interface{}{
+		"email":          "alice@example.org",
+		"email_verified": true,
+		"roles":          []string{"admin", "dev"},
+		"team":           "platform",
+	}
+
+	cases := []struct {
+		name       string
+		claims     map[string]interface{}
+		oo         []Option
+		wantUser   string
+		wantGroups []string
+		wantExtra  map[string][]string
+		wantReason string
+	}{
+		{
+			name: "Mappings",
+			oo: []Option{
+				UsernameExpression("claims.email.split('@')[0]"),
+				GroupsExpression("claims.roles.map(r, 'role:' + r)"),
+				ExtraExpression("example.org/team", "claims.team"),
+				ExtraExpression("example.org/missing", "has(claims.missing) ? [claims.missing] : []"),
+			},
+			wantUser:   "alice",
+			wantGroups: []string{"role:admin", "role:dev"},
+			wantExtra:  map[string][]string{"example.org/team": {"platform"}},
+		},
+		{
+			name:     "RulesPass",
+			oo:       []Option{ClaimValidationRule("claims.email_verified", ""), ClaimValidationRule("'admin' in claims.roles", "")},
+			wantUser: "alice@example.org",
+		},
+		{
+			name:       "RuleRejects",
+			oo:         []Option{ClaimValidationRule("'ops' in claims.roles", "must be in ops")},
+			wantReason: ReasonClaimRejected,
+		},
+		{
+			name:       "EvaluationError",
+			oo:         []Option{UsernameExpression("claims.missing")},
+			wantReason: ReasonInvalidClaims,
+		},
+		{
+			name:       "WrongType",
+			oo:         []Option{UsernameExpression("claims.roles")},
+			wantReason: ReasonInvalidClaims,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := oidctest.NewServer(oidctest.Claims(claims))
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			e, _ := newTestExtractor(t, s, tt.oo...)
+			idt, err := s.Provider.IDToken()
+			if err != nil {
+				t.Fatalf("s.Provider.IDToken(): %v", err)
+			}
+
+			got, err := e.Verify(context.Background(), idt)
+			if tt.wantReason != "" {
+				if diff := deep.Equal(Reason(err), tt.wantReason); diff != nil {
+					t.Errorf("e.Verify(...): want error with reason %q, got %v", tt.wantReason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("e.Verify(...): %v", err)
+			}
+			if diff := deep.Equal([]interface{}{got.Username, got.Groups, got.Extra}, []interface{}{tt.wantUser, tt.wantGroups, tt.wantExtra}); diff != nil {
+				t.Errorf("e.Verify(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestInvalidExpressions(t *testing.T) {
+	cases := map[string]Option{
+		"Syntax":             UsernameExpression("claims.email.("),
+		"UsernameType":       UsernameExpression("1 + 1"),
+		"GroupsType":         GroupsExpression("true"),
+		"RuleType":           ClaimValidationRule("'yes'", ""),
+		"UndeclaredVariable": UsernameExpression("user.username"),
+		"EmptyExtraKey":      ExtraExpression("", "claims.team"),
+	}
+	for name, o := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewOIDC(nil, Logger(zap.NewNop()), o); err == nil {
+				t.Error("NewOIDC(...): want error, got nil")
+			}
+		})
+	}
+}
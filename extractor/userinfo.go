@@ -0,0 +1,81 @@
+package extractor
+
+import (
+	"context"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/metrics"
+)
+
+// A UserInfoProvider serves the OIDC UserInfo endpoint. *oidc.Provider is a
+// UserInfoProvider.
+type UserInfoProvider interface {
+	UserInfo(ctx context.Context, ts oauth2.TokenSource) (*oidc.UserInfo, error)
+}
+
+// UserInfo merges claims from the supplied provider's UserInfo endpoint into
+// ID token claims before they are mapped and validated, for providers that
+// omit claims such as groups or email from their ID tokens. Claims in the ID
+// token take precedence.
+//
+// UserInfo is requested using the access token issued alongside each ID token,
+// and cached per subject until that ID token expires. ID tokens that are
+// verified without an access token use the UserInfo cached for their subject,
+// and are rejected if there is none; their identity cannot be determined.
+func UserInfo(p UserInfoProvider) Option {
+	return func(o *oidcExtractor) error {
+		o.userInfo = &userInfoCache{p: p, cache: newClaimCache()}
+		return nil
+	}
+}
+
+type userInfoCache struct {
+	p     UserInfoProvider
+	cache *claimCache
+}
+
+// get returns UserInfo claims for the subject of the supplied verified ID
+// token. They are requested using the supplied access token if there is one,
+// or else read from the cache.
+func (c *userInfoCache) get(ctx context.Context, idt *oidc.IDToken, accessToken string) (map[string]interface{}, error) {
+	if accessToken == "" {
+		claims, ok := c.cache.get(idt.Subject)
+		if !ok {
+			return nil, errors.Errorf("UserInfo is not cached for subject %q, and there is no access token with which to request it", idt.Subject)
+		}
+		return claims, nil
+	}
+
+	t := time.Now()
+	ui, err := c.p.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+	metrics.IdPRequestDuration.WithLabelValues(metrics.OperationUserInfo, metrics.Result(err)).Observe(time.Since(t).Seconds())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get UserInfo")
+	}
+
+	// The UserInfo subject must match the ID token's, per OpenID Connect Core
+	// section 5.3.2, lest we mix up two users' claims.
+	if ui.Subject != idt.Subject {
+		return nil, errors.Errorf("UserInfo subject %q does not match ID token subject %q", ui.Subject, idt.Subject)
+	}
+	claims := map[string]interface{}{}
+	if err := ui.Claims(&claims); err != nil {
+		return nil, errors.Wrap(err, "cannot extract claims from UserInfo")
+	}
+	c.cache.put(idt.Subject, claims, idt.Expiry)
+	return claims, nil
+}
+
+// merge UserInfo claims into the supplied ID token claims. ID token claims
+// take precedence.
+func merge(claims, userInfo map[string]interface{}) {
+	for k, v := range userInfo {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+}
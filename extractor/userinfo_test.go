@@ -0,0 +1,216 @@
+package extractor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/go-test/deep"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/oidctest"
+)
+
+func TestUserInfo(t *testing.T) {
+	cases := []struct {
+		name         string
+		claims       map[string]interface{}
+		userInfo     map[string]interface{}
+		fail         []oidctest.Failure
+		wantUser     string
+		wantGroups   []string
+		wantReason   string
+		wantRequests int
+	}{
+		{
+			name:         "MergedClaims",
+			claims:       map[string]interface{}{"email": "alice@example.org"},
+			userInfo:     map[string]interface{}{"groups": []string{"admins", "devs"}},
+			wantUser:     "alice@example.org",
+			wantGroups:   []string{"admins", "devs"},
+			wantRequests: 1,
+		},
+		{
+			name:         "IDTokenClaimsTakePrecedence",
+			claims:       map[string]interface{}{"email": "alice@example.org", "groups": []string{"devs"}},
+			userInfo:     map[string]interface{}{"email": "mallory@example.org", "groups": []string{"admins"}},
+			wantUser:     "alice@example.org",
+			wantGroups:   []string{"devs"},
+			wantRequests: 1,
+		},
+		{
+			name:       "UserInfoFailed",
+			claims:     map[string]interface{}{"email": "alice@example.org"},
+			fail:       []oidctest.Failure{oidctest.FailUserInfo},
+			wantReason: ReasonUserInfoFailed,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := oidctest.NewServer(
+				oidctest.Subject("1234"),
+				oidctest.Claims(tt.claims),
+				oidctest.UserInfoClaims(tt.userInfo),
+				oidctest.Fail(tt.fail...))
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			ctx := context.Background()
+			e, cfg := newTestExtractor(t, s, UserInfo(testProvider(t, s)))
+			got, err := e.Process(ctx, cfg, authorize(t, cfg))
+			if tt.wantReason != "" {
+				if diff := deep.Equal(Reason(err), tt.wantReason); diff != nil {
+					t.Errorf("e.Process(...): want error with reason %q, got %v", tt.wantReason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("e.Process(...): %v", err)
+			}
+			if diff := deep.Equal([]interface{}{got.Username, got.Groups}, []interface{}{tt.wantUser, tt.wantGroups}); diff != nil {
+				t.Errorf("e.Process(...): got != want: %v", diff)
+			}
+
+			// Verify has no access token, but should use the cached claims.
+			verified, err := e.Verify(ctx, got.IDToken)
+			if err != nil {
+				t.Fatalf("e.Verify(...): %v", err)
+			}
+			if diff := deep.Equal([]interface{}{verified.Username, verified.Groups}, []interface{}{tt.wantUser, tt.wantGroups}); diff != nil {
+				t.Errorf("e.Verify(...): got != want: %v", diff)
+			}
+			if diff := deep.Equal(s.Provider.UserInfoRequests(), tt.wantRequests); diff != nil {
+				t.Errorf("s.Provider.UserInfoRequests(): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestUserInfoCacheExpiry(t *testing.T) {
+	cases := []struct {
+		name       string
+		elapsed    func(expiry time.Time) time.Duration
+		wantReason string
+	}{
+		{
+			name:    "UntilIDTokenExpires",
+			elapsed: func(expiry time.Time) time.Duration { return time.Until(expiry) - time.Second },
+		},
+		{
+			name:       "Expired",
+			elapsed:    func(expiry time.Time) time.Duration { return time.Until(expiry) + time.Second },
+			wantReason: ReasonUserInfoFailed,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := oidctest.NewServer(oidctest.Subject("1234"), oidctest.UserInfoClaims(map[string]interface{}{"groups": []string{"admins"}}))
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			ctx := context.Background()
+			e, cfg := newTestExtractor(t, s, UserInfo(testProvider(t, s)))
+			p, err := e.Process(ctx, cfg, authorize(t, cfg))
+			if err != nil {
+				t.Fatalf("e.Process(...): %v", err)
+			}
+
+			// The ID token remains valid, but its cached UserInfo may not.
+			now := time.Now().Add(tt.elapsed(p.Expiry))
+			e.userInfo.cache.now = func() time.Time { return now }
+
+			got, err := e.Verify(ctx, p.IDToken)
+			if tt.wantReason != "" {
+				if diff := deep.Equal(Reason(err), tt.wantReason); diff != nil {
+					t.Errorf("e.Verify(...): want error with reason %q, got %v", tt.wantReason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("e.Verify(...): %v", err)
+			}
+			if diff := deep.Equal(got.Groups, []string{"admins"}); diff != nil {
+				t.Errorf("e.Verify(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestUserInfoNotCached(t *testing.T) {
+	s, err := oidctest.NewServer(oidctest.Subject("1234"), oidctest.UserInfoClaims(map[string]interface{}{"groups": []string{"admins"}}))
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+	defer s.Close()
+
+	// No UserInfo is cached for a subject that has not logged in since Kuberos
+	// started.
+	e, _ := newTestExtractor(t, s, UserInfo(testProvider(t, s)))
+	idt, err := s.Provider.IDToken()
+	if err != nil {
+		t.Fatalf("s.Provider.IDToken(): %v", err)
+	}
+	_, err = e.Verify(context.Background(), idt)
+	if diff := deep.Equal(Reason(err), ReasonUserInfoFailed); diff != nil {
+		t.Errorf("e.Verify(...): want error with reason %q, got %v", ReasonUserInfoFailed, err)
+	}
+}
+
+func TestUserInfoCachedPerSubject(t *testing.T) {
+	s, err := oidctest.NewServer(oidctest.Subject("1234"), oidctest.UserInfoClaims(map[string]interface{}{"groups": []string{"admins"}}))
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	e, cfg := newTestExtractor(t, s, UserInfo(testProvider(t, s)))
+	if _, err := e.Process(ctx, cfg, authorize(t, cfg)); err != nil {
+		t.Fatalf("e.Process(...): %v", err)
+	}
+
+	// An ID token Kuberos did not issue, e.g. one kubectl refreshed directly
+	// with the provider, uses the UserInfo cached for its subject.
+	idt, err := s.Provider.IDToken()
+	if err != nil {
+		t.Fatalf("s.Provider.IDToken(): %v", err)
+	}
+	got, err := e.Verify(ctx, idt)
+	if err != nil {
+		t.Fatalf("e.Verify(...): %v", err)
+	}
+	if diff := deep.Equal(got.Groups, []string{"admins"}); diff != nil {
+		t.Errorf("e.Verify(...): got != want: %v", diff)
+	}
+	if diff := deep.Equal(s.Provider.UserInfoRequests(), 1); diff != nil {
+		t.Errorf("s.Provider.UserInfoRequests(): got != want: %v", diff)
+	}
+}
+
+type predictableUserInfo struct{ subject string }
+
+func (p predictableUserInfo) UserInfo(_ context.Context, _ oauth2.TokenSource) (*oidc.UserInfo, error) {
+	return &oidc.UserInfo{Subject: p.subject}, nil
+}
+
+func TestUserInfoSubjectMismatch(t *testing.T) {
+	s, err := oidctest.NewServer(oidctest.Subject("1234"))
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+	defer s.Close()
+
+	e, cfg := newTestExtractor(t, s, UserInfo(predictableUserInfo{subject: "5678"}))
+	_, err = e.Process(context.Background(), cfg, authorize(t, cfg))
+	if diff := deep.Equal(Reason(err), ReasonUserInfoFailed); diff != nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("e.Process(...): want subject mismatch error, got %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package kuberos
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+)
+
+var headElement = []byte("<head>")
+
+// Frontend returns a handler that serves the supplied frontend index page.
+// The frontend uses relative links, so a base element naming the URL at which
+// Kuberos is served is added to the page, allowing it to be served at any
+// path under the base path.
+func (h *Handlers) Frontend(index []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base := []byte(fmt.Sprintf("<head>\n  <base href=\"%s\">", html.EscapeString(h.baseURL(r).Path)))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(bytes.Replace(index, headElement, base, 1)) // nolint: errcheck
+	}
+}
@@ -0,0 +1,182 @@
+// Package health provides the readiness and liveness checks Kuberos exposes
+// to Kubernetes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/negz/kuberos/template"
+)
+
+// DefaultTimeout is the default time allowed for all checks to complete.
+const DefaultTimeout = 5 * time.Second
+
+const (
+	statusOK     = "ok"
+	statusFailed = "failed"
+
+	discoveryPath = "/.well-known/openid-configuration"
+	maxBodyBytes  = 1 << 20 // 1MB
+)
+
+var (
+	// ErrMissingClientSecret indicates Kuberos has no OAuth 2.0 client secret.
+	ErrMissingClientSecret = errors.New("client secret is empty")
+
+	// ErrMissingJWKSURI indicates an OIDC discovery document that does not
+	// name a JSON Web Key Set.
+	ErrMissingJWKSURI = errors.New("discovery document missing jwks_uri")
+
+	// ErrNoKeys indicates a JSON Web Key Set that contains no keys.
+	ErrNoKeys = errors.New("JSON web key set contains no keys")
+
+	// ErrNoClusters indicates a kubecfg template that contains no clusters.
+	ErrNoClusters = errors.New("kubecfg template contains no clusters")
+)
+
+// A Check determines whether some aspect of Kuberos is healthy.
+type Check struct {
+	// Name identifies the check in responses.
+	Name string
+
+	// Check returns an error if Kuberos is unhealthy.
+	Check func(ctx context.Context) error
+}
+
+// ClientSecret returns a Check that fails if the supplied OAuth 2.0 client
+// secret is empty.
+func ClientSecret(secret string) Check {
+	return Check{Name: "client-secret", Check: func(_ context.Context) error {
+		if strings.TrimSpace(secret) == "" {
+			return ErrMissingClientSecret
+		}
+		return nil
+	}}
+}
+
+// Template returns a Check that fails if the supplied kubecfg template cannot
+// be loaded, contains no clusters, or contains a cluster without a server.
+func Template(s template.Source) Check {
+	return Check{Name: "template", Check: func(_ context.Context) error {
+		cfg, err := s.Get()
+		if err != nil {
+			return errors.Wrap(err, "cannot load kubecfg template")
+		}
+		if len(cfg.Clusters) == 0 {
+			return ErrNoClusters
+		}
+		for name, c := range cfg.Clusters {
+			if c.Server == "" {
+				return errors.Errorf("cluster %s has no server", name)
+			}
+		}
+		return nil
+	}}
+}
+
+// OIDCProvider returns a Check that fails if the discovery document and JSON
+// Web Key Set of the supplied OIDC issuer cannot be fetched.
+func OIDCProvider(issuer string, h *http.Client) Check {
+	return Check{Name: "oidc-provider", Check: func(ctx context.Context) error {
+		d := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := get(ctx, h, strings.TrimSuffix(issuer, "/")+discoveryPath, &d); err != nil {
+			return errors.Wrap(err, "cannot fetch discovery document")
+		}
+		if d.JWKSURI == "" {
+			return ErrMissingJWKSURI
+		}
+
+		ks := struct {
+			Keys []json.RawMessage `json:"keys"`
+		}{}
+		if err := get(ctx, h, d.JWKSURI, &ks); err != nil {
+			return errors.Wrap(err, "cannot fetch JSON web key set")
+		}
+		if len(ks.Keys) == 0 {
+			return ErrNoKeys
+		}
+		return nil
+	}}
+}
+
+func get(ctx context.Context, h *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot create request")
+	}
+	rsp, err := h.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "cannot send request")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, maxBodyBytes)) // nolint: errcheck
+		return errors.Errorf("%s: %s", u, rsp.Status)
+	}
+	return errors.Wrap(json.NewDecoder(io.LimitReader(rsp.Body, maxBodyBytes)).Decode(v), "cannot decode response")
+}
+
+type result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type response struct {
+	Status string   `json:"status"`
+	Checks []result `json:"checks"`
+}
+
+// Handler returns an HTTP handler that runs the supplied checks concurrently,
+// responding 200 OK if they all pass within the supplied timeout or 503
+// Service Unavailable otherwise. The body lists the outcome of each check.
+func Handler(timeout time.Duration, cc ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		errs := make([]chan error, len(cc))
+		for i := range cc {
+			errs[i] = make(chan error, 1)
+			go func(c Check, ch chan<- error) { ch <- c.Check(ctx) }(cc[i], errs[i])
+		}
+
+		rsp := &response{Status: statusOK, Checks: make([]result, len(cc))}
+		for i, c := range cc {
+			var err error
+			select {
+			case err = <-errs[i]:
+			case <-ctx.Done():
+				err = errors.Wrap(ctx.Err(), "check did not complete")
+			}
+			rsp.Checks[i] = result{Name: c.Name, Status: statusOK}
+			if err != nil {
+				rsp.Status = statusFailed
+				rsp.Checks[i] = result{Name: c.Name, Status: statusFailed, Error: err.Error()}
+			}
+		}
+
+		j, err := json.Marshal(rsp)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "cannot marshal JSON").Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if rsp.Status != statusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(j) // nolint: errcheck
+	}
+}
@@ -0,0 +1,153 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/template"
+)
+
+func TestOIDCProvider(t *testing.T) {
+	cases := []struct {
+		name      string
+		discovery string
+		jwks      string
+		wantErr   bool
+	}{
+		{
+			name:      "Healthy",
+			discovery: `{"jwks_uri":"SERVER/keys"}`,
+			jwks:      `{"keys":[{"kty":"RSA"}]}`,
+		},
+		{
+			name:      "MissingJWKSURI",
+			discovery: `{}`,
+			wantErr:   true,
+		},
+		{
+			name:      "NoKeys",
+			discovery: `{"jwks_uri":"SERVER/keys"}`,
+			jwks:      `{"keys":[]}`,
+			wantErr:   true,
+		},
+		{
+			name:      "JWKSUnavailable",
+			discovery: `{"jwks_uri":"SERVER/nope"}`,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case discoveryPath:
+					w.Write([]byte(strings.Replace(tt.discovery, "SERVER", srv.URL, -1))) // nolint: errcheck
+				case "/keys":
+					w.Write([]byte(tt.jwks)) // nolint: errcheck
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			err := OIDCProvider(srv.URL, srv.Client()).Check(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("OIDCProvider(...).Check(): got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     *api.Config
+		wantErr error
+	}{
+		{
+			name: "Valid",
+			cfg:  &api.Config{Clusters: map[string]*api.Cluster{"a": {Server: "https://a"}}},
+		},
+		{
+			name:    "NoClusters",
+			cfg:     &api.Config{},
+			wantErr: ErrNoClusters,
+		},
+		{
+			name:    "NoServer",
+			cfg:     &api.Config{Clusters: map[string]*api.Cluster{"a": {}}},
+			wantErr: errors.New("cluster a has no server"),
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Template(template.Static(tt.cfg)).Check(context.Background())
+			if diff := deep.Equal(err, tt.wantErr); diff != nil {
+				t.Errorf("Template(...).Check(): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	pass := Check{Name: "pass", Check: func(_ context.Context) error { return nil }}
+	fail := Check{Name: "fail", Check: func(_ context.Context) error { return errors.New("boom") }}
+	block := make(chan struct{})
+	defer close(block)
+	hang := Check{Name: "hang", Check: func(_ context.Context) error { <-block; return nil }}
+
+	cases := []struct {
+		name     string
+		checks   []Check
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "NoChecks",
+			wantCode: http.StatusOK,
+			wantBody: `{"status":"ok","checks":[]}`,
+		},
+		{
+			name:     "AllPass",
+			checks:   []Check{pass, ClientSecret("secret")},
+			wantCode: http.StatusOK,
+			wantBody: `{"status":"ok","checks":[{"name":"pass","status":"ok"},{"name":"client-secret","status":"ok"}]}`,
+		},
+		{
+			name:     "OneFails",
+			checks:   []Check{pass, fail, ClientSecret("")},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `{"status":"failed","checks":[{"name":"pass","status":"ok"},{"name":"fail","status":"failed","error":"boom"},{"name":"client-secret","status":"failed","error":"client secret is empty"}]}`,
+		},
+		{
+			name:     "TimesOut",
+			checks:   []Check{hang},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `{"status":"failed","checks":[{"name":"hang","status":"failed","error":"check did not complete: context deadline exceeded"}]}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Handler(10*time.Millisecond, tt.checks...)(w, httptest.NewRequest("GET", "/readyz", nil))
+			if diff := deep.Equal(w.Code, tt.wantCode); diff != nil {
+				t.Errorf("w.Code: got != want: %v", diff)
+			}
+			if diff := deep.Equal(w.Body.String(), tt.wantBody); diff != nil {
+				t.Errorf("w.Body: got != want: %v", diff)
+			}
+		})
+	}
+}
@@ -1,33 +1,57 @@
-// +build integration
-
 package kuberos
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	oidc "github.com/coreos/go-oidc"
+	"github.com/go-test/deep"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/oidctest"
+	"github.com/negz/kuberos/template"
 )
 
 func TestOfflineAsScope(t *testing.T) {
 	cases := []struct {
 		name           string
-		issuer         string
+		scopes         []string
 		offlineAsScope bool
 	}{
-		// TODO(negz): Call a mock provider instead of Google. oidc.NewProvider()
-		// is the only way to instantiate a provider, and makes a real HTTP call.
 		{
-			name:           "Google",
-			issuer:         "https://accounts.google.com",
+			name:           "OfflineAccessSupported",
+			scopes:         oidctest.DefaultScopesSupported,
+			offlineAsScope: true,
+		},
+		{
+			// Google does not support the offline_access scope.
+			name:           "Googley",
+			scopes:         []string{"openid", "email", "profile"},
 			offlineAsScope: false,
 		},
 	}
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			p, err := oidc.NewProvider(context.Background(), tt.issuer)
+			s, err := oidctest.NewServer(oidctest.ScopesSupported(tt.scopes...))
+			if err != nil {
+				t.Fatalf("oidctest.NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			p, err := oidc.NewProvider(context.Background(), s.URL)
 			if err != nil {
-				t.Fatalf("oidc.NewProvider(context.Background(), %v): %s", tt.issuer, err)
+				t.Fatalf("oidc.NewProvider(context.Background(), %v): %s", s.URL, err)
 			}
 			actual := OfflineAsScope(p)
 			if tt.offlineAsScope != actual {
@@ -36,3 +60,192 @@ func TestOfflineAsScope(t *testing.T) {
 		})
 	}
 }
+
+// TestLogin follows the login flow from Kuberos, via a mock OIDC provider,
+// back to Kuberos, then generates a kubecfg from the resulting parameters.
+func TestLogin(t *testing.T) {
+	idp, err := oidctest.NewServer(oidctest.Subject("alice"), oidctest.Claims(map[string]interface{}{"email": "alice@example.org"}))
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+	defer idp.Close()
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, idp.URL)
+	if err != nil {
+		t.Fatalf("oidc.NewProvider(...): %v", err)
+	}
+	sr := ScopeRequests{OfflineAsScope: OfflineAsScope(provider)}
+	cfg := &oauth2.Config{
+		ClientID:     oidctest.DefaultClientID,
+		ClientSecret: oidctest.DefaultClientSecret,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       sr.Get(),
+	}
+	e, err := extractor.NewOIDC(provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}), extractor.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("extractor.NewOIDC(...): %v", err)
+	}
+	tmpl := template.Static(&api.Config{
+		CurrentContext: "prod",
+		Clusters:       map[string]*api.Cluster{"prod": {Server: "https://prod.example.org"}},
+	})
+	h, err := NewHandlers(cfg, e, Logger(zap.NewNop()), KubeCfgTemplate(tmpl))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	// The frontend served at the kubecfg endpoint passes its URL parameters on
+	// to the KubeCfg handler, so we skip it.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.Login)
+	mux.HandleFunc("/"+DefaultKubeCfgEndpoint, h.KubeCfg)
+	mux.HandleFunc("/kubecfg.yaml", h.Template)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	rsp, err := http.Get(s.URL + "/")
+	if err != nil {
+		t.Fatalf("http.Get(%s): %v", s.URL, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(rsp.Body)
+		t.Fatalf("login: want %d, got %d: %s", http.StatusOK, rsp.StatusCode, b)
+	}
+	p := &extractor.OIDCAuthenticationParams{}
+	if err := json.NewDecoder(rsp.Body).Decode(p); err != nil {
+		t.Fatalf("cannot decode authentication parameters: %v", err)
+	}
+	if diff := deep.Equal(p.Username, "alice@example.org"); diff != nil {
+		t.Errorf("p.Username: got != want: %v", diff)
+	}
+	if diff := deep.Equal(p.IssuerURL, idp.URL); diff != nil {
+		t.Errorf("p.IssuerURL: got != want: %v", diff)
+	}
+	if p.IDToken == "" || p.RefreshToken == "" {
+		t.Errorf("p: want ID and refresh tokens, got %#v", p)
+	}
+
+	q := url.Values{
+		"email":        {p.Username},
+		"clientID":     {p.ClientID},
+		"clientSecret": {p.ClientSecret},
+		"idToken":      {p.IDToken},
+		"refreshToken": {p.RefreshToken},
+		"issuer":       {p.IssuerURL},
+	}
+	trsp, err := http.Get(s.URL + "/kubecfg.yaml?" + q.Encode())
+	if err != nil {
+		t.Fatalf("http.Get(kubecfg.yaml): %v", err)
+	}
+	defer trsp.Body.Close()
+	y, err := ioutil.ReadAll(trsp.Body)
+	if err != nil {
+		t.Fatalf("cannot read kubecfg: %v", err)
+	}
+	kc, err := clientcmd.Load(y)
+	if err != nil {
+		t.Fatalf("clientcmd.Load(...): %v", err)
+	}
+	ai, ok := kc.AuthInfos[p.Username]
+	if !ok || ai.AuthProvider == nil {
+		t.Fatalf("kubecfg: missing user %s", p.Username)
+	}
+	if diff := deep.Equal(ai.AuthProvider.Config[templateOIDCIDToken], p.IDToken); diff != nil {
+		t.Errorf("kubecfg ID token: got != want: %v", diff)
+	}
+	if diff := deep.Equal(kc.Contexts["prod"].AuthInfo, p.Username); diff != nil {
+		t.Errorf("kubecfg context user: got != want: %v", diff)
+	}
+
+	// A user who declines to authorize Kuberos should not get a kubecfg.
+	idp.Provider.Fail(oidctest.FailAccessDenied)
+	denied, err := http.Get(s.URL + "/")
+	if err != nil {
+		t.Fatalf("http.Get(%s): %v", s.URL, err)
+	}
+	denied.Body.Close()
+	if diff := deep.Equal(denied.StatusCode, http.StatusForbidden); diff != nil {
+		t.Errorf("denied login: got != want: %v", diff)
+	}
+}
+
+// TestTokenReviewUserInfo follows the login flow with UserInfo enabled, then
+// reviews an ID token the OIDC provider issued directly to the same user, as
+// an API server would after kubectl refreshed it with the provider.
+func TestTokenReviewUserInfo(t *testing.T) {
+	idp, err := oidctest.NewServer(
+		oidctest.Subject("alice"),
+		oidctest.Claims(map[string]interface{}{"email": "alice@example.org"}),
+		oidctest.UserInfoClaims(map[string]interface{}{"groups": []string{"admins"}}))
+	if err != nil {
+		t.Fatalf("oidctest.NewServer(...): %v", err)
+	}
+	defer idp.Close()
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, idp.URL)
+	if err != nil {
+		t.Fatalf("oidc.NewProvider(...): %v", err)
+	}
+	cfg := &oauth2.Config{
+		ClientID:     oidctest.DefaultClientID,
+		ClientSecret: oidctest.DefaultClientSecret,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID},
+	}
+	newHandlers := func() *Handlers {
+		e, err := extractor.NewOIDC(provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}), extractor.Logger(zap.NewNop()), extractor.UserInfo(provider))
+		if err != nil {
+			t.Fatalf("extractor.NewOIDC(...): %v", err)
+		}
+		h, err := NewHandlers(cfg, e, Logger(zap.NewNop()), TokenReviewWebhook("", ""))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		return h
+	}
+	review := func(h *Handlers, idt string) authenticationv1.TokenReviewStatus {
+		body := `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"` + idt + `"}}`
+		w := httptest.NewRecorder()
+		h.TokenReview(w, httptest.NewRequest("POST", "/tokenreview", strings.NewReader(body)))
+		got := &authenticationv1.TokenReview{}
+		if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+			t.Fatalf("json.Unmarshal(...): %v", err)
+		}
+		return got.Status
+	}
+
+	h := newHandlers()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.Login)
+	mux.HandleFunc("/"+DefaultKubeCfgEndpoint, h.KubeCfg)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	rsp, err := http.Get(s.URL + "/")
+	if err != nil {
+		t.Fatalf("http.Get(%s): %v", s.URL, err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("login: want %d, got %d", http.StatusOK, rsp.StatusCode)
+	}
+
+	idt, err := idp.Provider.IDToken()
+	if err != nil {
+		t.Fatalf("idp.Provider.IDToken(): %v", err)
+	}
+	want := authenticationv1.TokenReviewStatus{
+		Authenticated: true,
+		User:          authenticationv1.UserInfo{Username: "alice@example.org", UID: "alice", Groups: []string{"admins"}},
+	}
+	if diff := deep.Equal(review(h, idt), want); diff != nil {
+		t.Errorf("h.TokenReview(...): got != want: %v", diff)
+	}
+
+	// A restarted Kuberos has not cached UserInfo for any subject.
+	if got := review(newHandlers(), idt); got.Authenticated || got.Error == "" {
+		t.Errorf("h.TokenReview(...): want error, got %#v", got)
+	}
+}
@@ -4,20 +4,25 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/negz/kuberos/audit"
+	"github.com/negz/kuberos/ca"
 	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/metrics"
+	"github.com/negz/kuberos/selftest"
+	"github.com/negz/kuberos/template"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/gorilla/schema"
 	"github.com/pkg/errors"
-	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
-	"k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
@@ -27,21 +32,21 @@ const (
 	// be redirected after authentication.
 	DefaultKubeCfgEndpoint = "ui"
 
-	// DefaultAPITokenMountPath is the default mount path for API tokens
-	DefaultAPITokenMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
-
-	schemeHTTP  = "http"
-	schemeHTTPS = "https"
-
-	headerForwardedProto  = "X-Forwarded-Proto"
-	headerForwardedFor    = "X-Forwarded-For"
-	headerForwardedPrefix = "X-Forwarded-Prefix"
+	// DefaultAPITokenMountPath is the default mount path for API tokens.
+	//
+	// Deprecated: Use ca.DefaultAPITokenMountPath.
+	DefaultAPITokenMountPath = ca.DefaultAPITokenMountPath
 
 	urlParamState            = "state"
 	urlParamCode             = "code"
 	urlParamError            = "error"
 	urlParamErrorDescription = "error_description"
 	urlParamErrorURI         = "error_uri"
+	urlParamRefreshToken     = "refreshToken"
+	urlParamFormat           = "format"
+
+	formatJSON = "json"
+	formatYAML = "yaml"
 
 	templateAuthProvider     = "oidc"
 	templateOIDCClientID     = "client-id"
@@ -51,6 +56,10 @@ const (
 	templateOIDCRefreshToken = "refresh-token"
 
 	templateFormParseMemory = 32 << 20 // 32MB
+
+	reasonStateMismatch = "state_mismatch"
+	reasonProviderError = "provider_error"
+	reasonMissingCode   = "missing_code"
 )
 
 var (
@@ -68,14 +77,23 @@ var (
 	// code
 	ErrMissingCode = errors.New("response missing authorization code")
 
+	// ErrMissingRefreshToken indicates a refresh request without an OAuth 2.0
+	// refresh token.
+	ErrMissingRefreshToken = errors.New("request missing refresh token")
+
+	// ErrUnknownFormat indicates a request for an unsupported response format.
+	ErrUnknownFormat = errors.New("unknown response format")
+
+	// ErrNoTemplate indicates a request for a kubecfg when no kubecfg template
+	// is configured.
+	ErrNoTemplate = errors.New("no kubecfg template configured")
+
 	// ErrNoYAMLSerializer indicates we're unable to serialize Kubernetes
 	// objects as YAML.
 	ErrNoYAMLSerializer = errors.New("no YAML serializer registered")
 
 	decoder = schema.NewDecoder()
 
-	appFs = afero.NewOsFs()
-
 	approvalConsent = oauth2.SetAuthURLParam("prompt", "consent")
 )
 
@@ -135,13 +153,28 @@ func (r *ScopeRequests) Get() []string {
 
 // Handlers provides HTTP handlers for the Kubernary service.
 type Handlers struct {
-	log        *zap.Logger
-	cfg        *oauth2.Config
-	e          extractor.OIDC
-	oo         []oauth2.AuthCodeOption
-	state      StateFn
-	httpClient *http.Client
-	endpoint   *url.URL
+	log         *zap.Logger
+	cfg         *oauth2.Config
+	e           extractor.OIDC
+	oo          []oauth2.AuthCodeOption
+	state       StateFn
+	httpClient  *http.Client
+	endpoint    *url.URL
+	template    template.Source
+	broker      bool
+	endSession  string
+	revocation  string
+	postLogout  string
+	audit       audit.Sink
+	trusted     []*net.IPNet
+	public      *url.URL
+	basePath    string
+	selfTest    *selftest.Tester
+	tokenReview *tokenReview
+	acrValues   []string
+	maxAge      time.Duration
+	clusterAuth map[string]extractor.AuthenticationRequirement
+	reviewAuth  extractor.AuthenticationRequirement
 }
 
 // An Option represents a Handlers option.
@@ -179,6 +212,49 @@ func Logger(l *zap.Logger) Option {
 	}
 }
 
+// TokenBroker configures Kuberos to act as a token refresh broker. Generated
+// kubecfgs omit the client secret and name Kuberos as their issuer, such that
+// kubectl refreshes its tokens via Kuberos rather than directly via the OIDC
+// provider.
+func TokenBroker() Option {
+	return func(h *Handlers) error {
+		h.broker = true
+		return nil
+	}
+}
+
+// KubeCfgEndpoint sets the endpoint, relative to the base path, to which the
+// OIDC provider should redirect users after authentication. It must be
+// registered with the OIDC provider.
+func KubeCfgEndpoint(endpoint string) Option {
+	return func(h *Handlers) error {
+		u, err := url.Parse(strings.TrimPrefix(endpoint, "/"))
+		if err != nil || u.IsAbs() || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+			return ErrInvalidKubeCfgEndpoint
+		}
+		h.endpoint = u
+		return nil
+	}
+}
+
+// BasePath sets the path under which Kuberos is served, e.g. /auth/k8s/.
+// Kuberos is served at the root path by default.
+func BasePath(p string) Option {
+	return func(h *Handlers) error {
+		h.basePath = path.Clean("/" + p)
+		return nil
+	}
+}
+
+// KubeCfgTemplate allows handlers to return a kubecfg generated from the
+// supplied template.
+func KubeCfgTemplate(s template.Source) Option {
+	return func(h *Handlers) error {
+		h.template = s
+		return nil
+	}
+}
+
 // NewHandlers returns a new set of Kuberos HTTP handlers.
 func NewHandlers(c *oauth2.Config, e extractor.OIDC, ho ...Option) (*Handlers, error) {
 	l, err := zap.NewProduction()
@@ -194,6 +270,8 @@ func NewHandlers(c *oauth2.Config, e extractor.OIDC, ho ...Option) (*Handlers, e
 		state:      defaultStateFn([]byte(c.ClientSecret)),
 		httpClient: http.DefaultClient,
 		endpoint:   &url.URL{Path: DefaultKubeCfgEndpoint},
+		basePath:   "/",
+		audit:      audit.Discard,
 	}
 
 	// Assume we're using a Googley request for offline access.
@@ -219,17 +297,20 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 		ClientSecret: h.cfg.ClientSecret,
 		Endpoint:     h.cfg.Endpoint,
 		Scopes:       h.cfg.Scopes,
-		RedirectURL:  redirectURL(r, h.endpoint),
+		RedirectURL:  h.redirectURL(r),
 	}
 
-	u := c.AuthCodeURL(h.state(r), h.oo...)
+	u := c.AuthCodeURL(h.state(r), h.authCodeOptions()...)
 	h.log.Debug("redirect", zap.String("url", u))
+	metrics.LoginsStarted.Inc()
 	http.Redirect(w, r, u, http.StatusSeeOther)
 }
 
 // KubeCfg returns a handler that forms helpers for kubecfg authentication.
 func (h *Handlers) KubeCfg(w http.ResponseWriter, r *http.Request) {
 	if r.FormValue(urlParamState) != h.state(r) {
+		metrics.CodeExchanges.WithLabelValues(metrics.ResultFailure, reasonStateMismatch).Inc()
+		h.record(h.newEvent(r, audit.ActionKubeCfg, nil, ErrInvalidState))
 		http.Error(w, ErrInvalidState.Error(), http.StatusForbidden)
 		return
 	}
@@ -242,12 +323,16 @@ func (h *Handlers) KubeCfg(w http.ResponseWriter, r *http.Request) {
 		if uri := r.FormValue(urlParamErrorURI); uri != "" {
 			msg = fmt.Sprintf("%s (see %s)", msg, uri)
 		}
+		metrics.CodeExchanges.WithLabelValues(metrics.ResultFailure, reasonProviderError).Inc()
+		h.record(h.newEvent(r, audit.ActionKubeCfg, nil, errors.New(msg)))
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
 
 	code := r.FormValue(urlParamCode)
 	if code == "" {
+		metrics.CodeExchanges.WithLabelValues(metrics.ResultFailure, reasonMissingCode).Inc()
+		h.record(h.newEvent(r, audit.ActionKubeCfg, nil, ErrMissingCode))
 		http.Error(w, ErrMissingCode.Error(), http.StatusBadRequest)
 		return
 	}
@@ -257,84 +342,165 @@ func (h *Handlers) KubeCfg(w http.ResponseWriter, r *http.Request) {
 		ClientSecret: h.cfg.ClientSecret,
 		Endpoint:     h.cfg.Endpoint,
 		Scopes:       h.cfg.Scopes,
-		RedirectURL:  redirectURL(r, h.endpoint),
+		RedirectURL:  h.redirectURL(r),
 	}
 
 	rsp, err := h.e.Process(r.Context(), c, code)
 	if err != nil {
+		metrics.CodeExchanges.WithLabelValues(metrics.ResultFailure, extractor.Reason(err)).Inc()
+		h.record(h.newEvent(r, audit.ActionKubeCfg, nil, err))
 		http.Error(w, errors.Wrap(err, "cannot process OAuth2 code").Error(), http.StatusForbidden)
 		return
 	}
+	metrics.CodeExchanges.WithLabelValues(metrics.ResultSuccess, "").Inc()
+
+	e := h.newEvent(r, audit.ActionKubeCfg, rsp, nil)
+	e.Clusters = h.clusters(rsp)
+	h.record(e)
 
-	j, err := json.Marshal(rsp)
+	if h.broker {
+		p := *rsp
+		p.ClientSecret = ""
+		p.IssuerURL = h.brokerIssuer(r)
+		rsp = &p
+	}
+
+	writeParams(w, rsp)
+}
+
+// Refresh exchanges the refresh token in the body of a POST request for a new
+// ID token, using Kuberos' client secret. It returns the updated
+// authentication parameters as JSON, or a kubecfg if the format parameter is
+// yaml. Clients refreshing via Kuberos need not hold the client secret, so it
+// is omitted from the response.
+func (h *Handlers) Refresh(w http.ResponseWriter, r *http.Request) {
+	rt := r.PostFormValue(urlParamRefreshToken)
+	if rt == "" {
+		http.Error(w, ErrMissingRefreshToken.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.FormValue(urlParamFormat)
+	switch format {
+	case "", formatJSON:
+	case formatYAML:
+		if h.template == nil {
+			http.Error(w, ErrNoTemplate.Error(), http.StatusNotImplemented)
+			return
+		}
+	default:
+		http.Error(w, ErrUnknownFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rsp, err := h.e.Refresh(r.Context(), h.cfg, rt)
+	if err != nil {
+		h.record(h.newEvent(r, audit.ActionRefresh, nil, err))
+		http.Error(w, errors.Wrap(err, "cannot refresh OAuth2 token").Error(), http.StatusForbidden)
+		return
+	}
+	p := *rsp
+	p.ClientSecret = ""
+	if h.broker {
+		p.IssuerURL = h.brokerIssuer(r)
+	}
+
+	if format == formatYAML {
+		names, err := h.writeKubeCfg(w, &p)
+		e := h.newEvent(r, audit.ActionRefresh, &p, err)
+		e.Clusters = names
+		h.record(e)
+		return
+	}
+	e := h.newEvent(r, audit.ActionRefresh, &p, nil)
+	e.Clusters = h.clusters(&p)
+	h.record(e)
+	writeParams(w, &p)
+}
+
+func writeParams(w http.ResponseWriter, p *extractor.OIDCAuthenticationParams) {
+	j, err := json.Marshal(p)
 	if err != nil {
 		http.Error(w, errors.Wrap(err, "cannot marshal JSON").Error(), http.StatusInternalServerError)
 		return
 	}
 
+	metrics.KubeCfgDownloads.WithLabelValues(metrics.FormatJSON).Inc()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if _, err := w.Write(j); err != nil {
 		http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
 	}
 }
 
-func redirectURL(r *http.Request, endpoint *url.URL) string {
-	if r.URL.IsAbs() {
-		return fmt.Sprint(r.URL.ResolveReference(endpoint))
-	}
-	u := &url.URL{}
-	u.Scheme = schemeHTTP
-	if r.TLS != nil {
-		u.Scheme = schemeHTTPS
-	}
-
-	for h, v := range r.Header {
-		switch h {
-		case headerForwardedProto:
-			// Redirect to HTTPS if we're listening on HTTP behind an HTTPS ELB.
-			for _, proto := range v {
-				if proto == schemeHTTPS {
-					u.Scheme = schemeHTTPS
-				}
-			}
-		case headerForwardedPrefix:
-			// Redirect includes X-Forwarded-Prefix if exists
-			for _, prefix := range v {
-				u.Path = prefix
-			}
-		}
-	}
-	// TODO(negz): Set port if X-Forwarded-Port exists?
-	u.Host = r.Host
-	return fmt.Sprint(u.ResolveReference(endpoint))
-}
-
 // Template returns an HTTP handler that returns a new kubecfg by taking a
 // template with existing clusters and adding a user and context for each based
 // on the URL parameters passed to it.
-func Template(cfg *api.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseMultipartForm(templateFormParseMemory) //nolint:errcheck
-		p := &extractor.OIDCAuthenticationParams{}
-
-		// TODO(negz): Return an error if any required parameter is absent.
-		if err := decoder.Decode(p, r.Form); err != nil {
-			http.Error(w, errors.Wrap(err, "cannot parse URL parameter").Error(), http.StatusBadRequest)
-			return
-		}
+func Template(s template.Source) http.HandlerFunc {
+	h := &Handlers{log: zap.NewNop(), template: s, audit: audit.Discard}
+	return h.Template
+}
 
-		y, err := clientcmd.Write(populateUser(cfg, p))
-		if err != nil {
-			http.Error(w, errors.Wrap(err, "cannot marshal template to YAML").Error(), http.StatusInternalServerError)
-			return
-		}
+// Template returns a new kubecfg by taking the Handlers' kubecfg template and
+// adding a user and context for each cluster based on the URL parameters
+// passed to it.
+func (h *Handlers) Template(w http.ResponseWriter, r *http.Request) {
+	if h.template == nil {
+		http.Error(w, ErrNoTemplate.Error(), http.StatusNotImplemented)
+		return
+	}
 
-		w.Header().Set("Content-Type", "text/x-yaml; charset=utf-8")
-		w.Header().Set("Content-Disposition", "attachment")
-		if _, err := w.Write(y); err != nil {
-			http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
-		}
+	r.ParseMultipartForm(templateFormParseMemory) //nolint:errcheck
+	p := &extractor.OIDCAuthenticationParams{}
+
+	// TODO(negz): Return an error if any required parameter is absent.
+	if err := decoder.Decode(p, r.Form); err != nil {
+		h.record(h.newEvent(r, audit.ActionTemplate, nil, err))
+		http.Error(w, errors.Wrap(err, "cannot parse URL parameter").Error(), http.StatusBadRequest)
+		return
+	}
+	v := h.authenticate(r.Context(), p)
+
+	names, err := h.writeKubeCfg(w, p)
+	e := h.newEvent(r, audit.ActionTemplate, p, err)
+	e.Clusters = names
+	if v == nil {
+		// Only the subject claimed by an unverified ID token is audited.
+		e.Email, e.Issuer, e.Unverified = "", "", true
+	} else {
+		// The kubecfg names Kuberos as its issuer if it is a token broker.
+		e.Issuer = v.IssuerURL
 	}
+	h.record(e)
+}
+
+// writeKubeCfg writes a kubecfg generated from the kubecfg template and the
+// supplied parameters, returning the names of the clusters it contained. Any
+// error has already been written to the response.
+func (h *Handlers) writeKubeCfg(w http.ResponseWriter, p *extractor.OIDCAuthenticationParams) ([]string, error) {
+	cfg, err := h.kubeCfgTemplate(p)
+	if err != nil {
+		err = errors.Wrap(err, "cannot get kubecfg template")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	y, err := clientcmd.Write(populateUser(cfg, p))
+	if err != nil {
+		err = errors.Wrap(err, "cannot marshal template to YAML")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	metrics.KubeCfgDownloads.WithLabelValues(metrics.FormatYAML).Inc()
+	metrics.KubeCfgClusters.WithLabelValues(metrics.FormatYAML).Observe(float64(len(cfg.Clusters)))
+	w.Header().Set("Content-Type", "text/x-yaml; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment")
+	if _, err := w.Write(y); err != nil {
+		err = errors.Wrap(err, "cannot write response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	return clusterNames(cfg), nil
 }
 
 func populateUser(cfg *api.Config, p *extractor.OIDCAuthenticationParams) api.Config {
@@ -348,28 +514,17 @@ func populateUser(cfg *api.Config, p *extractor.OIDCAuthenticationParams) api.Co
 			Name: templateAuthProvider,
 			Config: map[string]string{
 				templateOIDCClientID:     p.ClientID,
-				templateOIDCClientSecret: p.ClientSecret,
 				templateOIDCIDToken:      p.IDToken,
 				templateOIDCRefreshToken: p.RefreshToken,
 				templateOIDCIssuer:       p.IssuerURL,
 			},
 		},
 	}
+	if p.ClientSecret != "" {
+		c.AuthInfos[p.Username].AuthProvider.Config[templateOIDCClientSecret] = p.ClientSecret
+	}
 
 	for name, cluster := range cfg.Clusters {
-		// If the cluster definition does not come with certificate-authority-data nor
-		// certificate-authority, then check if kuberos has access to the cluster's CA
-		// certificate and include it when possible. Assume all errors are non-fatal.
-		if len(cluster.CertificateAuthorityData) == 0 && cluster.CertificateAuthority == "" {
-			caPath := filepath.Join(DefaultAPITokenMountPath, v1.ServiceAccountRootCAKey)
-			if caFile, err := appFs.Open(caPath); err == nil {
-				if caCert, err := ioutil.ReadAll(caFile); err == nil {
-					cluster.CertificateAuthorityData = caCert
-				}
-			} else {
-				fmt.Printf("Error: %+v\n", err)
-			}
-		}
 		c.Clusters[name] = cluster
 		c.Contexts[name] = &api.Context{
 			Cluster:  name,
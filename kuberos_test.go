@@ -4,15 +4,26 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/go-test/deep"
-	"github.com/spf13/afero"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"golang.org/x/oauth2"
 
+	"github.com/negz/kuberos/audit"
 	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/metrics"
+	"github.com/negz/kuberos/template"
 
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
 
@@ -25,11 +36,20 @@ func (p *predictableExtractor) Process(_ context.Context, _ *oauth2.Config, _ st
 	return p.p, p.err
 }
 
+func (p *predictableExtractor) Refresh(_ context.Context, _ *oauth2.Config, _ string) (*extractor.OIDCAuthenticationParams, error) {
+	return p.p, p.err
+}
+
+func (p *predictableExtractor) Verify(_ context.Context, _ string) (*extractor.OIDCAuthenticationParams, error) {
+	return p.p, p.err
+}
+
 func TestAuthCodeURL(t *testing.T) {
 	cases := []struct {
 		name string
 		c    *oauth2.Config
 		s    StateFn
+		oo   []Option
 		url  string
 	}{
 		{
@@ -56,12 +76,25 @@ func TestAuthCodeURL(t *testing.T) {
 			s:   func(_ *http.Request) string { return "state" },
 			url: "https://auth.example.org?client_id=testClientID&prompt=consent&redirect_uri=http%3A%2F%2Fexample.com%2Fui&response_type=code&scope=openid+offline_access&state=state",
 		},
+		{
+			name: "AuthenticationRequest",
+			c: &oauth2.Config{
+				ClientID:     "testClientID",
+				ClientSecret: "testClientSecret",
+				Endpoint:     oauth2.Endpoint{"https://auth.example.org", "https://token.example.org"},
+				Scopes:       []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess},
+				RedirectURL:  "https://example.org/redirect",
+			},
+			s:   func(_ *http.Request) string { return "state" },
+			oo:  []Option{ACRValues("mfa", "phr"), MaxAge(time.Hour)},
+			url: "https://auth.example.org?acr_values=mfa+phr&client_id=testClientID&max_age=3600&prompt=consent&redirect_uri=http%3A%2F%2Fexample.com%2Fui&response_type=code&scope=openid+offline_access&state=state",
+		},
 	}
 
 	for _, tt := range cases {
 		e := &predictableExtractor{}
 		t.Run(tt.name, func(t *testing.T) {
-			h, err := NewHandlers(tt.c, e, StateFunction(tt.s))
+			h, err := NewHandlers(tt.c, e, append([]Option{StateFunction(tt.s)}, tt.oo...)...)
 			if err != nil {
 				t.Fatalf("NewHandlers(%v, %v): %v", tt.c, e, err)
 			}
@@ -80,11 +113,521 @@ func TestAuthCodeURL(t *testing.T) {
 		})
 	}
 }
+
+func TestRefresh(t *testing.T) {
+	params := &extractor.OIDCAuthenticationParams{
+		Username:     "example@example.org",
+		ClientID:     "id",
+		ClientSecret: "secret",
+		IDToken:      "token",
+		RefreshToken: "refresh",
+		IssuerURL:    "https://example.org",
+	}
+	tmpl := template.Static(&api.Config{
+		Clusters: map[string]*api.Cluster{
+			"a": &api.Cluster{Server: "https://example.org"},
+		},
+	})
+
+	cases := []struct {
+		name string
+		form url.Values
+		e    *predictableExtractor
+		oo   []Option
+		code int
+		want string
+	}{
+		{
+			name: "JSON",
+			form: url.Values{urlParamRefreshToken: {"refresh"}},
+			e:    &predictableExtractor{p: params},
+			code: http.StatusOK,
+			want: `{"email":"example@example.org","clientID":"id","clientSecret":"","idToken":"token","refreshToken":"refresh","issuer":"https://example.org"}`,
+		},
+		{
+			name: "YAML",
+			form: url.Values{urlParamRefreshToken: {"refresh"}, urlParamFormat: {formatYAML}},
+			e:    &predictableExtractor{p: params},
+			oo:   []Option{KubeCfgTemplate(tmpl)},
+			code: http.StatusOK,
+			want: `apiVersion: v1
+clusters:
+- cluster:
+    server: https://example.org
+  name: a
+contexts:
+- context:
+    cluster: a
+    user: example@example.org
+  name: a
+current-context: ""
+kind: Config
+preferences: {}
+users:
+- name: example@example.org
+  user:
+    auth-provider:
+      config:
+        client-id: id
+        id-token: token
+        idp-issuer-url: https://example.org
+        refresh-token: refresh
+      name: oidc
+`,
+		},
+		{
+			name: "YAMLWithoutTemplate",
+			form: url.Values{urlParamRefreshToken: {"refresh"}, urlParamFormat: {formatYAML}},
+			e:    &predictableExtractor{p: params},
+			code: http.StatusNotImplemented,
+		},
+		{
+			name: "UnknownFormat",
+			form: url.Values{urlParamRefreshToken: {"refresh"}, urlParamFormat: {"toml"}},
+			e:    &predictableExtractor{p: params},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "MissingRefreshToken",
+			form: url.Values{},
+			e:    &predictableExtractor{p: params},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "RefreshFailed",
+			form: url.Values{urlParamRefreshToken: {"refresh"}},
+			e:    &predictableExtractor{err: errors.New("nope")},
+			code: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &oauth2.Config{ClientID: "id", ClientSecret: "secret"}
+			h, err := NewHandlers(c, tt.e, tt.oo...)
+			if err != nil {
+				t.Fatalf("NewHandlers(%v, %v): %v", c, tt.e, err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/refresh", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			h.Refresh(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if tt.want == "" {
+				return
+			}
+			if diff := deep.Equal(w.Body.String(), tt.want); diff != nil {
+				t.Errorf("w.Body: got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestTokenBroker(t *testing.T) {
+	params := &extractor.OIDCAuthenticationParams{
+		Username:     "example@example.org",
+		ClientID:     "id",
+		ClientSecret: "secret",
+		IDToken:      "token",
+		RefreshToken: "refresh",
+		IssuerURL:    "https://example.org",
+		AccessToken:  "access",
+	}
+	c := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+	}
+	h, err := NewHandlers(c, &predictableExtractor{p: params}, TokenBroker(), StateFunction(func(_ *http.Request) string { return "state" }))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	t.Run("KubeCfg", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.KubeCfg(w, httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil))
+		want := `{"email":"example@example.org","clientID":"id","clientSecret":"","idToken":"token","refreshToken":"refresh","issuer":"http://example.com/"}`
+		if diff := deep.Equal(w.Body.String(), want); diff != nil {
+			t.Errorf("w.Body: got != want: %v", diff)
+		}
+	})
+
+	t.Run("Discovery", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.Discovery(w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+		want := `{"issuer":"http://example.com/","authorization_endpoint":"https://auth.example.org","token_endpoint":"http://example.com/token","response_types_supported":["code"],"subject_types_supported":["public"],"id_token_signing_alg_values_supported":["RS256"],"grant_types_supported":["refresh_token"]}`
+		if diff := deep.Equal(w.Body.String(), want); diff != nil {
+			t.Errorf("w.Body: got != want: %v", diff)
+		}
+	})
+
+	cases := []struct {
+		name  string
+		form  url.Values
+		basic string
+		code  int
+		want  string
+	}{
+		{
+			name: "ClientIDInForm",
+			form: url.Values{formGrantType: {grantTypeRefreshToken}, formClientID: {"id"}, formRefreshToken: {"refresh"}},
+			code: http.StatusOK,
+			want: `{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","id_token":"token"}`,
+		},
+		{
+			name:  "ClientIDInBasicAuth",
+			form:  url.Values{formGrantType: {grantTypeRefreshToken}, formRefreshToken: {"refresh"}},
+			basic: "id",
+			code:  http.StatusOK,
+			want:  `{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","id_token":"token"}`,
+		},
+		{
+			name: "UnknownClient",
+			form: url.Values{formGrantType: {grantTypeRefreshToken}, formClientID: {"wat"}, formRefreshToken: {"refresh"}},
+			code: http.StatusUnauthorized,
+			want: `{"error":"invalid_client","error_description":"unknown client"}`,
+		},
+		{
+			name: "UnsupportedGrantType",
+			form: url.Values{formGrantType: {"authorization_code"}, formClientID: {"id"}},
+			code: http.StatusBadRequest,
+			want: `{"error":"unsupported_grant_type","error_description":"grant type \"authorization_code\" is not supported"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/token", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.basic != "" {
+				r.SetBasicAuth(tt.basic, "")
+			}
+			h.Token(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if diff := deep.Equal(w.Body.String(), tt.want); diff != nil {
+				t.Errorf("w.Body: got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	revoked := ""
+	revocation := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "id" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue(formToken) == "bad" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		revoked = r.PostFormValue(formToken)
+	}))
+	defer revocation.Close()
+
+	cases := []struct {
+		name        string
+		method      string
+		form        url.Values
+		oo          []Option
+		code        int
+		location    string
+		wantRevoked string
+		wantResult  string
+	}{
+		{
+			name:        "RevokeAndEndSession",
+			method:      "POST",
+			form:        url.Values{urlParamRefreshToken: {"refresh"}, urlParamIDToken: {"token"}},
+			oo:          []Option{RevocationEndpoint(revocation.URL), EndSessionEndpoint("https://example.org/logout"), PostLogoutRedirect("https://example.com/ui")},
+			code:        http.StatusSeeOther,
+			location:    "https://example.org/logout?client_id=id&id_token_hint=token&post_logout_redirect_uri=https%3A%2F%2Fexample.com%2Fui",
+			wantRevoked: "refresh",
+			wantResult:  metrics.ResultSuccess,
+		},
+		{
+			name:     "EndSessionOnly",
+			method:   "GET",
+			form:     url.Values{urlParamIDToken: {"token"}},
+			oo:       []Option{EndSessionEndpoint("https://example.org/logout")},
+			code:     http.StatusSeeOther,
+			location: "https://example.org/logout?client_id=id&id_token_hint=token",
+		},
+		{
+			name:   "NoEndpoints",
+			method: "POST",
+			form:   url.Values{urlParamRefreshToken: {"refresh"}},
+			code:   http.StatusOK,
+		},
+		{
+			name:       "RevocationFailed",
+			method:     "POST",
+			form:       url.Values{urlParamRefreshToken: {"bad"}},
+			oo:         []Option{RevocationEndpoint(revocation.URL), EndSessionEndpoint("https://example.org/logout")},
+			code:       http.StatusBadGateway,
+			wantResult: metrics.ResultFailure,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked = ""
+			c := &oauth2.Config{ClientID: "id", ClientSecret: "secret"}
+			h, err := NewHandlers(c, &predictableExtractor{}, tt.oo...)
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			before := map[string]uint64{}
+			for _, result := range []string{metrics.ResultSuccess, metrics.ResultFailure} {
+				before[result] = revocations(t, result)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/logout?"+tt.form.Encode(), nil)
+			if tt.method == "POST" {
+				r = httptest.NewRequest(tt.method, "/logout", strings.NewReader(tt.form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			h.Logout(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if l := w.Header().Get("Location"); l != tt.location {
+				t.Errorf("Location:\nwant %v\ngot %v\n", tt.location, l)
+			}
+			if revoked != tt.wantRevoked {
+				t.Errorf("revoked:\nwant %v\ngot %v\n", tt.wantRevoked, revoked)
+			}
+			for result, n := range before {
+				want := uint64(0)
+				if result == tt.wantResult {
+					want = 1
+				}
+				if got := revocations(t, result) - n; got != want {
+					t.Errorf("IdPRequestDuration{operation=%q, result=%q}: got %v observations, want %v", metrics.OperationRevoke, result, got, want)
+				}
+			}
+		})
+	}
+}
+
+// revocations returns the number of revocation requests observed with the
+// supplied result.
+func revocations(t *testing.T, result string) uint64 {
+	m := &dto.Metric{}
+	if err := metrics.IdPRequestDuration.WithLabelValues(metrics.OperationRevoke, result).(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("cannot read IdPRequestDuration: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestKubeCfgMetrics(t *testing.T) {
+	c := &oauth2.Config{ClientID: "id", Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org"}}
+	p := &extractor.OIDCAuthenticationParams{Username: "example@example.org", IDToken: "token"}
+
+	cases := []struct {
+		name   string
+		e      extractor.OIDC
+		url    string
+		result string
+		reason string
+	}{
+		{
+			name:   "Success",
+			e:      &predictableExtractor{p: p},
+			url:    "/kubecfg?state=state&code=code",
+			result: metrics.ResultSuccess,
+		},
+		{
+			name:   "StateMismatch",
+			e:      &predictableExtractor{p: p},
+			url:    "/kubecfg?state=wrong&code=code",
+			result: metrics.ResultFailure,
+			reason: reasonStateMismatch,
+		},
+		{
+			name:   "MissingCode",
+			e:      &predictableExtractor{p: p},
+			url:    "/kubecfg?state=state",
+			result: metrics.ResultFailure,
+			reason: reasonMissingCode,
+		},
+		{
+			name:   "ExtractorFailure",
+			e:      &predictableExtractor{err: errors.New("boom")},
+			url:    "/kubecfg?state=state&code=code",
+			result: metrics.ResultFailure,
+			reason: extractor.ReasonUnknown,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandlers(c, tt.e, StateFunction(func(_ *http.Request) string { return "state" }))
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+			m := metrics.CodeExchanges.WithLabelValues(tt.result, tt.reason)
+			before := testutil.ToFloat64(m)
+			h.KubeCfg(httptest.NewRecorder(), httptest.NewRequest("GET", tt.url, nil))
+			if got := testutil.ToFloat64(m) - before; got != 1 {
+				t.Errorf("CodeExchanges{result=%q, reason=%q}: got %v increments, want 1", tt.result, tt.reason, got)
+			}
+		})
+	}
+}
+
+type recordingSink struct {
+	mx     sync.Mutex
+	events []*audit.Event
+}
+
+func (s *recordingSink) Record(e *audit.Event) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) actions() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	a := make([]string, 0, len(s.events))
+	for _, e := range s.events {
+		a = append(a, e.Action)
+	}
+	return a
+}
+
+func TestAudit(t *testing.T) {
+	// {"sub":"1234","groups":["a","b"]}
+	idToken := "e30.eyJzdWIiOiIxMjM0IiwiZ3JvdXBzIjpbImEiLCJiIl19.sig"
+	params := &extractor.OIDCAuthenticationParams{
+		Username:  "example@example.org",
+		IDToken:   idToken,
+		IssuerURL: "https://example.org",
+		Subject:   "1234",
+		Groups:    []string{"a", "b"},
+	}
+	tmpl := template.Static(&api.Config{
+		Clusters: map[string]*api.Cluster{
+			"b": &api.Cluster{Server: "https://b.example.org"},
+			"a": &api.Cluster{Server: "https://a.example.org"},
+		},
+	})
+	c := &oauth2.Config{ClientID: "id", Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org"}}
+
+	cases := []struct {
+		name    string
+		e       extractor.OIDC
+		handler func(h *Handlers) http.HandlerFunc
+		url     string
+		want    *audit.Event
+	}{
+		{
+			name:    "KubeCfg",
+			e:       &predictableExtractor{p: params},
+			handler: func(h *Handlers) http.HandlerFunc { return h.KubeCfg },
+			url:     "/kubecfg?state=state&code=code",
+			want: &audit.Event{
+				Action:    audit.ActionKubeCfg,
+				Outcome:   audit.OutcomeSuccess,
+				Subject:   "1234",
+				Email:     "example@example.org",
+				Groups:    []string{"a", "b"},
+				Issuer:    "https://example.org",
+				ClientIP:  "192.0.2.1",
+				UserAgent: "kubectl",
+				Clusters:  []string{"a", "b"},
+			},
+		},
+		{
+			name:    "KubeCfgFailure",
+			e:       &predictableExtractor{err: errors.New("boom")},
+			handler: func(h *Handlers) http.HandlerFunc { return h.KubeCfg },
+			url:     "/kubecfg?state=state&code=code",
+			want: &audit.Event{
+				Action:    audit.ActionKubeCfg,
+				Outcome:   audit.OutcomeFailure,
+				Reason:    "boom",
+				ClientIP:  "192.0.2.1",
+				UserAgent: "kubectl",
+			},
+		},
+		{
+			name:    "Template",
+			e:       &predictableExtractor{p: params},
+			handler: func(h *Handlers) http.HandlerFunc { return h.Template },
+			// The identity of the verified ID token is audited, not that of
+			// the URL parameters.
+			url: "/kubecfg.yaml?email=mallory@example.org&issuer=https://kuberos.example.org&idToken=" + idToken,
+			want: &audit.Event{
+				Action:    audit.ActionTemplate,
+				Outcome:   audit.OutcomeSuccess,
+				Subject:   "1234",
+				Email:     "example@example.org",
+				Groups:    []string{"a", "b"},
+				Issuer:    "https://example.org",
+				ClientIP:  "192.0.2.1",
+				UserAgent: "kubectl",
+				Clusters:  []string{"a", "b"},
+			},
+		},
+		{
+			name:    "TemplateUnverified",
+			e:       &predictableExtractor{err: errors.New("boom")},
+			handler: func(h *Handlers) http.HandlerFunc { return h.Template },
+			url:     "/kubecfg.yaml?email=mallory@example.org&issuer=https://example.org&idToken=" + idToken,
+			want: &audit.Event{
+				Action:     audit.ActionTemplate,
+				Outcome:    audit.OutcomeSuccess,
+				Subject:    "1234",
+				Unverified: true,
+				ClientIP:   "192.0.2.1",
+				UserAgent:  "kubectl",
+				Clusters:   []string{"a", "b"},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &recordingSink{}
+			h, err := NewHandlers(c, tt.e, KubeCfgTemplate(tmpl), Audit(s), StateFunction(func(_ *http.Request) string { return "state" }))
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+			r := httptest.NewRequest("GET", tt.url, nil)
+			r.Header.Set("User-Agent", "kubectl")
+			tt.handler(h)(httptest.NewRecorder(), r)
+
+			if len(s.events) != 1 {
+				t.Fatalf("recorded events: got %d, want 1", len(s.events))
+			}
+			got := s.events[0]
+			got.Time = time.Time{}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("recorded event: got != want: %v", diff)
+			}
+		})
+	}
+}
+
 func TestPopulateUser(t *testing.T) {
 	cases := []struct {
 		name   string
 		cfg    *api.Config
-		files  map[string]string
 		params *extractor.OIDCAuthenticationParams
 		want   api.Config
 	}{
@@ -96,7 +639,6 @@ func TestPopulateUser(t *testing.T) {
 					"b": &api.Cluster{Server: "https://example.net", CertificateAuthorityData: []byte("PAM")},
 				},
 			},
-			files: map[string]string{},
 			params: &extractor.OIDCAuthenticationParams{
 				Username:     "example@example.org",
 				ClientID:     "id",
@@ -139,7 +681,6 @@ func TestPopulateUser(t *testing.T) {
 				},
 				CurrentContext: "a",
 			},
-			files: map[string]string{},
 			params: &extractor.OIDCAuthenticationParams{
 				Username:     "example@example.org",
 				ClientID:     "id",
@@ -174,47 +715,6 @@ func TestPopulateUser(t *testing.T) {
 				CurrentContext: "a",
 			},
 		},
-		{
-			name: "SingleClusterWithCAOnDisk",
-			cfg: &api.Config{
-				Clusters: map[string]*api.Cluster{
-					"a": &api.Cluster{Server: "https://example.org"},
-				},
-			},
-			files: map[string]string{
-				"/var/run/secrets/kubernetes.io/serviceaccount/ca.crt": "PEM",
-			},
-			params: &extractor.OIDCAuthenticationParams{
-				Username:     "example@example.org",
-				ClientID:     "id",
-				ClientSecret: "secret",
-				IDToken:      "token",
-				RefreshToken: "refresh",
-				IssuerURL:    "https://example.org",
-			},
-			want: api.Config{
-				Clusters: map[string]*api.Cluster{
-					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PEM")},
-				},
-				Contexts: map[string]*api.Context{
-					"a": &api.Context{AuthInfo: "example@example.org", Cluster: "a"},
-				},
-				AuthInfos: map[string]*api.AuthInfo{
-					"example@example.org": &api.AuthInfo{
-						AuthProvider: &api.AuthProviderConfig{
-							Name: templateAuthProvider,
-							Config: map[string]string{
-								templateOIDCClientID:     "id",
-								templateOIDCClientSecret: "secret",
-								templateOIDCIDToken:      "token",
-								templateOIDCRefreshToken: "refresh",
-								templateOIDCIssuer:       "https://example.org",
-							},
-						},
-					},
-				},
-			},
-		},
 		{
 			name: "SingleClusterWithoutCA",
 			cfg: &api.Config{
@@ -222,7 +722,6 @@ func TestPopulateUser(t *testing.T) {
 					"a": &api.Cluster{Server: "https://example.org"},
 				},
 			},
-			files: map[string]string{},
 			params: &extractor.OIDCAuthenticationParams{
 				Username:     "example@example.org",
 				ClientID:     "id",
@@ -258,13 +757,6 @@ func TestPopulateUser(t *testing.T) {
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			appFs = afero.NewMemMapFs()
-			for filename, content := range tt.files {
-				if err := afero.WriteFile(appFs, filename, []byte(content), 0644); err != nil {
-					t.Errorf("error writing file %q: %v", filename, err)
-				}
-			}
-
 			got := populateUser(tt.cfg, tt.params)
 			if diff := deep.Equal(got, tt.want); diff != nil {
 				t.Errorf("populateUser(...): got != want: %v", diff)
@@ -272,3 +764,28 @@ func TestPopulateUser(t *testing.T) {
 		})
 	}
 }
+
+func TestTemplate(t *testing.T) {
+	tmpl := template.Static(&api.Config{
+		Clusters: map[string]*api.Cluster{
+			"a": &api.Cluster{Server: "https://a.example.org"},
+		},
+	})
+
+	// Template has no extractor with which to verify ID tokens.
+	w := httptest.NewRecorder()
+	Template(tmpl)(w, httptest.NewRequest("GET", "/kubecfg.yaml?email=example@example.org&issuer=https://example.org&idToken=token", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Template(...): want %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	cfg, err := clientcmd.Load(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("clientcmd.Load(...): %v", err)
+	}
+	if diff := deep.Equal(clusterNames(cfg), []string{"a"}); diff != nil {
+		t.Errorf("Template(...): clusters: got != want: %v", diff)
+	}
+	if _, ok := cfg.AuthInfos["example@example.org"]; !ok {
+		t.Errorf("Template(...): missing user example@example.org")
+	}
+}
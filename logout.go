@@ -0,0 +1,147 @@
+package kuberos
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/negz/kuberos/audit"
+	"github.com/negz/kuberos/metrics"
+)
+
+const (
+	urlParamIDToken               = "idToken"
+	urlParamIDTokenHint           = "id_token_hint"
+	urlParamClientID              = "client_id"
+	urlParamPostLogoutRedirectURI = "post_logout_redirect_uri"
+
+	formToken         = "token"
+	formTokenTypeHint = "token_type_hint"
+)
+
+// ErrRevocationFailed indicates the OIDC provider refused to revoke a token.
+var ErrRevocationFailed = errors.New("cannot revoke refresh token")
+
+// LogoutEndpoints returns the RP-initiated logout (end_session_endpoint) and
+// token revocation (revocation_endpoint) endpoints advertised by the supplied
+// provider. Either may be empty if the provider does not support it.
+func LogoutEndpoints(p *oidc.Provider) (endSession, revocation string) {
+	var s struct {
+		EndSession string `json:"end_session_endpoint"`
+		Revocation string `json:"revocation_endpoint"`
+	}
+	if err := p.Claims(&s); err != nil {
+		return "", ""
+	}
+	return s.EndSession, s.Revocation
+}
+
+// EndSessionEndpoint allows Logout to end the user's session with the OIDC
+// provider per OpenID Connect RP-Initiated Logout.
+func EndSessionEndpoint(u string) Option {
+	return func(h *Handlers) error {
+		h.endSession = u
+		return nil
+	}
+}
+
+// RevocationEndpoint allows Logout to revoke the user's refresh token per RFC
+// 7009.
+func RevocationEndpoint(u string) Option {
+	return func(h *Handlers) error {
+		h.revocation = u
+		return nil
+	}
+}
+
+// PostLogoutRedirect sets the URL to which the OIDC provider should redirect
+// the user after ending their session. It must be registered with the OIDC
+// provider.
+func PostLogoutRedirect(u string) Option {
+	return func(h *Handlers) error {
+		h.postLogout = u
+		return nil
+	}
+}
+
+// Logout revokes the refresh token in the body of a POST request, if any,
+// then redirects to the OIDC provider's end session endpoint, if any. Kuberos
+// keeps no session state of its own, so there is nothing else to clear.
+func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
+	revoked := false
+	if rt := r.PostFormValue(urlParamRefreshToken); rt != "" && h.revocation != "" {
+		if err := h.revoke(r, rt); err != nil {
+			h.log.Info("logout", zap.Bool("revoked", false), zap.Error(err))
+			h.record(h.logoutEvent(r, err))
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		revoked = true
+	}
+	h.log.Info("logout", zap.Bool("revoked", revoked), zap.Bool("endSession", h.endSession != ""))
+	h.record(h.logoutEvent(r, nil))
+
+	if h.endSession == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "logged out") // nolint: errcheck
+		return
+	}
+
+	u, err := url.Parse(h.endSession)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot parse end session endpoint").Error(), http.StatusInternalServerError)
+		return
+	}
+	q := u.Query()
+	q.Set(urlParamClientID, h.cfg.ClientID)
+	if id := r.FormValue(urlParamIDToken); id != "" {
+		q.Set(urlParamIDTokenHint, id)
+	}
+	if h.postLogout != "" {
+		q.Set(urlParamPostLogoutRedirectURI, h.postLogout)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+func (h *Handlers) logoutEvent(r *http.Request, err error) *audit.Event {
+	e := h.newEvent(r, audit.ActionLogout, nil, err)
+	if id := r.FormValue(urlParamIDToken); id != "" {
+		e.Subject, e.Unverified = unverifiedSubject(id), true
+	}
+	return e
+}
+
+func (h *Handlers) revoke(r *http.Request, refreshToken string) (err error) {
+	form := url.Values{formToken: {refreshToken}, formTokenTypeHint: {formRefreshToken}}
+	req, err := http.NewRequest("POST", h.revocation, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "cannot create revocation request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(h.cfg.ClientID), url.QueryEscape(h.cfg.ClientSecret))
+
+	// Observe the result after checking the status, so that the provider
+	// refusing to revoke the token counts as a failure.
+	t := time.Now()
+	defer func() {
+		metrics.IdPRequestDuration.WithLabelValues(metrics.OperationRevoke, metrics.Result(err)).Observe(time.Since(t).Seconds())
+	}()
+	rsp, err := h.httpClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		return errors.Wrap(err, "cannot revoke refresh token")
+	}
+	defer rsp.Body.Close()
+
+	// Per RFC 7009 the provider responds 200 OK even if the token was invalid.
+	if rsp.StatusCode != http.StatusOK {
+		return errors.Errorf("%v: %s", ErrRevocationFailed, rsp.Status)
+	}
+	return nil
+}
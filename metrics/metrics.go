@@ -0,0 +1,98 @@
+// Package metrics provides Prometheus metrics for Kuberos.
+package metrics
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "kuberos"
+
+// Results of OAuth 2.0 code exchanges and IdP requests.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Formats of kubecfg downloads.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// IdP operations.
+const (
+	OperationExchange          = "exchange"
+	OperationRefresh           = "refresh"
+	OperationRevoke            = "revoke"
+	OperationUserInfo          = "userinfo"
+	OperationDistributedClaims = "distributed_claims"
+)
+
+var (
+	// LoginsStarted counts redirects to the OIDC provider.
+	LoginsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_started_total",
+		Help:      "Number of logins started by redirecting to the OIDC provider.",
+	})
+
+	// CodeExchanges counts OAuth 2.0 authorization code exchanges by result,
+	// and by reason for failure.
+	CodeExchanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "code_exchanges_total",
+		Help:      "Number of OAuth 2.0 authorization code exchanges by result and reason.",
+	}, []string{"result", "reason"})
+
+	// KubeCfgDownloads counts downloads of authentication parameters (JSON)
+	// and kubecfgs (YAML).
+	KubeCfgDownloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kubecfg_downloads_total",
+		Help:      "Number of kubecfg downloads by format.",
+	}, []string{"format"})
+
+	// KubeCfgClusters observes the number of clusters in downloaded kubecfgs.
+	KubeCfgClusters = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kubecfg_clusters",
+		Help:      "Number of clusters in downloaded kubecfgs by format.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100},
+	}, []string{"format"})
+
+	// IdPRequestDuration observes the latency of requests to the OIDC
+	// provider.
+	IdPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "idp_request_duration_seconds",
+		Help:      "Latency of requests to the OIDC provider by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	// TokenReviews counts TokenReviews by result, and by reason for failure.
+	TokenReviews = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_reviews_total",
+		Help:      "Number of TokenReviews by result and reason.",
+	}, []string{"result", "reason"})
+)
+
+// Register all Kuberos metrics with the supplied registerer.
+func Register(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{LoginsStarted, CodeExchanges, KubeCfgDownloads, KubeCfgClusters, IdPRequestDuration, TokenReviews} {
+		if err := r.Register(c); err != nil {
+			return errors.Wrap(err, "cannot register metric")
+		}
+	}
+	return nil
+}
+
+// Result returns ResultSuccess if the supplied error is nil, or ResultFailure
+// otherwise.
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
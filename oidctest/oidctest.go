@@ -0,0 +1,693 @@
+// Package oidctest provides an OpenID Connect provider for tests and local
+// development. It approves every authorization request without prompting,
+// issuing ID tokens with configurable claims.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Paths at which a Provider serves its endpoints, relative to its issuer.
+const (
+	PathDiscovery = "/.well-known/openid-configuration"
+	PathJWKS      = "/keys"
+	PathAuthorize = "/authorize"
+	PathToken     = "/token"
+	PathUserInfo  = "/userinfo"
+
+	// PathMemberObjects emulates the Microsoft Graph getMemberObjects action
+	// of the user with the subject at %s.
+	PathMemberObjects = "/users/%s/getMemberObjects"
+)
+
+// Defaults for a Provider that is not otherwise configured.
+const (
+	DefaultClientID      = "kuberos"
+	DefaultClientSecret  = "secret"
+	DefaultSubject       = "user"
+	DefaultEmail         = "user@example.org"
+	DefaultTokenLifetime = time.Hour
+)
+
+// DefaultScopesSupported are the scopes a Provider advertises by default.
+var DefaultScopesSupported = []string{"openid", "offline_access", "profile", "email", "groups"}
+
+const (
+	paramClientID     = "client_id"
+	paramClientSecret = "client_secret"
+	paramRedirectURI  = "redirect_uri"
+	paramResponseType = "response_type"
+	paramScope        = "scope"
+	paramState        = "state"
+	paramNonce        = "nonce"
+	paramAccessType   = "access_type"
+	paramACRValues    = "acr_values"
+	paramMaxAge       = "max_age"
+	paramCode         = "code"
+	paramGrantType    = "grant_type"
+	paramRefreshToken = "refresh_token"
+	paramError        = "error"
+
+	responseTypeCode       = "code"
+	grantAuthorizationCode = "authorization_code"
+	grantRefreshToken      = "refresh_token"
+	scopeOfflineAccess     = "offline_access"
+	accessTypeOffline      = "offline"
+
+	errInvalidRequest          = "invalid_request"
+	errInvalidClient           = "invalid_client"
+	errInvalidGrant            = "invalid_grant"
+	errUnsupportedGrantType    = "unsupported_grant_type"
+	errUnsupportedResponseType = "unsupported_response_type"
+	errAccessDenied            = "access_denied"
+	errServerError             = "server_error"
+)
+
+// A Failure that may be injected into a Provider.
+type Failure string
+
+// Failures that may be injected into a Provider.
+const (
+	// FailDiscovery causes the discovery endpoint to return an error.
+	FailDiscovery Failure = "discovery"
+
+	// FailJWKS causes the JWKS endpoint to return an error.
+	FailJWKS Failure = "jwks"
+
+	// FailAccessDenied causes the authorize endpoint to redirect with an
+	// access_denied error, as if the user declined to authorize the client.
+	FailAccessDenied Failure = "access-denied"
+
+	// FailToken causes the token endpoint to reject every grant.
+	FailToken Failure = "token"
+
+	// FailMissingIDToken causes the token endpoint to omit the ID token.
+	FailMissingIDToken Failure = "missing-id-token"
+
+	// FailBadSignature causes ID tokens to be signed by an unpublished key.
+	FailBadSignature Failure = "bad-signature"
+
+	// FailExpired causes ID tokens to be issued already expired.
+	FailExpired Failure = "expired"
+
+	// FailUserInfo causes the UserInfo endpoint to return an error.
+	FailUserInfo Failure = "userinfo"
+
+	// FailMemberObjects causes the getMemberObjects endpoint to return an
+	// error.
+	FailMemberObjects Failure = "member-objects"
+)
+
+// Failures lists every Failure that may be injected into a Provider.
+var Failures = []Failure{FailDiscovery, FailJWKS, FailAccessDenied, FailToken, FailMissingIDToken, FailBadSignature, FailExpired, FailUserInfo, FailMemberObjects}
+
+// A grant records the authorization request that produced a code or refresh
+// token.
+type grant struct {
+	redirectURI string
+	nonce       string
+	offline     bool
+
+	// acr is the first requested ACR value, which the Provider claims to have
+	// satisfied. authTime is the time the user authenticated, which the
+	// Provider claims only if the client requested a max_age.
+	acr      string
+	authTime int64
+}
+
+// A Provider is an OpenID Connect provider.
+type Provider struct {
+	key   *rsa.PrivateKey
+	keyID string
+
+	mx           sync.Mutex
+	issuer       string
+	clientID     string
+	clientSecret string
+	subject      string
+	claims       map[string]interface{}
+	userInfo     map[string]interface{}
+	scopes       []string
+	lifetime     time.Duration
+	failures     map[Failure]bool
+	codes        map[string]grant
+	refresh      map[string]grant
+	access       map[string]bool
+	rogue        *rsa.PrivateKey
+	overage      bool
+
+	userInfoRequests      int
+	memberObjectsRequests int
+}
+
+// An Option represents a Provider option.
+type Option func(*Provider) error
+
+// ClientID sets the client ID the Provider accepts.
+func ClientID(id string) Option {
+	return func(p *Provider) error {
+		p.clientID = id
+		return nil
+	}
+}
+
+// ClientSecret sets the client secret the Provider accepts.
+func ClientSecret(secret string) Option {
+	return func(p *Provider) error {
+		p.clientSecret = secret
+		return nil
+	}
+}
+
+// Subject sets the subject of the ID tokens the Provider issues.
+func Subject(sub string) Option {
+	return func(p *Provider) error {
+		p.subject = sub
+		return nil
+	}
+}
+
+// Claims adds the supplied claims to the ID tokens the Provider issues,
+// replacing any default claims of the same name.
+func Claims(c map[string]interface{}) Option {
+	return func(p *Provider) error {
+		for k, v := range c {
+			p.claims[k] = v
+		}
+		return nil
+	}
+}
+
+// UserInfoClaims adds the supplied claims to the Provider's UserInfo responses,
+// but not to its ID tokens, like providers that issue thin ID tokens. They
+// replace any ID token claims of the same name.
+func UserInfoClaims(c map[string]interface{}) Option {
+	return func(p *Provider) error {
+		for k, v := range c {
+			p.userInfo[k] = v
+		}
+		return nil
+	}
+}
+
+// GroupOverage causes the Provider to omit the groups claim from the ID tokens
+// it issues, like Azure AD does for users in too many groups. ID tokens instead
+// refer to the Provider's emulated getMemberObjects endpoint via distributed
+// claims. The endpoint serves the omitted groups.
+func GroupOverage() Option {
+	return func(p *Provider) error {
+		p.overage = true
+		return nil
+	}
+}
+
+// ScopesSupported sets the scopes the Provider advertises via discovery.
+func ScopesSupported(s ...string) Option {
+	return func(p *Provider) error {
+		p.scopes = s
+		return nil
+	}
+}
+
+// TokenLifetime sets the lifetime of the ID tokens the Provider issues.
+func TokenLifetime(d time.Duration) Option {
+	return func(p *Provider) error {
+		p.lifetime = d
+		return nil
+	}
+}
+
+// Fail injects the supplied failures into the Provider.
+func Fail(ff ...Failure) Option {
+	return func(p *Provider) error {
+		p.Fail(ff...)
+		return nil
+	}
+}
+
+// New returns a Provider for the supplied issuer URL. The Provider must be
+// served at the issuer URL.
+func New(issuer string, oo ...Option) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate signing key")
+	}
+	p := &Provider{
+		key:          key,
+		keyID:        random(),
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     DefaultClientID,
+		clientSecret: DefaultClientSecret,
+		subject:      DefaultSubject,
+		claims:       map[string]interface{}{"email": DefaultEmail, "email_verified": true},
+		scopes:       DefaultScopesSupported,
+		lifetime:     DefaultTokenLifetime,
+		failures:     map[Failure]bool{},
+		codes:        map[string]grant{},
+		refresh:      map[string]grant{},
+		userInfo:     map[string]interface{}{},
+		access:       map[string]bool{},
+	}
+	for _, o := range oo {
+		if err := o(p); err != nil {
+			return nil, errors.Wrap(err, "cannot apply provider option")
+		}
+	}
+	return p, nil
+}
+
+// Issuer returns the Provider's issuer URL.
+func (p *Provider) Issuer() string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.issuer
+}
+
+// Fail replaces any failures injected into the Provider with the supplied
+// failures. Call Fail with no arguments to stop injecting failures.
+func (p *Provider) Fail(ff ...Failure) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.failures = map[Failure]bool{}
+	for _, f := range ff {
+		p.failures[f] = true
+	}
+}
+
+// SetClaims adds the supplied claims to ID tokens issued from now on,
+// replacing any existing claims of the same name. A nil value removes a claim.
+func (p *Provider) SetClaims(c map[string]interface{}) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for k, v := range c {
+		if v == nil {
+			delete(p.claims, k)
+			continue
+		}
+		p.claims[k] = v
+	}
+}
+
+// IDToken returns an ID token issued by the Provider, as if a user had logged
+// in. Injected failures apply.
+func (p *Provider) IDToken() (string, error) {
+	idt, _, err := p.Tokens()
+	return idt, err
+}
+
+// Tokens returns an ID token and an access token issued by the Provider, as if
+// a user had logged in. Injected failures apply.
+func (p *Provider) Tokens() (idToken, accessToken string, err error) {
+	rsp, err := p.tokens(grant{})
+	if err != nil {
+		return "", "", err
+	}
+	idt, ok := rsp["id_token"].(string)
+	if !ok {
+		return "", "", errors.New("provider did not issue an ID token")
+	}
+	return idt, rsp["access_token"].(string), nil
+}
+
+// MemberObjectsRequests returns the number of requests the getMemberObjects
+// endpoint has served successfully.
+func (p *Provider) MemberObjectsRequests() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.memberObjectsRequests
+}
+
+// UserInfoRequests returns the number of requests the UserInfo endpoint has
+// served successfully.
+func (p *Provider) UserInfoRequests() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.userInfoRequests
+}
+
+func (p *Provider) failing(f Failure) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.failures[f]
+}
+
+// ServeHTTP serves the Provider's endpoints.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case PathDiscovery:
+		p.discovery(w, r)
+	case PathJWKS:
+		p.jwks(w, r)
+	case PathAuthorize:
+		p.authorize(w, r)
+	case PathToken:
+		p.token(w, r)
+	case PathUserInfo:
+		p.userinfo(w, r)
+	case fmt.Sprintf(PathMemberObjects, p.subject):
+		p.memberObjects(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, _ *http.Request) {
+	if p.failing(FailDiscovery) {
+		http.Error(w, "injected discovery failure", http.StatusInternalServerError)
+		return
+	}
+	p.mx.Lock()
+	d := map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + PathAuthorize,
+		"token_endpoint":                        p.issuer + PathToken,
+		"jwks_uri":                              p.issuer + PathJWKS,
+		"userinfo_endpoint":                     p.issuer + PathUserInfo,
+		"response_types_supported":              []string{responseTypeCode},
+		"grant_types_supported":                 []string{grantAuthorizationCode, grantRefreshToken},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{string(jose.RS256)},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"scopes_supported":                      p.scopes,
+	}
+	p.mx.Unlock()
+	writeJSON(w, http.StatusOK, d)
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, _ *http.Request) {
+	if p.failing(FailJWKS) {
+		http.Error(w, "injected JWKS failure", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &p.key.PublicKey,
+		KeyID:     p.keyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+// userinfo serves the claims of the user to whom the bearer access token was
+// issued. Every access token is issued to the Provider's only user.
+func (p *Provider) userinfo(w http.ResponseWriter, r *http.Request) {
+	if p.failing(FailUserInfo) {
+		http.Error(w, "injected UserInfo failure", http.StatusInternalServerError)
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if !p.access[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	claims := map[string]interface{}{}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	for k, v := range p.userInfo {
+		claims[k] = v
+	}
+	claims["sub"] = p.subject
+	p.userInfoRequests++
+	writeJSON(w, http.StatusOK, claims)
+}
+
+// memberObjects serves the groups omitted from ID tokens by GroupOverage, like
+// Microsoft Graph's getMemberObjects action.
+func (p *Provider) memberObjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.failing(FailMemberObjects) {
+		http.Error(w, "injected getMemberObjects failure", http.StatusInternalServerError)
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if !p.access[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	groups := p.claims["groups"]
+	if groups == nil {
+		groups = []string{}
+	}
+	p.memberObjectsRequests++
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": groups})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get(paramRedirectURI))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get(paramClientID) != p.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+
+	params := redirect.Query()
+	params.Set(paramState, q.Get(paramState))
+	scopes := strings.Fields(q.Get(paramScope))
+	switch {
+	case q.Get(paramResponseType) != responseTypeCode:
+		params.Set(paramError, errUnsupportedResponseType)
+	case !contains(scopes, "openid"):
+		params.Set(paramError, errInvalidRequest)
+	case p.failing(FailAccessDenied):
+		params.Set(paramError, errAccessDenied)
+	default:
+		code := random()
+		g := grant{
+			redirectURI: redirect.String(),
+			nonce:       q.Get(paramNonce),
+			offline:     contains(scopes, scopeOfflineAccess) || q.Get(paramAccessType) == accessTypeOffline,
+		}
+		if acr := strings.Fields(q.Get(paramACRValues)); len(acr) > 0 {
+			g.acr = acr[0]
+		}
+		if q.Get(paramMaxAge) != "" {
+			g.authTime = time.Now().Unix()
+		}
+		p.mx.Lock()
+		p.codes[code] = g
+		p.mx.Unlock()
+		params.Set(paramCode, code)
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, errInvalidRequest)
+		return
+	}
+	if !p.authenticated(r) {
+		tokenError(w, http.StatusUnauthorized, errInvalidClient)
+		return
+	}
+	if p.failing(FailToken) {
+		tokenError(w, http.StatusBadRequest, errInvalidGrant)
+		return
+	}
+
+	var g grant
+	var ok bool
+	p.mx.Lock()
+	switch r.PostForm.Get(paramGrantType) {
+	case grantAuthorizationCode:
+		code := r.PostForm.Get(paramCode)
+		g, ok = p.codes[code]
+		delete(p.codes, code)
+		ok = ok && g.redirectURI == r.PostForm.Get(paramRedirectURI)
+	case grantRefreshToken:
+		g, ok = p.refresh[r.PostForm.Get(paramRefreshToken)]
+		g.nonce = ""
+	default:
+		p.mx.Unlock()
+		tokenError(w, http.StatusBadRequest, errUnsupportedGrantType)
+		return
+	}
+	p.mx.Unlock()
+	if !ok {
+		tokenError(w, http.StatusBadRequest, errInvalidGrant)
+		return
+	}
+
+	rsp, err := p.tokens(g)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, errServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, rsp)
+}
+
+func (p *Provider) authenticated(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// Client credentials are form encoded before being sent via HTTP basic
+		// authentication per RFC 6749 section 2.3.1.
+		id, _ = url.QueryUnescape(id)         // nolint: errcheck
+		secret, _ = url.QueryUnescape(secret) // nolint: errcheck
+	} else {
+		id, secret = r.PostForm.Get(paramClientID), r.PostForm.Get(paramClientSecret)
+	}
+	return id == p.clientID && secret == p.clientSecret
+}
+
+// tokens returns a token response for the supplied grant.
+func (p *Provider) tokens(g grant) (map[string]interface{}, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	now := time.Now()
+	if p.failures[FailExpired] {
+		now = now.Add(-2 * p.lifetime)
+	}
+	claims := map[string]interface{}{}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	claims["iss"] = p.issuer
+	claims["sub"] = p.subject
+	claims["aud"] = p.clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(p.lifetime).Unix()
+	claims["jti"] = random()
+	if p.overage {
+		delete(claims, "groups")
+		claims["_claim_names"] = map[string]string{"groups": "src1"}
+		claims["_claim_sources"] = map[string]interface{}{
+			"src1": map[string]string{"endpoint": p.issuer + fmt.Sprintf(PathMemberObjects, p.subject)},
+		}
+	}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	if g.acr != "" {
+		claims["acr"] = g.acr
+	}
+	if g.authTime != 0 {
+		claims["auth_time"] = g.authTime
+	}
+
+	key := p.key
+	if p.failures[FailBadSignature] {
+		if p.rogue == nil {
+			k, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot generate rogue signing key")
+			}
+			p.rogue = k
+		}
+		key = p.rogue
+	}
+	idt, err := sign(key, p.keyID, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	at := random()
+	p.access[at] = true
+	rsp := map[string]interface{}{
+		"access_token": at,
+		"token_type":   "Bearer",
+		"expires_in":   int64(p.lifetime / time.Second),
+	}
+	if !p.failures[FailMissingIDToken] {
+		rsp["id_token"] = idt
+	}
+	if g.offline {
+		rt := random()
+		p.refresh[rt] = grant{offline: true, acr: g.acr, authTime: g.authTime}
+		rsp["refresh_token"] = rt
+	}
+	return rsp, nil
+}
+
+func sign(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	s, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: keyID}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create signer")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal claims")
+	}
+	jws, err := s.Sign(payload)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot sign ID token")
+	}
+	t, err := jws.CompactSerialize()
+	return t, errors.Wrap(err, "cannot serialize ID token")
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{paramError: code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) // nolint: errcheck
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func random() string {
+	b := make([]byte, 16)
+	rand.Read(b) // nolint: errcheck
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// A Server is a Provider served by a local HTTP server, for use in tests.
+type Server struct {
+	*httptest.Server
+	Provider *Provider
+}
+
+// NewServer starts and returns a Server. The caller should call Close when
+// finished, to shut it down.
+func NewServer(oo ...Option) (*Server, error) {
+	p, err := New("", oo...)
+	if err != nil {
+		return nil, err
+	}
+	s := httptest.NewServer(p)
+	p.mx.Lock()
+	p.issuer = s.URL
+	p.mx.Unlock()
+	return &Server{Server: s, Provider: p}, nil
+}
@@ -0,0 +1,203 @@
+package oidctest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/go-test/deep"
+	"golang.org/x/oauth2"
+)
+
+const redirectURL = "https://kuberos.example.org/ui"
+
+// authorize follows the authorization flow for the supplied config, returning
+// the parameters of the redirect back to the client.
+func authorize(t *testing.T, c *oauth2.Config) url.Values {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	rsp, err := client.Get(c.AuthCodeURL("state"))
+	if err != nil {
+		t.Fatalf("client.Get(...): %v", err)
+	}
+	rsp.Body.Close()
+	u, err := rsp.Location()
+	if err != nil {
+		t.Fatalf("rsp.Location(): %v", err)
+	}
+	return u.Query()
+}
+
+func TestProvider(t *testing.T) {
+	cases := []struct {
+		name         string
+		oo           []Option
+		scopes       []string
+		wantDiscover bool
+		wantError    string
+		wantExchange bool
+		wantVerify   bool
+		wantClaims   map[string]interface{}
+		wantRefresh  bool
+	}{
+		{
+			name:         "Success",
+			oo:           []Option{Subject("alice"), Claims(map[string]interface{}{"email": "alice@example.org", "groups": []string{"admins"}})},
+			scopes:       []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess},
+			wantDiscover: true,
+			wantExchange: true,
+			wantVerify:   true,
+			wantClaims:   map[string]interface{}{"sub": "alice", "email": "alice@example.org", "groups": []interface{}{"admins"}},
+			wantRefresh:  true,
+		},
+		{
+			name:         "DiscoveryFailure",
+			oo:           []Option{Fail(FailDiscovery)},
+			wantDiscover: false,
+		},
+		{
+			name:         "AccessDenied",
+			oo:           []Option{Fail(FailAccessDenied)},
+			scopes:       []string{oidc.ScopeOpenID},
+			wantDiscover: true,
+			wantError:    errAccessDenied,
+		},
+		{
+			name:         "TokenFailure",
+			oo:           []Option{Fail(FailToken)},
+			scopes:       []string{oidc.ScopeOpenID},
+			wantDiscover: true,
+			wantExchange: false,
+		},
+		{
+			name:         "BadSignature",
+			oo:           []Option{Fail(FailBadSignature)},
+			scopes:       []string{oidc.ScopeOpenID},
+			wantDiscover: true,
+			wantExchange: true,
+			wantVerify:   false,
+		},
+		{
+			name:         "Expired",
+			oo:           []Option{Fail(FailExpired)},
+			scopes:       []string{oidc.ScopeOpenID},
+			wantDiscover: true,
+			wantExchange: true,
+			wantVerify:   false,
+		},
+		{
+			name:         "JWKSFailure",
+			oo:           []Option{Fail(FailJWKS)},
+			scopes:       []string{oidc.ScopeOpenID},
+			wantDiscover: true,
+			wantExchange: true,
+			wantVerify:   false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServer(tt.oo...)
+			if err != nil {
+				t.Fatalf("NewServer(...): %v", err)
+			}
+			defer s.Close()
+
+			ctx := context.Background()
+			p, err := oidc.NewProvider(ctx, s.URL)
+			if (err == nil) != tt.wantDiscover {
+				t.Fatalf("oidc.NewProvider(...): want success %v, got error %v", tt.wantDiscover, err)
+			}
+			if !tt.wantDiscover {
+				return
+			}
+
+			c := &oauth2.Config{
+				ClientID:     DefaultClientID,
+				ClientSecret: DefaultClientSecret,
+				Endpoint:     p.Endpoint(),
+				RedirectURL:  redirectURL,
+				Scopes:       tt.scopes,
+			}
+			q := authorize(t, c)
+			if diff := deep.Equal(q.Get(paramState), "state"); diff != nil {
+				t.Errorf("state: got != want: %v", diff)
+			}
+			if diff := deep.Equal(q.Get(paramError), tt.wantError); diff != nil {
+				t.Fatalf("error: got != want: %v", diff)
+			}
+			if tt.wantError != "" {
+				return
+			}
+
+			tkn, err := c.Exchange(ctx, q.Get(paramCode))
+			if (err == nil) != tt.wantExchange {
+				t.Fatalf("c.Exchange(...): want success %v, got error %v", tt.wantExchange, err)
+			}
+			if !tt.wantExchange {
+				return
+			}
+			if diff := deep.Equal(tkn.RefreshToken != "", tt.wantRefresh); diff != nil {
+				t.Errorf("refresh token issued: got != want: %v", diff)
+			}
+
+			raw, _ := tkn.Extra("id_token").(string)
+			idt, err := p.Verifier(&oidc.Config{ClientID: DefaultClientID}).Verify(ctx, raw)
+			if (err == nil) != tt.wantVerify {
+				t.Fatalf("Verify(...): want success %v, got error %v", tt.wantVerify, err)
+			}
+			if !tt.wantVerify {
+				return
+			}
+			got := map[string]interface{}{}
+			if err := idt.Claims(&got); err != nil {
+				t.Fatalf("idt.Claims(...): %v", err)
+			}
+			for k, want := range tt.wantClaims {
+				if diff := deep.Equal(got[k], want); diff != nil {
+					t.Errorf("claim %s: got != want: %v", k, diff)
+				}
+			}
+
+			if !tt.wantRefresh {
+				return
+			}
+			refreshed, err := c.TokenSource(ctx, &oauth2.Token{RefreshToken: tkn.RefreshToken}).Token()
+			if err != nil {
+				t.Fatalf("TokenSource(...).Token(): %v", err)
+			}
+			if refreshed.Extra("id_token") == nil {
+				t.Errorf("refreshed token: missing ID token")
+			}
+		})
+	}
+}
+
+func TestCodeReuse(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %v", err)
+	}
+	defer s.Close()
+
+	c := &oauth2.Config{
+		ClientID:     DefaultClientID,
+		ClientSecret: DefaultClientSecret,
+		Endpoint:     oauth2.Endpoint{AuthURL: s.URL + PathAuthorize, TokenURL: s.URL + PathToken},
+		RedirectURL:  redirectURL,
+		Scopes:       []string{oidc.ScopeOpenID},
+	}
+	code := authorize(t, c).Get(paramCode)
+	if _, err := c.Exchange(context.Background(), code); err != nil {
+		t.Fatalf("c.Exchange(...): %v", err)
+	}
+	if _, err := c.Exchange(context.Background(), code); err == nil {
+		t.Errorf("c.Exchange(...): want error when reusing a code")
+	}
+
+	c.ClientSecret = "wrong"
+	if _, err := c.Exchange(context.Background(), authorize(t, c).Get(paramCode)); err == nil {
+		t.Errorf("c.Exchange(...): want error with the wrong client secret")
+	}
+}
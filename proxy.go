@@ -0,0 +1,241 @@
+package kuberos
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	schemeHTTP  = "http"
+	schemeHTTPS = "https"
+
+	portHTTP  = "80"
+	portHTTPS = "443"
+
+	headerForwarded       = "Forwarded"
+	headerForwardedProto  = "X-Forwarded-Proto"
+	headerForwardedHost   = "X-Forwarded-Host"
+	headerForwardedPort   = "X-Forwarded-Port"
+	headerForwardedFor    = "X-Forwarded-For"
+	headerForwardedPrefix = "X-Forwarded-Prefix"
+
+	forwardedProto = "proto"
+	forwardedHost  = "host"
+	forwardedFor   = "for"
+)
+
+// ParseTrustedProxies parses a list of CIDRs (e.g. 10.0.0.0/8) or bare IP
+// addresses from which forwarded headers should be trusted.
+func ParseTrustedProxies(ss []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("cannot parse trusted proxy %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse trusted proxy %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// TrustedProxies configures Kuberos to honour the Forwarded and X-Forwarded-*
+// headers of requests sent from the supplied networks. Forwarded headers are
+// ignored by default, because any client could set them.
+func TrustedProxies(nets []*net.IPNet) Option {
+	return func(h *Handlers) error {
+		h.trusted = nets
+		return nil
+	}
+}
+
+// PublicURL configures the URL at which clients reach Kuberos, bypassing any
+// inference from the request or its forwarded headers.
+func PublicURL(u *url.URL) Option {
+	return func(h *Handlers) error {
+		if !u.IsAbs() || u.Host == "" {
+			return errors.Errorf("public URL %q must be absolute", u)
+		}
+		p := *u
+		p.Path = withTrailingSlash(p.Path)
+		p.RawQuery, p.Fragment = "", ""
+		h.public = &p
+		return nil
+	}
+}
+
+func withTrailingSlash(p string) string {
+	if strings.HasSuffix(p, "/") {
+		return p
+	}
+	return p + "/"
+}
+
+func (h *Handlers) redirectURL(r *http.Request) string {
+	return fmt.Sprint(h.baseURL(r).ResolveReference(h.endpoint))
+}
+
+// trusts returns true if the supplied IP address is a trusted proxy.
+func (h *Handlers) trusts(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustsPeer returns true if the supplied request was sent by a trusted proxy.
+func (h *Handlers) trustsPeer(r *http.Request) bool {
+	return h.trusts(net.ParseIP(remoteHost(r.RemoteAddr)))
+}
+
+// baseURL returns the URL at which the supplied request was received, as seen
+// by the client.
+func (h *Handlers) baseURL(r *http.Request) *url.URL {
+	if h.public != nil {
+		u := *h.public
+		return &u
+	}
+	if r.URL.IsAbs() {
+		u := *r.URL
+		return &u
+	}
+	u := &url.URL{Scheme: schemeHTTP, Host: r.Host, Path: withTrailingSlash(h.basePath)}
+	if r.TLS != nil {
+		u.Scheme = schemeHTTPS
+	}
+	if !h.trustsPeer(r) {
+		return u
+	}
+
+	// The Forwarded header supersedes the X-Forwarded-* headers per RFC 7239.
+	if f := forwarded(r.Header); len(f) > 0 {
+		if proto := f[0][forwardedProto]; proto != "" {
+			u.Scheme = strings.ToLower(proto)
+		}
+		if host := f[0][forwardedHost]; host != "" {
+			u.Host = host
+		}
+	} else {
+		if proto := first(r.Header.Get(headerForwardedProto)); proto != "" {
+			u.Scheme = strings.ToLower(proto)
+		}
+		if host := first(r.Header.Get(headerForwardedHost)); host != "" {
+			u.Host = host
+		}
+		if port := first(r.Header.Get(headerForwardedPort)); port != "" {
+			u.Host = net.JoinHostPort(hostname(u.Host), port)
+		}
+	}
+	if prefix := first(r.Header.Get(headerForwardedPrefix)); prefix != "" {
+		u.Path = withTrailingSlash(path.Join("/", prefix, h.basePath))
+	}
+
+	// Omit the port if it is the default for the scheme.
+	if _, port, err := net.SplitHostPort(u.Host); err == nil {
+		if (u.Scheme == schemeHTTP && port == portHTTP) || (u.Scheme == schemeHTTPS && port == portHTTPS) {
+			u.Host = strings.TrimSuffix(u.Host, ":"+port)
+		}
+	}
+	return u
+}
+
+// clientIP returns the IP address from which the supplied request was sent.
+// When the request was sent by a trusted proxy the forwarded-for chain is
+// walked from the nearest hop, returning the first untrusted address.
+func (h *Handlers) clientIP(r *http.Request) string {
+	peer := remoteHost(r.RemoteAddr)
+	if !h.trustsPeer(r) {
+		return peer
+	}
+
+	var chain []string
+	if f := forwarded(r.Header); len(f) > 0 {
+		for _, e := range f {
+			chain = append(chain, remoteHost(e[forwardedFor]))
+		}
+	} else {
+		for _, v := range r.Header[http.CanonicalHeaderKey(headerForwardedFor)] {
+			for _, ip := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(ip))
+			}
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// An obfuscated or unknown hop; we can't see past it.
+			return peer
+		}
+		if !h.trusts(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+	return peer
+}
+
+// forwarded parses the RFC 7239 Forwarded headers of a request into a list of
+// elements, nearest the client first. Parameter names are lower cased.
+func forwarded(hdr http.Header) []map[string]string {
+	var elements []map[string]string
+	for _, v := range hdr[headerForwarded] {
+		for _, e := range strings.Split(v, ",") {
+			params := map[string]string{}
+			for _, pair := range strings.Split(e, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+			if len(params) > 0 {
+				elements = append(elements, params)
+			}
+		}
+	}
+	return elements
+}
+
+// first returns the first of a comma separated list of values.
+func first(v string) string {
+	return strings.TrimSpace(strings.Split(v, ",")[0])
+}
+
+// hostname returns the supplied host without any port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// remoteHost returns the IP address of the supplied address, which may include
+// a port and may be a bracketed IPv6 address.
+func remoteHost(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,214 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-test/deep"
+	"golang.org/x/oauth2"
+)
+
+func TestRedirectURL(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies(...): %v", err)
+	}
+	public, _ := url.Parse("https://kuberos.example.org/kuberos")
+
+	cases := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		oo      []Option
+		want    string
+	}{
+		{
+			name:   "NoHeaders",
+			remote: "10.0.0.1:1234",
+			oo:     []Option{TrustedProxies(trusted)},
+			want:   "http://example.com/ui",
+		},
+		{
+			name:    "UntrustedProxy",
+			remote:  "203.0.113.1:1234",
+			headers: map[string]string{headerForwardedProto: "https", headerForwardedHost: "evil.example.org"},
+			oo:      []Option{TrustedProxies(trusted)},
+			want:    "http://example.com/ui",
+		},
+		{
+			name:    "NoTrustedProxiesByDefault",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{headerForwardedProto: "https"},
+			want:    "http://example.com/ui",
+		},
+		{
+			name:   "XForwarded",
+			remote: "10.0.0.1:1234",
+			headers: map[string]string{
+				headerForwardedProto:  "https",
+				headerForwardedHost:   "kuberos.example.org",
+				headerForwardedPort:   "8443",
+				headerForwardedPrefix: "/kuberos",
+			},
+			oo:   []Option{TrustedProxies(trusted)},
+			want: "https://kuberos.example.org:8443/kuberos/ui",
+		},
+		{
+			name:   "XForwardedDefaultPort",
+			remote: "192.0.2.1:1234",
+			headers: map[string]string{
+				headerForwardedProto: "https, http",
+				headerForwardedHost:  "kuberos.example.org:10003",
+				headerForwardedPort:  "443",
+			},
+			oo:   []Option{TrustedProxies(trusted)},
+			want: "https://kuberos.example.org/ui",
+		},
+		{
+			name:   "Forwarded",
+			remote: "10.0.0.1:1234",
+			headers: map[string]string{
+				headerForwarded:      `for=198.51.100.1;proto=https;host="kuberos.example.org", for=10.0.0.2`,
+				headerForwardedProto: "http",
+				headerForwardedHost:  "ignored.example.org",
+			},
+			oo:   []Option{TrustedProxies(trusted)},
+			want: "https://kuberos.example.org/ui",
+		},
+		{
+			name: "BasePath",
+			oo:   []Option{BasePath("/auth/k8s/"), KubeCfgEndpoint("callback")},
+			want: "http://example.com/auth/k8s/callback",
+		},
+		{
+			name:    "BasePathWithPrefix",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{headerForwardedPrefix: "/proxy"},
+			oo:      []Option{TrustedProxies(trusted), BasePath("auth/k8s"), KubeCfgEndpoint("/oidc/callback")},
+			want:    "http://example.com/proxy/auth/k8s/oidc/callback",
+		},
+		{
+			name:    "PublicURL",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{headerForwardedHost: "ignored.example.org"},
+			oo:      []Option{TrustedProxies(trusted), PublicURL(public)},
+			want:    "https://kuberos.example.org/kuberos/ui",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandlers(&oauth2.Config{}, &predictableExtractor{}, tt.oo...)
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.remote != "" {
+				r.RemoteAddr = tt.remote
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if diff := deep.Equal(h.redirectURL(r), tt.want); diff != nil {
+				t.Errorf("h.redirectURL(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestKubeCfgEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		wantErr  error
+	}{
+		{endpoint: "ui"},
+		{endpoint: "/oidc/callback"},
+		{endpoint: "https://evil.example.org/ui", wantErr: ErrInvalidKubeCfgEndpoint},
+		{endpoint: "//evil.example.org/ui", wantErr: ErrInvalidKubeCfgEndpoint},
+		{endpoint: "", wantErr: ErrInvalidKubeCfgEndpoint},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			err := KubeCfgEndpoint(tt.endpoint)(&Handlers{})
+			if diff := deep.Equal(err, tt.wantErr); diff != nil {
+				t.Errorf("KubeCfgEndpoint(%q): got != want: %v", tt.endpoint, diff)
+			}
+		})
+	}
+}
+
+func TestFrontend(t *testing.T) {
+	h, err := NewHandlers(&oauth2.Config{}, &predictableExtractor{}, BasePath("/auth/k8s"))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+	w := httptest.NewRecorder()
+	h.Frontend([]byte("<html>\n<head>\n</head>\n</html>"))(w, httptest.NewRequest("GET", "/auth/k8s/ui", nil))
+	want := "<html>\n<head>\n  <base href=\"/auth/k8s/\">\n</head>\n</html>"
+	if diff := deep.Equal(w.Body.String(), want); diff != nil {
+		t.Errorf("w.Body: got != want: %v", diff)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies(...): %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		remote  string
+		headers http.Header
+		want    string
+	}{
+		{
+			name:    "UntrustedPeer",
+			remote:  "203.0.113.1:1234",
+			headers: http.Header{headerForwardedFor: {"198.51.100.1"}},
+			want:    "203.0.113.1",
+		},
+		{
+			name:    "XForwardedFor",
+			remote:  "10.0.0.1:1234",
+			headers: http.Header{headerForwardedFor: {"192.0.2.9, 198.51.100.1, 10.0.0.2"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "AllTrusted",
+			remote:  "10.0.0.1:1234",
+			headers: http.Header{headerForwardedFor: {"10.0.0.3", "10.0.0.2"}},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "Forwarded",
+			remote:  "10.0.0.1:1234",
+			headers: http.Header{headerForwarded: {`for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`}},
+			want:    "2001:db8::1",
+		},
+		{
+			name:    "ObfuscatedHop",
+			remote:  "10.0.0.1:1234",
+			headers: http.Header{headerForwarded: {`for=198.51.100.1, for=_hidden`}},
+			want:    "10.0.0.1",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandlers(&oauth2.Config{}, &predictableExtractor{}, TrustedProxies(trusted))
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header = tt.headers
+			if diff := deep.Equal(h.clientIP(r), tt.want); diff != nil {
+				t.Errorf("h.clientIP(...): got != want: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Package redact masks credentials in URLs and log entries.
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted replaces sensitive values.
+const Redacted = "REDACTED"
+
+var (
+	// sensitive keys are normalised by normalise before comparison.
+	sensitive = map[string]bool{
+		"accesstoken":        true,
+		"authorization":      true,
+		"clientsecret":       true,
+		"code":               true,
+		"cookie":             true,
+		"idtoken":            true,
+		"idtokenhint":        true,
+		"password":           true,
+		"proxyauthorization": true,
+		"refreshtoken":       true,
+		"secret":             true,
+		"setcookie":          true,
+		"token":              true,
+	}
+
+	// jwtRegexp matches JSON web tokens, whose base64 encoded JSON header
+	// always begins with eyJ (i.e. {").
+	jwtRegexp = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+func normalise(key string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+}
+
+// Sensitive returns true if values of the supplied key (e.g. a URL parameter,
+// HTTP header, or log field) should be redacted.
+func Sensitive(key string) bool {
+	return sensitive[normalise(key)]
+}
+
+// String masks any JSON web tokens in the supplied string.
+func String(s string) string {
+	return jwtRegexp.ReplaceAllString(s, Redacted)
+}
+
+// URL returns the supplied URL as a string, with the values of any sensitive
+// query parameters, any JSON web tokens, and any password masked.
+func URL(u *url.URL) string {
+	r := *u
+	if r.User != nil {
+		if _, ok := r.User.Password(); ok {
+			r.User = url.UserPassword(r.User.Username(), Redacted)
+		}
+	}
+	q := r.Query()
+	for k, vs := range q {
+		for i := range vs {
+			if Sensitive(k) {
+				vs[i] = Redacted
+				continue
+			}
+			vs[i] = String(vs[i])
+		}
+	}
+	if len(q) > 0 {
+		r.RawQuery = q.Encode()
+	}
+	return String(r.String())
+}
+
+// text masks sensitive query parameters if the supplied string is a URL, and
+// any JSON web tokens it contains.
+func text(s string) string {
+	if strings.Contains(s, "?") {
+		if u, err := url.Parse(s); err == nil && u.RawQuery != "" {
+			return URL(u)
+		}
+	}
+	return String(s)
+}
+
+type core struct {
+	zapcore.Core
+}
+
+// Core wraps the supplied core, masking the values of sensitive fields and any
+// JSON web tokens in log entries at all levels. Use it via zap.WrapCore.
+func Core(c zapcore.Core) zapcore.Core {
+	return &core{c}
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{c.Core.With(Fields(fields))}
+}
+
+func (c *core) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	// The wrapped core decides whether the entry is logged, e.g. by sampling,
+	// but we must write it so that it is masked.
+	if c.Core.Check(e, nil) != nil {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *core) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	e.Message = String(e.Message)
+	return c.Core.Write(e, Fields(fields))
+}
+
+// Fields returns a copy of the supplied fields with sensitive values masked.
+func Fields(fields []zapcore.Field) []zapcore.Field {
+	r := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		r[i] = field(f)
+	}
+	return r
+}
+
+func field(f zapcore.Field) zapcore.Field {
+	if Sensitive(f.Key) {
+		return zap.String(f.Key, Redacted)
+	}
+
+	switch f.Type {
+	case zapcore.StringType:
+		return zap.String(f.Key, text(f.String))
+	case zapcore.ByteStringType:
+		return zap.String(f.Key, text(string(f.Interface.([]byte))))
+	case zapcore.ErrorType:
+		return zap.String(f.Key, String(f.Interface.(error).Error()))
+	case zapcore.StringerType:
+		if u, ok := f.Interface.(*url.URL); ok {
+			return zap.String(f.Key, URL(u))
+		}
+		return zap.String(f.Key, text(f.Interface.(fmt.Stringer).String()))
+	case zapcore.ReflectType, zapcore.ObjectMarshalerType, zapcore.ArrayMarshalerType:
+		enc := zapcore.NewMapObjectEncoder()
+		f.AddTo(enc)
+		return zap.Any(f.Key, value(enc.Fields[f.Key]))
+	}
+	return f
+}
+
+// value returns a copy of the supplied value with sensitive values masked. It
+// round trips the value through JSON, which is how it would be logged.
+func value(v interface{}) interface{} {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return Redacted
+	}
+	var generic interface{}
+	if err := json.Unmarshal(j, &generic); err != nil {
+		return Redacted
+	}
+	return walk(generic)
+}
+
+func walk(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return text(t)
+	case []interface{}:
+		for i := range t {
+			t[i] = walk(t[i])
+		}
+		return t
+	case map[string]interface{}:
+		for k := range t {
+			if Sensitive(k) {
+				t[k] = Redacted
+				continue
+			}
+			t[k] = walk(t[k])
+		}
+		return t
+	}
+	return v
+}
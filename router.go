@@ -0,0 +1,27 @@
+package kuberos
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Routes adds the routes used by browsers and kubectl to the supplied router,
+// under the base path. The frontend's static files are served from the
+// supplied filesystem, and its index page at the kubecfg endpoint.
+func (h *Handlers) Routes(r *httprouter.Router, files http.FileSystem, index []byte) {
+	base := func(p string) string { return path.Join("/", h.basePath, p) }
+	r.ServeFiles(base("/dist/*filepath"), files)
+	r.HandlerFunc("GET", base(h.endpoint.Path), h.Frontend(index))
+	r.HandlerFunc("GET", withTrailingSlash(base("/")), h.Login)
+	r.HandlerFunc("GET", base("/kubecfg"), h.KubeCfg)
+	r.HandlerFunc("GET", base("/kubecfg.yaml"), h.Template)
+	r.HandlerFunc("POST", base("/refresh"), h.Refresh)
+	r.HandlerFunc("POST", base("/selftest"), h.SelfTest)
+	r.HandlerFunc("POST", base("/rules"), h.Rules)
+	r.HandlerFunc("GET", base("/.well-known/openid-configuration"), h.Discovery)
+	r.HandlerFunc("POST", base("/"+brokerTokenEndpoint), h.Token)
+	r.HandlerFunc("GET", base("/logout"), h.Logout)
+	r.HandlerFunc("POST", base("/logout"), h.Logout)
+}
@@ -0,0 +1,92 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/selftest"
+)
+
+// ErrMissingIDToken indicates a self-test request without an ID token.
+var ErrMissingIDToken = errors.New("request missing ID token")
+
+type selfTestResponse struct {
+	Clusters []selftest.Result `json:"clusters"`
+}
+
+type rulesResponse struct {
+	Clusters []selftest.Rules `json:"clusters"`
+}
+
+// SelfTest allows users to test their ID token against each cluster of the
+// kubecfg template using the supplied tester, before downloading a kubecfg.
+func SelfTest(t *selftest.Tester) Option {
+	return func(h *Handlers) error {
+		h.selfTest = t
+		return nil
+	}
+}
+
+// SelfTest tests the ID token in the body of a POST request against each
+// cluster of the kubecfg template. It reports whether each cluster was
+// reachable, whether it authenticated the ID token, and which identity it saw,
+// allowing users to find misconfigured username and groups claims before they
+// download a kubecfg.
+func (h *Handlers) SelfTest(w http.ResponseWriter, r *http.Request) {
+	cfg, idt, ok := h.selfTestRequest(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, &selfTestResponse{Clusters: h.selfTest.Test(cfg, idt)})
+}
+
+// Rules reviews the actions the ID token in the body of a POST request may
+// perform in each cluster of the kubecfg template, in each of the self-test
+// namespaces.
+func (h *Handlers) Rules(w http.ResponseWriter, r *http.Request) {
+	cfg, idt, ok := h.selfTestRequest(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, &rulesResponse{Clusters: h.selfTest.Rules(cfg, idt)})
+}
+
+// selfTestRequest returns the kubecfg template and the ID token to test. It
+// writes an error and returns false if the request cannot be served.
+func (h *Handlers) selfTestRequest(w http.ResponseWriter, r *http.Request) (*api.Config, string, bool) {
+	if h.selfTest == nil {
+		http.NotFound(w, r)
+		return nil, "", false
+	}
+	if h.template == nil {
+		http.Error(w, ErrNoTemplate.Error(), http.StatusNotImplemented)
+		return nil, "", false
+	}
+	idt := r.PostFormValue(urlParamIDToken)
+	if idt == "" {
+		http.Error(w, ErrMissingIDToken.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	p := &extractor.OIDCAuthenticationParams{IDToken: idt}
+	h.authenticate(r.Context(), p)
+	cfg, err := h.kubeCfgTemplate(p)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot get kubecfg template").Error(), http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return cfg, idt, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot marshal JSON").Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(j) // nolint: errcheck
+}
@@ -0,0 +1,91 @@
+package selftest
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// NamespaceRules are the actions a user may perform in a namespace.
+type NamespaceRules struct {
+	Namespace        string                            `json:"namespace"`
+	ResourceRules    []authorizationv1.ResourceRule    `json:"resourceRules,omitempty"`
+	NonResourceRules []authorizationv1.NonResourceRule `json:"nonResourceRules,omitempty"`
+
+	// Incomplete is true when the API server's authorizers could not list
+	// every rule, for example because they do not support rules reviews. The
+	// user may be able to perform actions that are not listed.
+	Incomplete      bool   `json:"incomplete,omitempty"`
+	EvaluationError string `json:"evaluationError,omitempty"`
+}
+
+// Rules reports the actions a user may perform in a cluster.
+type Rules struct {
+	Cluster    string           `json:"cluster"`
+	Server     string           `json:"server"`
+	Namespaces []NamespaceRules `json:"namespaces,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// Rules reviews the actions the supplied ID token may perform in each of the
+// Tester's namespaces, in each cluster of the supplied kubecfg, concurrently.
+// Results are ordered by cluster name.
+func (t *Tester) Rules(cfg *api.Config, idToken string) []Rules {
+	results := make([]Rules, 0, len(cfg.Clusters))
+	mx := &sync.Mutex{}
+	forEach(cfg, func(name string, c *api.Cluster) {
+		r := t.rules(name, c, idToken)
+		mx.Lock()
+		results = append(results, r)
+		mx.Unlock()
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Cluster < results[j].Cluster })
+	return results
+}
+
+func (t *Tester) rules(name string, c *api.Cluster, idToken string) Rules {
+	r := Rules{Cluster: name, Server: c.Server}
+	client, err := t.client(c, idToken)
+	if err != nil {
+		r.Error = errors.Wrap(err, "cannot create Kubernetes client").Error()
+		return r
+	}
+	for _, ns := range t.namespaces {
+		nr, err := selfSubjectRulesReview(client, ns)
+		switch {
+		case err == nil:
+			r.Namespaces = append(r.Namespaces, nr)
+		case apierrors.IsUnauthorized(err):
+			r.Namespaces, r.Error = nil, "API server did not authenticate the ID token"
+			return r
+		default:
+			r.Namespaces, r.Error = nil, errors.Wrapf(err, "cannot review rules in namespace %s", ns).Error()
+			return r
+		}
+	}
+	return r
+}
+
+// selfSubjectRulesReview returns the actions the user may perform in the
+// supplied namespace. Any authenticated user may create a
+// SelfSubjectRulesReview.
+func selfSubjectRulesReview(client kubernetes.Interface, namespace string) (NamespaceRules, error) {
+	rsp, err := client.AuthorizationV1().SelfSubjectRulesReviews().Create(&authorizationv1.SelfSubjectRulesReview{
+		Spec: authorizationv1.SelfSubjectRulesReviewSpec{Namespace: namespace},
+	})
+	if err != nil {
+		return NamespaceRules{}, err
+	}
+	return NamespaceRules{
+		Namespace:        namespace,
+		ResourceRules:    rsp.Status.ResourceRules,
+		NonResourceRules: rsp.Status.NonResourceRules,
+		Incomplete:       rsp.Status.Incomplete,
+		EvaluationError:  rsp.Status.EvaluationError,
+	}, nil
+}
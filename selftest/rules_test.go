@@ -0,0 +1,114 @@
+package selftest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// forbiddenNamespace is a namespace in which the fake API server forbids
+// rules reviews.
+const forbiddenNamespace = "forbidden"
+
+// incompleteNamespace is a namespace in which the fake API server cannot list
+// every rule.
+const incompleteNamespace = "kube-system"
+
+// rules returns the rules the fake API server reports for a namespace.
+func rules(namespace string) authorizationv1.SubjectRulesReviewStatus {
+	s := authorizationv1.SubjectRulesReviewStatus{
+		ResourceRules: []authorizationv1.ResourceRule{{
+			Verbs:     []string{"get", "list"},
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+		}},
+		NonResourceRules: []authorizationv1.NonResourceRule{{
+			Verbs:           []string{"get"},
+			NonResourceURLs: []string{"/version"},
+		}},
+	}
+	if namespace == incompleteNamespace {
+		s.Incomplete, s.EvaluationError = true, "webhook authorizer does not support rules reviews"
+	}
+	return s
+}
+
+func namespaceRules(namespace string) NamespaceRules {
+	s := rules(namespace)
+	return NamespaceRules{
+		Namespace:        namespace,
+		ResourceRules:    s.ResourceRules,
+		NonResourceRules: s.NonResourceRules,
+		Incomplete:       s.Incomplete,
+		EvaluationError:  s.EvaluationError,
+	}
+}
+
+func TestRules(t *testing.T) {
+	cases := []struct {
+		name       string
+		namespaces []string
+		token      string
+		want       []NamespaceRules
+		wantError  string
+	}{
+		{
+			name:  "DefaultNamespace",
+			token: validToken,
+			want:  []NamespaceRules{namespaceRules("default")},
+		},
+		{
+			name:       "Namespaces",
+			namespaces: []string{"default", incompleteNamespace},
+			token:      validToken,
+			want:       []NamespaceRules{namespaceRules("default"), namespaceRules(incompleteNamespace)},
+		},
+		{
+			name:       "Forbidden",
+			namespaces: []string{"default", forbiddenNamespace},
+			token:      validToken,
+			wantError:  "cannot review rules in namespace forbidden",
+		},
+		{
+			name:      "Unauthenticated",
+			token:     "invalid",
+			wantError: "did not authenticate",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := apiServer(true, "v1")
+			defer s.Close()
+
+			oo := []Option{}
+			if tt.namespaces != nil {
+				oo = append(oo, Namespaces(tt.namespaces...))
+			}
+			st, err := New(oo...)
+			if err != nil {
+				t.Fatalf("New(): %v", err)
+			}
+			got := st.Rules(&api.Config{Clusters: map[string]*api.Cluster{"test": cluster(s)}}, tt.token)
+			if len(got) != 1 {
+				t.Fatalf("st.Rules(...): want 1 result, got %d", len(got))
+			}
+			if !strings.Contains(got[0].Error, tt.wantError) || (tt.wantError == "" && got[0].Error != "") {
+				t.Errorf("st.Rules(...).Error: want %q, got %q", tt.wantError, got[0].Error)
+			}
+			want := Rules{Cluster: "test", Server: s.URL, Namespaces: tt.want, Error: got[0].Error}
+			if diff := deep.Equal(got[0], want); diff != nil {
+				t.Errorf("st.Rules(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestNamespacesRequired(t *testing.T) {
+	if _, err := New(Namespaces()); err == nil {
+		t.Error("New(Namespaces()): want error, got nil")
+	}
+}
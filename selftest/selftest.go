@@ -0,0 +1,226 @@
+// Package selftest checks whether an ID token authenticates to the clusters of
+// a kubecfg, which identity each cluster's API server sees, and what that
+// identity may do.
+package selftest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// DefaultTimeout is the default time allowed for each request to a cluster.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultNamespaces are the namespaces in which rules are reviewed by default.
+var DefaultNamespaces = []string{"default"}
+
+const groupAuthentication = "authentication.k8s.io"
+
+// selfSubjectReviewVersions are the API versions at which SelfSubjectReviews
+// may be served, most preferred first. They were introduced in Kubernetes
+// 1.26 and became generally available in 1.28.
+var selfSubjectReviewVersions = []string{"v1", "v1beta1", "v1alpha1"}
+
+// ErrNoSelfSubjectReview indicates an API server that does not serve
+// SelfSubjectReviews.
+var ErrNoSelfSubjectReview = errors.New("API server does not support SelfSubjectReviews")
+
+// UserInfo is the identity an API server sees.
+type UserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+// A Result reports whether a cluster was reachable and whether it
+// authenticated the ID token.
+type Result struct {
+	Cluster       string `json:"cluster"`
+	Server        string `json:"server"`
+	Reachable     bool   `json:"reachable"`
+	Version       string `json:"version,omitempty"`
+	Authenticated bool   `json:"authenticated"`
+
+	// User is the identity the API server sees. It is omitted if the user was
+	// not authenticated, or if the API server does not support
+	// SelfSubjectReviews.
+	User *UserInfo `json:"user,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// A Tester tests ID tokens against clusters.
+type Tester struct {
+	timeout    time.Duration
+	namespaces []string
+}
+
+// An Option represents a Tester option.
+type Option func(*Tester) error
+
+// Timeout sets the time allowed for each request to a cluster.
+func Timeout(t time.Duration) Option {
+	return func(s *Tester) error {
+		s.timeout = t
+		return nil
+	}
+}
+
+// Namespaces sets the namespaces in which rules are reviewed.
+func Namespaces(ns ...string) Option {
+	return func(s *Tester) error {
+		if len(ns) == 0 {
+			return errors.New("at least one namespace is required")
+		}
+		s.namespaces = ns
+		return nil
+	}
+}
+
+// New returns a new Tester.
+func New(oo ...Option) (*Tester, error) {
+	t := &Tester{timeout: DefaultTimeout, namespaces: DefaultNamespaces}
+	for _, o := range oo {
+		if err := o(t); err != nil {
+			return nil, errors.Wrap(err, "cannot apply self-test option")
+		}
+	}
+	return t, nil
+}
+
+// Test the supplied ID token against each cluster of the supplied kubecfg,
+// concurrently. Results are ordered by cluster name.
+func (t *Tester) Test(cfg *api.Config, idToken string) []Result {
+	results := make([]Result, 0, len(cfg.Clusters))
+	mx := &sync.Mutex{}
+	forEach(cfg, func(name string, c *api.Cluster) {
+		r := t.test(name, c, idToken)
+		mx.Lock()
+		results = append(results, r)
+		mx.Unlock()
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Cluster < results[j].Cluster })
+	return results
+}
+
+// forEach calls fn for each cluster of the supplied kubecfg concurrently,
+// returning once every call has returned.
+func forEach(cfg *api.Config, fn func(name string, c *api.Cluster)) {
+	wg := &sync.WaitGroup{}
+	for name, c := range cfg.Clusters {
+		wg.Add(1)
+		go func(name string, c *api.Cluster) {
+			defer wg.Done()
+			fn(name, c)
+		}(name, c)
+	}
+	wg.Wait()
+}
+
+// client returns a Kubernetes client that authenticates to the supplied
+// cluster using the supplied ID token.
+func (t *Tester) client(c *api.Cluster, idToken string) (kubernetes.Interface, error) {
+	return kubernetes.NewForConfig(&rest.Config{
+		Host:        c.Server,
+		BearerToken: idToken,
+		Timeout:     t.timeout,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAFile:   c.CertificateAuthority,
+			CAData:   c.CertificateAuthorityData,
+			Insecure: c.InsecureSkipTLSVerify,
+		},
+	})
+}
+
+func (t *Tester) test(name string, c *api.Cluster, idToken string) Result {
+	r := Result{Cluster: name, Server: c.Server}
+	client, err := t.client(c, idToken)
+	if err != nil {
+		r.Error = errors.Wrap(err, "cannot create Kubernetes client").Error()
+		return r
+	}
+
+	// Most API servers serve their version to anonymous users, but some
+	// reject anonymous requests entirely.
+	v, err := client.Discovery().ServerVersion()
+	switch {
+	case err == nil:
+		r.Version = v.GitVersion
+	case apierrors.IsUnauthorized(err), apierrors.IsForbidden(err):
+	default:
+		r.Error = errors.Wrap(err, "cannot reach API server").Error()
+		return r
+	}
+	r.Reachable = true
+
+	u, err := selfSubjectReview(client)
+	if err == ErrNoSelfSubjectReview {
+		r.Authenticated, err = selfSubjectAccessReview(client)
+	} else {
+		r.Authenticated, r.User = err == nil, u
+	}
+	switch {
+	case err == nil:
+	case apierrors.IsUnauthorized(err):
+		r.Authenticated, r.Error = false, "API server did not authenticate the ID token"
+	default:
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// selfSubjectReview returns the identity the API server sees. The API client
+// predates SelfSubjectReviews, so they are requested without it.
+func selfSubjectReview(client kubernetes.Interface) (*UserInfo, error) {
+	for _, v := range selfSubjectReviewVersions {
+		body := fmt.Sprintf(`{"apiVersion":"%s/%s","kind":"SelfSubjectReview"}`, groupAuthentication, v)
+		raw, err := client.Discovery().RESTClient().Post().
+			AbsPath("/apis", groupAuthentication, v, "selfsubjectreviews").
+			SetHeader("Content-Type", "application/json").
+			Body([]byte(body)).
+			Do().
+			Raw()
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ssr := &struct {
+			Status struct {
+				UserInfo UserInfo `json:"userInfo"`
+			} `json:"status"`
+		}{}
+		if err := json.Unmarshal(raw, ssr); err != nil {
+			return nil, errors.Wrap(err, "cannot decode SelfSubjectReview")
+		}
+		return &ssr.Status.UserInfo, nil
+	}
+	return nil, ErrNoSelfSubjectReview
+}
+
+// selfSubjectAccessReview determines whether the API server authenticated the
+// user by asking whether they may get its version. Any authenticated user may
+// create a SelfSubjectAccessReview.
+func selfSubjectAccessReview(client kubernetes.Interface) (bool, error) {
+	_, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			NonResourceAttributes: &authorizationv1.NonResourceAttributes{Path: "/version", Verb: "get"},
+		},
+	})
+	if apierrors.IsForbidden(err) {
+		return true, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,152 @@
+package selftest
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	validToken = "valid"
+	version    = "v1.28.0"
+)
+
+var user = UserInfo{Username: "alice@example.org", Groups: []string{"admins", "system:authenticated"}}
+
+// apiServer returns a fake API server that authenticates the valid token,
+// serving SelfSubjectReviews at the supplied API versions, and
+// SelfSubjectRulesReviews.
+func apiServer(anonymousVersion bool, ssr ...string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated := r.Header.Get("Authorization") == "Bearer "+validToken
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == "/version" && (authenticated || anonymousVersion) {
+			json.NewEncoder(w).Encode(map[string]string{"gitVersion": version}) // nolint: errcheck
+			return
+		}
+		if !authenticated {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Unauthorized", "code": 401}) // nolint: errcheck
+			return
+		}
+		for _, v := range ssr {
+			if r.URL.Path == "/apis/authentication.k8s.io/"+v+"/selfsubjectreviews" {
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]interface{}{"userInfo": user}}) // nolint: errcheck
+				return
+			}
+		}
+		if r.URL.Path == "/apis/authorization.k8s.io/v1/selfsubjectrulesreviews" {
+			review := &authorizationv1.SelfSubjectRulesReview{}
+			json.NewDecoder(r.Body).Decode(review) // nolint: errcheck
+			if review.Spec.Namespace == forbiddenNamespace {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Forbidden", "code": 403}) // nolint: errcheck
+				return
+			}
+			review.Status = rules(review.Spec.Namespace)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(review) // nolint: errcheck
+			return
+		}
+		if r.URL.Path == "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews" {
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]interface{}{"allowed": true}}) // nolint: errcheck
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}) // nolint: errcheck
+	}))
+}
+
+func cluster(s *httptest.Server) *api.Cluster {
+	return &api.Cluster{
+		Server:                   s.URL,
+		CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}),
+	}
+}
+
+func TestTest(t *testing.T) {
+	cases := []struct {
+		name      string
+		server    func() *httptest.Server
+		token     string
+		want      Result
+		wantError string
+	}{
+		{
+			name:   "SelfSubjectReview",
+			server: func() *httptest.Server { return apiServer(true, "v1") },
+			token:  validToken,
+			want:   Result{Reachable: true, Version: version, Authenticated: true, User: &user},
+		},
+		{
+			name:   "SelfSubjectReviewAlpha",
+			server: func() *httptest.Server { return apiServer(true, "v1alpha1") },
+			token:  validToken,
+			want:   Result{Reachable: true, Version: version, Authenticated: true, User: &user},
+		},
+		{
+			name:   "SelfSubjectAccessReview",
+			server: func() *httptest.Server { return apiServer(true) },
+			token:  validToken,
+			want:   Result{Reachable: true, Version: version, Authenticated: true},
+		},
+		{
+			name:      "Unauthenticated",
+			server:    func() *httptest.Server { return apiServer(true, "v1") },
+			token:     "invalid",
+			want:      Result{Reachable: true, Version: version},
+			wantError: "did not authenticate",
+		},
+		{
+			name:      "UnauthenticatedNoAnonymous",
+			server:    func() *httptest.Server { return apiServer(false, "v1") },
+			token:     "invalid",
+			want:      Result{Reachable: true},
+			wantError: "did not authenticate",
+		},
+		{
+			name: "Unreachable",
+			server: func() *httptest.Server {
+				s := apiServer(true, "v1")
+				s.Close()
+				return s
+			},
+			token:     validToken,
+			wantError: "cannot reach API server",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server()
+			defer s.Close()
+
+			st, err := New()
+			if err != nil {
+				t.Fatalf("New(): %v", err)
+			}
+			got := st.Test(&api.Config{Clusters: map[string]*api.Cluster{"test": cluster(s)}}, tt.token)
+			if len(got) != 1 {
+				t.Fatalf("st.Test(...): want 1 result, got %d", len(got))
+			}
+			if !strings.Contains(got[0].Error, tt.wantError) || (tt.wantError == "" && got[0].Error != "") {
+				t.Errorf("st.Test(...).Error: want %q, got %q", tt.wantError, got[0].Error)
+			}
+			want := tt.want
+			want.Cluster, want.Server, want.Error = "test", s.URL, got[0].Error
+			if diff := deep.Equal(got[0], want); diff != nil {
+				t.Errorf("st.Test(...): got != want: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package template
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	// DefaultClusterAPISelector selects the kubeconfig Secrets written by
+	// Cluster API.
+	DefaultClusterAPISelector = labelClusterAPIClusterName
+
+	labelClusterAPIClusterName = "cluster.x-k8s.io/cluster-name"
+
+	// Cluster API writes all of its Secrets, including CA, etcd, and service
+	// account keys, with this type. Only its kubeconfig Secrets are of use.
+	clusterAPISecretType = "cluster.x-k8s.io/secret"
+
+	clusterAPIKubeconfigSuffix = "-kubeconfig"
+	clusterAPIKubeconfigKey    = "value"
+)
+
+var (
+	// ErrNotClusterAPIKubeconfig indicates a Secret that is not a Cluster API
+	// kubeconfig Secret.
+	ErrNotClusterAPIKubeconfig = errors.New("not a Cluster API kubeconfig Secret")
+
+	// ErrNoCluster indicates a kubeconfig from which a cluster could not be
+	// determined.
+	ErrNoCluster = errors.New("cannot determine cluster from kubeconfig")
+)
+
+// ClusterAPI is a Source that builds a kubecfg template from the
+// <cluster>-kubeconfig Secrets Cluster API writes for each cluster it
+// provisions. Only the server URL and CA data are read from each kubeconfig;
+// its credentials are ignored.
+type ClusterAPI struct {
+	log     *zap.Logger
+	exclude labels.Selector
+	factory informers.SharedInformerFactory
+	secrets listers.SecretLister
+	synced  cache.InformerSynced
+}
+
+// NewClusterAPI returns a Source that watches Cluster API Secrets matching
+// DefaultClusterAPISelector, unless configured otherwise. Start must be called
+// before the Source is used.
+func NewClusterAPI(c kubernetes.Interface, oo ...WatchOption) (*ClusterAPI, error) {
+	wo, err := newWatchOptions(DefaultClusterAPISelector, oo...)
+	if err != nil {
+		return nil, err
+	}
+	wo.field = fields.OneTermEqualSelector("type", clusterAPISecretType).String()
+
+	f := wo.factory(c)
+	s := f.Core().V1().Secrets()
+
+	return &ClusterAPI{
+		log:     wo.log,
+		exclude: wo.exclude,
+		factory: f,
+		secrets: s.Lister(),
+		synced:  s.Informer().HasSynced,
+	}, nil
+}
+
+// Start watching Secrets. Blocks until the initial set of Secrets has been
+// listed, or the supplied channel is closed.
+func (c *ClusterAPI) Start(stop <-chan struct{}) error {
+	c.factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, c.synced) {
+		return ErrCacheSync
+	}
+	return nil
+}
+
+// Get a kubecfg template containing the clusters described by all watched
+// kubeconfig Secrets. Each cluster is named for its Cluster API cluster.
+// Secrets that do not contain a valid kubeconfig are logged and skipped.
+func (c *ClusterAPI) Get() (*api.Config, error) {
+	ss, err := c.secrets.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list Secrets")
+	}
+
+	objs := make([]object, 0, len(ss))
+	for _, s := range ss {
+		o := object{kind: "Secret", meta: s.ObjectMeta, data: s.Data}
+		// Cluster API writes several Secrets per cluster. We expect to skip
+		// all but its kubeconfig.
+		if !strings.HasSuffix(s.GetName(), clusterAPIKubeconfigSuffix) {
+			c.log.Debug("skipping non-kubeconfig Secret", o.fields()...)
+			continue
+		}
+		objs = append(objs, o)
+	}
+	return build(c.log, c.exclude, objs, clusterFromKubeconfigSecret), nil
+}
+
+func clusterFromKubeconfigSecret(o object) (string, *api.Cluster, error) {
+	name := o.meta.Labels[labelClusterAPIClusterName]
+	if name == "" || o.meta.Name != name+clusterAPIKubeconfigSuffix {
+		return "", nil, ErrNotClusterAPIKubeconfig
+	}
+
+	kc, err := clientcmd.Load(o.data[clusterAPIKubeconfigKey])
+	if err != nil {
+		return "", nil, errors.Wrap(err, "cannot parse kubeconfig")
+	}
+
+	var src *api.Cluster
+	if ctx, ok := kc.Contexts[kc.CurrentContext]; ok {
+		src = kc.Clusters[ctx.Cluster]
+	}
+	if src == nil && len(kc.Clusters) == 1 {
+		for _, cl := range kc.Clusters {
+			src = cl
+		}
+	}
+	if src == nil {
+		return "", nil, ErrNoCluster
+	}
+	if src.Server == "" {
+		return "", nil, ErrMissingServer
+	}
+
+	cl := api.NewCluster()
+	cl.Server = src.Server
+	cl.CertificateAuthorityData = src.CertificateAuthorityData
+	return name, cl, nil
+}
@@ -0,0 +1,134 @@
+package template
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	"go.uber.org/zap"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func kubeconfigSecret(t *testing.T, namespace, cluster, name string, labels map[string]string, kc *api.Config) *v1.Secret {
+	y, err := clientcmd.Write(*kc)
+	if err != nil {
+		t.Fatalf("clientcmd.Write(...): %v", err)
+	}
+	l := map[string]string{labelClusterAPIClusterName: cluster}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: l},
+		Type:       clusterAPISecretType,
+		Data:       map[string][]byte{clusterAPIKubeconfigKey: y},
+	}
+}
+
+func TestClusterAPI(t *testing.T) {
+	admin := &api.Config{
+		CurrentContext: "prod-admin@prod",
+		Clusters: map[string]*api.Cluster{
+			"prod":  &api.Cluster{Server: "https://prod.example.org", CertificateAuthorityData: []byte("PEM")},
+			"other": &api.Cluster{Server: "https://other.example.org"},
+		},
+		Contexts: map[string]*api.Context{
+			"prod-admin@prod": &api.Context{Cluster: "prod", AuthInfo: "prod-admin"},
+		},
+		AuthInfos: map[string]*api.AuthInfo{
+			"prod-admin": &api.AuthInfo{ClientCertificateData: []byte("CERT"), ClientKeyData: []byte("KEY")},
+		},
+	}
+	single := &api.Config{
+		Clusters: map[string]*api.Cluster{
+			"dev": &api.Cluster{Server: "https://dev.example.org"},
+		},
+	}
+	empty := &api.Config{}
+
+	cases := []struct {
+		name string
+		objs func(t *testing.T) []runtime.Object
+		oo   []WatchOption
+		want map[string]*api.Cluster
+	}{
+		{
+			name: "KubeconfigSecrets",
+			objs: func(t *testing.T) []runtime.Object {
+				return []runtime.Object{
+					kubeconfigSecret(t, "a", "prod", "prod-kubeconfig", nil, admin),
+					kubeconfigSecret(t, "a", "dev", "dev-kubeconfig", nil, single),
+					kubeconfigSecret(t, "a", "prod", "prod-user-kubeconfig", nil, single),
+					kubeconfigSecret(t, "a", "broken", "broken-kubeconfig", nil, empty),
+					&v1.Secret{
+						ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "prod-ca", Labels: map[string]string{labelClusterAPIClusterName: "prod"}},
+						Type:       clusterAPISecretType,
+						Data:       map[string][]byte{"tls.key": []byte("KEY")},
+					},
+				}
+			},
+			want: map[string]*api.Cluster{
+				"prod": &api.Cluster{Server: "https://prod.example.org", CertificateAuthorityData: []byte("PEM")},
+				"dev":  &api.Cluster{Server: "https://dev.example.org"},
+			},
+		},
+		{
+			name: "IncludeAndExclude",
+			objs: func(t *testing.T) []runtime.Object {
+				return []runtime.Object{
+					kubeconfigSecret(t, "a", "prod", "prod-kubeconfig", map[string]string{"team": "a"}, admin),
+					kubeconfigSecret(t, "a", "dev", "dev-kubeconfig", map[string]string{"team": "a", "env": "dev"}, single),
+					kubeconfigSecret(t, "b", "other", "other-kubeconfig", map[string]string{"team": "b"}, single),
+				}
+			},
+			oo: []WatchOption{Selector("team=a"), Exclude("env=dev")},
+			want: map[string]*api.Cluster{
+				"prod": &api.Cluster{Server: "https://prod.example.org", CertificateAuthorityData: []byte("PEM")},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset(tt.objs(t)...)
+			c, err := NewClusterAPI(cs, append(tt.oo, Logger(zap.NewNop()))...)
+			if err != nil {
+				t.Fatalf("NewClusterAPI(...): %v", err)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			if err := c.Start(stop); err != nil {
+				t.Fatalf("c.Start(...): %v", err)
+			}
+
+			got, err := c.Get()
+			if err != nil {
+				t.Fatalf("c.Get(): %v", err)
+			}
+			for _, cl := range got.Clusters {
+				cl.Extensions = nil
+			}
+			if diff := deep.Equal(got.Clusters, tt.want); diff != nil {
+				t.Errorf("c.Get(): got != want: %v", diff)
+			}
+
+			// The fake clientset ignores field selectors, so we check that we
+			// asked for only Cluster API Secrets.
+			for _, a := range cs.Actions() {
+				l, ok := a.(clienttesting.ListAction)
+				if !ok {
+					continue
+				}
+				if diff := deep.Equal(l.GetListRestrictions().Fields.String(), "type="+clusterAPISecretType); diff != nil {
+					t.Errorf("cs.List(...): field selector: got != want: %v", diff)
+				}
+			}
+		})
+	}
+}
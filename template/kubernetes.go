@@ -0,0 +1,281 @@
+package template
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	// DefaultSelector selects the ConfigMaps and Secrets that describe
+	// clusters.
+	DefaultSelector = "kuberos/cluster"
+
+	// DefaultResyncPeriod is the default period at which watched objects are
+	// resynced.
+	DefaultResyncPeriod = 10 * time.Minute
+
+	keyName                  = "name"
+	keyServer                = "server"
+	keyCertificateAuthority  = "certificate-authority-data"
+	keyInsecureSkipTLSVerify = "insecure-skip-tls-verify"
+)
+
+var (
+	// ErrCacheSync indicates watched objects could not be synced.
+	ErrCacheSync = errors.New("cannot sync watched objects")
+
+	// ErrMissingServer indicates an object that does not specify a server.
+	ErrMissingServer = errors.New("missing server")
+)
+
+type watchOptions struct {
+	log       *zap.Logger
+	namespace string
+	selector  string
+	field     string
+	exclude   labels.Selector
+	resync    time.Duration
+}
+
+// A WatchOption represents an option for a Source that watches Kubernetes
+// objects.
+type WatchOption func(*watchOptions) error
+
+// Logger allows the use of a bespoke Zap logger.
+func Logger(l *zap.Logger) WatchOption {
+	return func(o *watchOptions) error {
+		o.log = l
+		return nil
+	}
+}
+
+// Namespace restricts watched objects to the supplied namespace. Objects in
+// all namespaces are watched by default.
+func Namespace(ns string) WatchOption {
+	return func(o *watchOptions) error {
+		o.namespace = ns
+		return nil
+	}
+}
+
+// Selector watches only the objects matching the supplied label selector.
+func Selector(s string) WatchOption {
+	return func(o *watchOptions) error {
+		if _, err := labels.Parse(s); err != nil {
+			return errors.Wrapf(err, "cannot parse label selector %q", s)
+		}
+		o.selector = s
+		return nil
+	}
+}
+
+// Exclude ignores watched objects matching the supplied label selector.
+func Exclude(s string) WatchOption {
+	return func(o *watchOptions) error {
+		sel, err := labels.Parse(s)
+		if err != nil {
+			return errors.Wrapf(err, "cannot parse label selector %q", s)
+		}
+		o.exclude = sel
+		return nil
+	}
+}
+
+// ResyncPeriod sets the period at which watched objects are resynced.
+func ResyncPeriod(d time.Duration) WatchOption {
+	return func(o *watchOptions) error {
+		o.resync = d
+		return nil
+	}
+}
+
+func newWatchOptions(selector string, oo ...WatchOption) (*watchOptions, error) {
+	l, err := zap.NewProduction()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default logger")
+	}
+
+	wo := &watchOptions{
+		log:       l,
+		namespace: metav1.NamespaceAll,
+		selector:  selector,
+		exclude:   labels.Nothing(),
+		resync:    DefaultResyncPeriod,
+	}
+	for _, o := range oo {
+		if err := o(wo); err != nil {
+			return nil, errors.Wrap(err, "cannot apply watch option")
+		}
+	}
+	return wo, nil
+}
+
+func (o *watchOptions) factory(c kubernetes.Interface) informers.SharedInformerFactory {
+	return informers.NewFilteredSharedInformerFactory(c, o.resync, o.namespace, func(lo *metav1.ListOptions) {
+		lo.LabelSelector = o.selector
+		lo.FieldSelector = o.field
+	})
+}
+
+// Kubernetes is a Source that builds a kubecfg template from ConfigMaps and
+// Secrets. Each object describes one cluster using the following keys:
+//
+//	server: https://prod.example.org  # Required.
+//	certificate-authority-data: PEM   # Optional. Not base64 encoded.
+//	insecure-skip-tls-verify: "true"  # Optional.
+//	name: production                  # Optional. Defaults to the object name.
+type Kubernetes struct {
+	log        *zap.Logger
+	exclude    labels.Selector
+	factory    informers.SharedInformerFactory
+	configMaps listers.ConfigMapLister
+	secrets    listers.SecretLister
+	synced     []cache.InformerSynced
+}
+
+// NewKubernetes returns a Source that watches ConfigMaps and Secrets matching
+// DefaultSelector, unless configured otherwise. Start must be called before
+// the Source is used.
+func NewKubernetes(c kubernetes.Interface, oo ...WatchOption) (*Kubernetes, error) {
+	wo, err := newWatchOptions(DefaultSelector, oo...)
+	if err != nil {
+		return nil, err
+	}
+
+	f := wo.factory(c)
+	cm := f.Core().V1().ConfigMaps()
+	s := f.Core().V1().Secrets()
+
+	return &Kubernetes{
+		log:        wo.log,
+		exclude:    wo.exclude,
+		factory:    f,
+		configMaps: cm.Lister(),
+		secrets:    s.Lister(),
+		synced:     []cache.InformerSynced{cm.Informer().HasSynced, s.Informer().HasSynced},
+	}, nil
+}
+
+// Start watching ConfigMaps and Secrets. Blocks until the initial set of
+// objects has been listed, or the supplied channel is closed.
+func (k *Kubernetes) Start(stop <-chan struct{}) error {
+	k.factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, k.synced...) {
+		return ErrCacheSync
+	}
+	return nil
+}
+
+// Get a kubecfg template containing the clusters described by all watched
+// ConfigMaps and Secrets. Objects that do not describe a valid cluster are
+// logged and skipped.
+func (k *Kubernetes) Get() (*api.Config, error) {
+	cms, err := k.configMaps.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list ConfigMaps")
+	}
+	ss, err := k.secrets.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list Secrets")
+	}
+
+	objs := make([]object, 0, len(cms)+len(ss))
+	for _, cm := range cms {
+		data := make(map[string][]byte, len(cm.Data))
+		for key, value := range cm.Data {
+			data[key] = []byte(value)
+		}
+		objs = append(objs, object{kind: "ConfigMap", meta: cm.ObjectMeta, data: data})
+	}
+	for _, s := range ss {
+		objs = append(objs, object{kind: "Secret", meta: s.ObjectMeta, data: s.Data})
+	}
+	return build(k.log, k.exclude, objs, func(o object) (string, *api.Cluster, error) {
+		return clusterFromData(o.meta.Name, o.data)
+	}), nil
+}
+
+// build a kubecfg template from the supplied objects, using fn to derive a
+// cluster from each object. Objects matching the exclude selector are ignored.
+func build(log *zap.Logger, exclude labels.Selector, objs []object, fn func(object) (string, *api.Cluster, error)) *api.Config {
+	sortObjects(objs)
+
+	c := api.NewConfig()
+	for _, o := range objs {
+		if exclude.Matches(labels.Set(o.meta.Labels)) {
+			continue
+		}
+		name, cluster, err := fn(o)
+		if err != nil {
+			log.Info("skipping invalid cluster", o.fields(zap.Error(err))...)
+			continue
+		}
+		if _, ok := c.Clusters[name]; ok {
+			log.Info("skipping duplicate cluster", o.fields(zap.String("cluster", name))...)
+			continue
+		}
+		c.Clusters[name] = cluster
+	}
+	return c
+}
+
+type object struct {
+	kind string
+	meta metav1.ObjectMeta
+	data map[string][]byte
+}
+
+func (o object) fields(f ...zap.Field) []zap.Field {
+	return append([]zap.Field{
+		zap.String("kind", o.kind),
+		zap.String("namespace", o.meta.Namespace),
+		zap.String("name", o.meta.Name),
+	}, f...)
+}
+
+// sortObjects sorts objects by kind, namespace, and name such that duplicate
+// clusters are resolved deterministically.
+func sortObjects(objs []object) {
+	sort.Slice(objs, func(i, j int) bool {
+		if objs[i].kind != objs[j].kind {
+			return objs[i].kind < objs[j].kind
+		}
+		if objs[i].meta.Namespace != objs[j].meta.Namespace {
+			return objs[i].meta.Namespace < objs[j].meta.Namespace
+		}
+		return objs[i].meta.Name < objs[j].meta.Name
+	})
+}
+
+func clusterFromData(name string, data map[string][]byte) (string, *api.Cluster, error) {
+	if n := string(data[keyName]); n != "" {
+		name = n
+	}
+	server := string(data[keyServer])
+	if server == "" {
+		return "", nil, ErrMissingServer
+	}
+
+	c := api.NewCluster()
+	c.Server = server
+	c.CertificateAuthorityData = data[keyCertificateAuthority]
+	if v, ok := data[keyInsecureSkipTLSVerify]; ok {
+		skip, err := strconv.ParseBool(string(v))
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "cannot parse %s", keyInsecureSkipTLSVerify)
+		}
+		c.InsecureSkipTLSVerify = skip
+	}
+	return name, c, nil
+}
@@ -0,0 +1,148 @@
+package template
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	"go.uber.org/zap"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestKubernetes(t *testing.T) {
+	cases := []struct {
+		name string
+		objs []runtime.Object
+		oo   []WatchOption
+		want map[string]*api.Cluster
+	}{
+		{
+			name: "ConfigMapsAndSecrets",
+			objs: []runtime.Object{
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "prod", Labels: map[string]string{DefaultSelector: ""}},
+					Data:       map[string]string{keyServer: "https://prod.example.org", keyCertificateAuthority: "PEM"},
+				},
+				&v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "staging", Labels: map[string]string{DefaultSelector: ""}},
+					Data: map[string][]byte{
+						keyName:                  []byte("stage"),
+						keyServer:                []byte("https://staging.example.org"),
+						keyInsecureSkipTLSVerify: []byte("true"),
+					},
+				},
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "unlabelled"},
+					Data:       map[string]string{keyServer: "https://unlabelled.example.org"},
+				},
+			},
+			want: map[string]*api.Cluster{
+				"prod":  &api.Cluster{Server: "https://prod.example.org", CertificateAuthorityData: []byte("PEM")},
+				"stage": &api.Cluster{Server: "https://staging.example.org", InsecureSkipTLSVerify: true},
+			},
+		},
+		{
+			name: "InvalidAndDuplicate",
+			objs: []runtime.Object{
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "noserver", Labels: map[string]string{DefaultSelector: ""}},
+					Data:       map[string]string{keyCertificateAuthority: "PEM"},
+				},
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "prod", Labels: map[string]string{DefaultSelector: ""}},
+					Data:       map[string]string{keyServer: "https://a.example.org"},
+				},
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "prod", Labels: map[string]string{DefaultSelector: ""}},
+					Data:       map[string]string{keyServer: "https://b.example.org"},
+				},
+			},
+			want: map[string]*api.Cluster{
+				"prod": &api.Cluster{Server: "https://a.example.org"},
+			},
+		},
+		{
+			name: "NamespaceAndExclude",
+			objs: []runtime.Object{
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "prod", Labels: map[string]string{DefaultSelector: ""}},
+					Data:       map[string]string{keyServer: "https://prod.example.org"},
+				},
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "dev", Labels: map[string]string{DefaultSelector: "", "env": "dev"}},
+					Data:       map[string]string{keyServer: "https://dev.example.org"},
+				},
+				&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "other", Labels: map[string]string{DefaultSelector: ""}},
+					Data:       map[string]string{keyServer: "https://other.example.org"},
+				},
+			},
+			oo: []WatchOption{Namespace("a"), Exclude("env=dev")},
+			want: map[string]*api.Cluster{
+				"prod": &api.Cluster{Server: "https://prod.example.org"},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKubernetes(fake.NewSimpleClientset(tt.objs...), append(tt.oo, Logger(zap.NewNop()))...)
+			if err != nil {
+				t.Fatalf("NewKubernetes(...): %v", err)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			if err := k.Start(stop); err != nil {
+				t.Fatalf("k.Start(...): %v", err)
+			}
+
+			got, err := k.Get()
+			if err != nil {
+				t.Fatalf("k.Get(): %v", err)
+			}
+			for _, c := range got.Clusters {
+				c.LocationOfOrigin = ""
+				c.Extensions = nil
+			}
+			if diff := deep.Equal(got.Clusters, tt.want); diff != nil {
+				t.Errorf("k.Get(): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := Static(&api.Config{
+		Clusters: map[string]*api.Cluster{
+			"a": &api.Cluster{Server: "https://a.example.org"},
+			"b": &api.Cluster{Server: "https://b.example.org"},
+		},
+	})
+	b := Static(&api.Config{
+		CurrentContext: "b",
+		Clusters: map[string]*api.Cluster{
+			"b": &api.Cluster{Server: "https://b.example.net"},
+			"c": &api.Cluster{Server: "https://c.example.net"},
+		},
+	})
+
+	got, err := Merge(a, b).Get()
+	if err != nil {
+		t.Fatalf("Merge(...).Get(): %v", err)
+	}
+	want := map[string]*api.Cluster{
+		"a": &api.Cluster{Server: "https://a.example.org"},
+		"b": &api.Cluster{Server: "https://b.example.org"},
+		"c": &api.Cluster{Server: "https://c.example.net"},
+	}
+	if diff := deep.Equal(got.Clusters, want); diff != nil {
+		t.Errorf("Merge(...).Get(): got != want: %v", diff)
+	}
+	if got.CurrentContext != "b" {
+		t.Errorf("Merge(...).Get().CurrentContext: want %v, got %v", "b", got.CurrentContext)
+	}
+}
@@ -0,0 +1,68 @@
+// Package template provides sources of the kubecfg template Kuberos uses to
+// generate a kubecfg for each authenticated user.
+package template
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// A Source provides a kubecfg template containing the clusters to which a
+// user and contexts should be added. Callers must not modify the returned
+// config.
+type Source interface {
+	Get() (*api.Config, error)
+}
+
+type static struct {
+	cfg *api.Config
+}
+
+// Static returns a Source that always returns the supplied template.
+func Static(cfg *api.Config) Source {
+	return &static{cfg: cfg}
+}
+
+func (s *static) Get() (*api.Config, error) {
+	return s.cfg, nil
+}
+
+// File returns a Source that always returns the kubecfg template loaded from
+// the supplied file.
+func File(filename string) (Source, error) {
+	cfg, err := clientcmd.LoadFromFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load kubecfg template %s", filename)
+	}
+	return Static(cfg), nil
+}
+
+type merged []Source
+
+// Merge returns a Source that combines the clusters of the supplied sources.
+// When several sources contain a cluster of the same name the first source
+// wins. The current context is that of the first source to specify one.
+func Merge(ss ...Source) Source {
+	return merged(ss)
+}
+
+func (m merged) Get() (*api.Config, error) {
+	c := api.NewConfig()
+	for _, s := range m {
+		cfg, err := s.Get()
+		if err != nil {
+			return nil, err
+		}
+		for name, cluster := range cfg.Clusters {
+			if _, ok := c.Clusters[name]; ok {
+				continue
+			}
+			c.Clusters[name] = cluster
+		}
+		if c.CurrentContext == "" {
+			c.CurrentContext = cfg.CurrentContext
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,276 @@
+// Package tlsconfig configures Kuberos to serve HTTPS.
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// DefaultReloadInterval is the default interval at which a Reloader checks
+// its certificate and key files for changes.
+const DefaultReloadInterval = 10 * time.Second
+
+// DefaultMinVersion is the default minimum TLS version.
+const DefaultMinVersion = "1.2"
+
+const portHTTPS = "443"
+
+var (
+	// ErrNoCertificate indicates a request to a Reloader that has no
+	// certificate loaded.
+	ErrNoCertificate = errors.New("no certificate loaded")
+
+	// ErrClientCertificateRequired indicates a request that did not present a
+	// verified client certificate.
+	ErrClientCertificateRequired = errors.New("a verified client certificate is required")
+
+	appFs = afero.NewOsFs()
+
+	versions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	cipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+)
+
+// ParseVersion parses a TLS version (e.g. 1.2).
+func ParseVersion(v string) (uint16, error) {
+	if id, ok := versions[v]; ok {
+		return id, nil
+	}
+	return 0, errors.Errorf("unsupported TLS version %q", v)
+}
+
+// ParseCipherSuites parses cipher suites named per the IANA registry (e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := cipherSuites[n]
+		if !ok {
+			return nil, errors.Errorf("unsupported cipher suite %q (supported: %s)", n, strings.Join(supportedCipherSuites(), ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func supportedCipherSuites() []string {
+	names := make([]string, 0, len(cipherSuites))
+	for n := range cipherSuites {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ClientCAs loads a pool of CA certificates used to verify client
+// certificates from the supplied PEM encoded file.
+func ClientCAs(filename string) (*x509.CertPool, error) {
+	b, err := afero.ReadFile(appFs, filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read client CA file %s", filename)
+	}
+	p := x509.NewCertPool()
+	if !p.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no PEM encoded certificates found in %s", filename)
+	}
+	return p, nil
+}
+
+// A Reloader serves a TLS certificate and key loaded from files, reloading
+// them when they change.
+type Reloader struct {
+	log      *zap.Logger
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mx   sync.RWMutex
+	cert *tls.Certificate
+	raw  []byte
+}
+
+// A ReloadOption represents a Reloader option.
+type ReloadOption func(*Reloader) error
+
+// Logger allows the use of a bespoke Zap logger.
+func Logger(l *zap.Logger) ReloadOption {
+	return func(r *Reloader) error {
+		r.log = l
+		return nil
+	}
+}
+
+// ReloadInterval sets the interval at which the certificate and key files are
+// checked for changes.
+func ReloadInterval(i time.Duration) ReloadOption {
+	return func(r *Reloader) error {
+		r.interval = i
+		return nil
+	}
+}
+
+// NewReloader returns a Reloader that serves the certificate and key loaded
+// from the supplied PEM encoded files. They must be valid when the Reloader
+// is created.
+func NewReloader(certFile, keyFile string, oo ...ReloadOption) (*Reloader, error) {
+	l, err := zap.NewProduction()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default logger")
+	}
+
+	r := &Reloader{log: l, certFile: certFile, keyFile: keyFile, interval: DefaultReloadInterval}
+	for _, o := range oo {
+		if err := o(r); err != nil {
+			return nil, errors.Wrap(err, "cannot apply reloader option")
+		}
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate and key if either has changed since they were
+// last loaded. It returns true if a new certificate was loaded.
+func (r *Reloader) reload() (bool, error) {
+	c, err := afero.ReadFile(appFs, r.certFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot read certificate file %s", r.certFile)
+	}
+	k, err := afero.ReadFile(appFs, r.keyFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot read key file %s", r.keyFile)
+	}
+	raw := append(append([]byte{}, c...), k...)
+
+	r.mx.RLock()
+	unchanged := bytes.Equal(raw, r.raw)
+	r.mx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(c, k)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot parse certificate and key")
+	}
+
+	r.mx.Lock()
+	r.cert, r.raw = &cert, raw
+	r.mx.Unlock()
+	return true, nil
+}
+
+// Start checks the certificate and key files for changes until the supplied
+// channel is closed. Invalid files are logged and ignored; the last valid
+// certificate continues to be served.
+func (r *Reloader) Start(stop <-chan struct{}) {
+	t := time.NewTicker(r.interval)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				reloaded, err := r.reload()
+				if err != nil {
+					r.log.Error("cannot reload TLS certificate", zap.Error(err))
+					continue
+				}
+				if reloaded {
+					r.log.Info("reloaded TLS certificate", zap.String("cert", r.certFile))
+				}
+			}
+		}
+	}()
+}
+
+// GetCertificate returns the most recently loaded valid certificate. It is
+// suitable for use as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	if r.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return r.cert, nil
+}
+
+// Config returns a server TLS config that serves the supplied Reloader's
+// certificate. Client certificates are verified using the supplied pool if
+// presented, but are not required; use RequireClientCertificate to require
+// them for specific handlers.
+func Config(r *Reloader, minVersion uint16, ciphers []uint16, clientCAs *x509.CertPool) *tls.Config {
+	c := &tls.Config{
+		GetCertificate:           r.GetCertificate,
+		MinVersion:               minVersion,
+		CipherSuites:             ciphers,
+		PreferServerCipherSuites: len(ciphers) > 0,
+	}
+	if clientCAs != nil {
+		c.ClientCAs = clientCAs
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c
+}
+
+// RequireClientCertificate returns a handler that responds 403 Forbidden to
+// any request that did not present a verified client certificate.
+func RequireClientCertificate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, ErrClientCertificateRequired.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Redirect returns a handler that permanently redirects all requests to HTTPS
+// on the supplied port.
+func Redirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != portHTTPS {
+			host = net.JoinHostPort(host, port)
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
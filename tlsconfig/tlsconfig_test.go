@@ -0,0 +1,218 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+)
+
+const (
+	certFile = "/tls/tls.crt"
+	keyFile  = "/tls/tls.key"
+)
+
+func newKeyPair(t *testing.T, serial int64) (cert, key []byte) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "kuberos.example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey(...): %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+}
+
+func writeKeyPair(t *testing.T, cert, key []byte) {
+	if err := afero.WriteFile(appFs, certFile, cert, 0600); err != nil {
+		t.Fatalf("afero.WriteFile(%s): %v", certFile, err)
+	}
+	if err := afero.WriteFile(appFs, keyFile, key, 0600); err != nil {
+		t.Fatalf("afero.WriteFile(%s): %v", keyFile, err)
+	}
+}
+
+func serial(t *testing.T, r *Reloader) int64 {
+	c, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("r.GetCertificate(...): %v", err)
+	}
+	x, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(...): %v", err)
+	}
+	return x.SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Fatalf("NewReloader(...): want error when files do not exist")
+	}
+
+	c, k := newKeyPair(t, 1)
+	writeKeyPair(t, c, k)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader(...): %v", err)
+	}
+	if diff := deep.Equal(serial(t, r), int64(1)); diff != nil {
+		t.Errorf("initial certificate: got != want: %v", diff)
+	}
+
+	reloaded, err := r.reload()
+	if err != nil {
+		t.Fatalf("r.reload(): %v", err)
+	}
+	if reloaded {
+		t.Errorf("r.reload(): reloaded unchanged files")
+	}
+
+	c, k = newKeyPair(t, 2)
+	writeKeyPair(t, c, k)
+	if _, err := r.reload(); err != nil {
+		t.Fatalf("r.reload(): %v", err)
+	}
+	if diff := deep.Equal(serial(t, r), int64(2)); diff != nil {
+		t.Errorf("reloaded certificate: got != want: %v", diff)
+	}
+
+	// A certificate that does not match its key should not replace the last
+	// valid certificate.
+	c, _ = newKeyPair(t, 3)
+	_, k = newKeyPair(t, 4)
+	writeKeyPair(t, c, k)
+	if _, err := r.reload(); err == nil {
+		t.Errorf("r.reload(): want error for mismatched certificate and key")
+	}
+	if diff := deep.Equal(serial(t, r), int64(2)); diff != nil {
+		t.Errorf("certificate after invalid reload: got != want: %v", diff)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	got, err := ParseVersion("1.3")
+	if err != nil {
+		t.Fatalf("ParseVersion(...): %v", err)
+	}
+	if diff := deep.Equal(got, uint16(tls.VersionTLS13)); diff != nil {
+		t.Errorf("ParseVersion(...): got != want: %v", diff)
+	}
+	if _, err := ParseVersion("1.4"); err == nil {
+		t.Errorf("ParseVersion(...): want error for unknown version")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	got, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"})
+	if err != nil {
+		t.Fatalf("ParseCipherSuites(...): %v", err)
+	}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("ParseCipherSuites(...): got != want: %v", diff)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_NULL"}); err == nil {
+		t.Errorf("ParseCipherSuites(...): want error for unknown cipher suite")
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	cases := []struct {
+		name string
+		tls  *tls.ConnectionState
+		want int
+	}{
+		{
+			name: "PlainHTTP",
+			want: http.StatusForbidden,
+		},
+		{
+			name: "NoClientCertificate",
+			tls:  &tls.ConnectionState{},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "VerifiedClientCertificate",
+			tls:  &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}},
+			want: http.StatusOK,
+		},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			RequireClientCertificate(ok).ServeHTTP(w, r)
+			if diff := deep.Equal(w.Code, tt.want); diff != nil {
+				t.Errorf("w.Code: got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	cases := []struct {
+		name string
+		port string
+		url  string
+		want string
+	}{
+		{
+			name: "DefaultPort",
+			port: "443",
+			url:  "http://kuberos.example.org/kubecfg?code=a&state=b",
+			want: "https://kuberos.example.org/kubecfg?code=a&state=b",
+		},
+		{
+			name: "StripsHTTPPort",
+			port: "443",
+			url:  "http://kuberos.example.org:8080/ui",
+			want: "https://kuberos.example.org/ui",
+		},
+		{
+			name: "CustomPort",
+			port: "10443",
+			url:  "http://kuberos.example.org:10003/ui",
+			want: "https://kuberos.example.org:10443/ui",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Redirect(tt.port).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			if diff := deep.Equal(w.Code, http.StatusPermanentRedirect); diff != nil {
+				t.Errorf("w.Code: got != want: %v", diff)
+			}
+			if diff := deep.Equal(w.Header().Get("Location"), tt.want); diff != nil {
+				t.Errorf("Location: got != want: %v", diff)
+			}
+		})
+	}
+}
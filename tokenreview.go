@@ -0,0 +1,114 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	authenticationv1 "k8s.io/api/authentication/v1"
+
+	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/metrics"
+)
+
+const (
+	tokenReviewAPIVersion = "authentication.k8s.io/v1"
+	tokenReviewKind       = "TokenReview"
+
+	reasonInvalidReview   = "invalid_review"
+	reasonMissingUsername = "missing_username"
+
+	urlParamCluster = "cluster"
+)
+
+// ErrMissingUsername indicates an ID token that lacks the username claim.
+var ErrMissingUsername = errors.New("ID token missing username claim")
+
+type tokenReview struct {
+	usernamePrefix string
+	groupsPrefix   string
+}
+
+// TokenReviewWebhook allows Kubernetes API servers that cannot be configured
+// to authenticate OIDC ID tokens to delegate authentication to Kuberos. The
+// supplied prefixes are prepended to authenticated usernames and groups,
+// like the API server's --oidc-username-prefix and --oidc-groups-prefix
+// flags.
+func TokenReviewWebhook(usernamePrefix, groupsPrefix string) Option {
+	return func(h *Handlers) error {
+		h.tokenReview = &tokenReview{usernamePrefix: usernamePrefix, groupsPrefix: groupsPrefix}
+		return nil
+	}
+}
+
+// TokenReview serves a Kubernetes webhook token authenticator. It verifies the
+// ID token of the POSTed TokenReview with the same verifier and claim mapping
+// used to generate kubecfgs, and returns the user's username and groups. API
+// servers may name their cluster via the cluster URL parameter, in which case
+// the cluster's authentication requirement, if any, applies.
+func (h *Handlers) TokenReview(w http.ResponseWriter, r *http.Request) {
+	if h.tokenReview == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	review := &authenticationv1.TokenReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+		metrics.TokenReviews.WithLabelValues(metrics.ResultFailure, reasonInvalidReview).Inc()
+		http.Error(w, errors.Wrap(err, "cannot decode TokenReview").Error(), http.StatusBadRequest)
+		return
+	}
+
+	// API servers may send TokenReviews at v1beta1, which has the same schema.
+	// Respond at the version we were sent.
+	if review.APIVersion == "" {
+		review.APIVersion = tokenReviewAPIVersion
+	}
+	review.Kind = tokenReviewKind
+	review.Status = h.review(r, review.Spec.Token)
+
+	// There's no need to echo the ID token back to the API server.
+	review.Spec = authenticationv1.TokenReviewSpec{}
+
+	j, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot marshal JSON").Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(j) // nolint: errcheck
+}
+
+func (h *Handlers) review(r *http.Request, token string) authenticationv1.TokenReviewStatus {
+	p, err := h.e.Verify(r.Context(), token)
+	reason := extractor.Reason(err)
+	if err == nil && p.Username == "" {
+		err, reason = ErrMissingUsername, reasonMissingUsername
+	}
+	if err == nil {
+		if err = h.reviewAuthentication(p, r.URL.Query().Get(urlParamCluster)); err != nil {
+			reason = extractor.ReasonAuthenticationTooWeak
+		}
+	}
+	if err != nil {
+		// The error is returned to the API server, which logs it.
+		h.log.Debug("token review", zap.Bool("authenticated", false), zap.Error(err))
+		metrics.TokenReviews.WithLabelValues(metrics.ResultFailure, reason).Inc()
+		return authenticationv1.TokenReviewStatus{Error: err.Error()}
+	}
+
+	u := authenticationv1.UserInfo{Username: h.tokenReview.usernamePrefix + p.Username, UID: p.Subject}
+	for _, g := range p.Groups {
+		u.Groups = append(u.Groups, h.tokenReview.groupsPrefix+g)
+	}
+	for k, v := range p.Extra {
+		if u.Extra == nil {
+			u.Extra = map[string]authenticationv1.ExtraValue{}
+		}
+		u.Extra[k] = authenticationv1.ExtraValue(v)
+	}
+	h.log.Debug("token review", zap.Bool("authenticated", true), zap.String("username", u.Username))
+	metrics.TokenReviews.WithLabelValues(metrics.ResultSuccess, "").Inc()
+	return authenticationv1.TokenReviewStatus{Authenticated: true, User: u}
+}
@@ -0,0 +1,164 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestTokenReview(t *testing.T) {
+	params := &extractor.OIDCAuthenticationParams{
+		Username: "example@example.org",
+		Subject:  "1234",
+		Groups:   []string{"a", "b"},
+		Extra:    map[string][]string{"example.org/team": {"platform"}},
+	}
+	authenticated := authenticationv1.TokenReviewStatus{
+		Authenticated: true,
+		User: authenticationv1.UserInfo{
+			Username: "example@example.org",
+			UID:      "1234",
+			Groups:   []string{"a", "b"},
+			Extra:    map[string]authenticationv1.ExtraValue{"example.org/team": {"platform"}},
+		},
+	}
+	mfa := map[string]extractor.AuthenticationRequirement{"prod": {ACR: []string{"mfa"}}}
+
+	cases := []struct {
+		name       string
+		e          extractor.OIDC
+		oo         []Option
+		url        string
+		body       string
+		wantStatus int
+		want       *authenticationv1.TokenReview
+	}{
+		{
+			name:       "Authenticated",
+			e:          &predictableExtractor{p: params},
+			oo:         []Option{TokenReviewWebhook("", "")},
+			body:       `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusOK,
+			want:       &authenticationv1.TokenReview{Status: authenticated},
+		},
+		{
+			name:       "Prefixes",
+			e:          &predictableExtractor{p: params},
+			oo:         []Option{TokenReviewWebhook("oidc:", "oidc:")},
+			body:       `{"apiVersion":"authentication.k8s.io/v1beta1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusOK,
+			want: &authenticationv1.TokenReview{
+				Status: authenticationv1.TokenReviewStatus{
+					Authenticated: true,
+					User: authenticationv1.UserInfo{
+						Username: "oidc:example@example.org",
+						UID:      "1234",
+						Groups:   []string{"oidc:a", "oidc:b"},
+						Extra:    map[string]authenticationv1.ExtraValue{"example.org/team": {"platform"}},
+					},
+				},
+			},
+		},
+		{
+			name:       "VerifyFailed",
+			e:          &predictableExtractor{err: errors.New("nope")},
+			oo:         []Option{TokenReviewWebhook("", "")},
+			body:       `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusOK,
+			want:       &authenticationv1.TokenReview{Status: authenticationv1.TokenReviewStatus{Error: "nope"}},
+		},
+		{
+			name:       "MissingUsername",
+			e:          &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Subject: "1234"}},
+			oo:         []Option{TokenReviewWebhook("", "")},
+			body:       `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusOK,
+			want:       &authenticationv1.TokenReview{Status: authenticationv1.TokenReviewStatus{Error: ErrMissingUsername.Error()}},
+		},
+		{
+			name:       "TooWeak",
+			e:          &predictableExtractor{p: params},
+			oo:         []Option{TokenReviewWebhook("", ""), TokenReviewAuthentication(extractor.AuthenticationRequirement{ACR: []string{"mfa"}})},
+			body:       `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusOK,
+			want:       &authenticationv1.TokenReview{Status: authenticationv1.TokenReviewStatus{Error: `authentication context class "" is not one of [mfa]`}},
+		},
+		{
+			name:       "ClusterTooWeak",
+			e:          &predictableExtractor{p: params},
+			oo:         []Option{TokenReviewWebhook("", ""), ClusterAuthentication(mfa)},
+			url:        "/tokenreview?cluster=prod",
+			body:       `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusOK,
+			want:       &authenticationv1.TokenReview{Status: authenticationv1.TokenReviewStatus{Error: `cluster prod: authentication context class "" is not one of [mfa]`}},
+		},
+		{
+			name:       "ClusterWithoutRequirement",
+			e:          &predictableExtractor{p: params},
+			oo:         []Option{TokenReviewWebhook("", ""), ClusterAuthentication(mfa)},
+			url:        "/tokenreview?cluster=dev",
+			body:       `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusOK,
+			want:       &authenticationv1.TokenReview{Status: authenticated},
+		},
+		{
+			name:       "InvalidReview",
+			e:          &predictableExtractor{p: params},
+			oo:         []Option{TokenReviewWebhook("", "")},
+			body:       `{"spec":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Disabled",
+			e:          &predictableExtractor{p: params},
+			body:       `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"idt"}}`,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandlers(&oauth2.Config{}, tt.e, append([]Option{Logger(zap.NewNop())}, tt.oo...)...)
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			u := tt.url
+			if u == "" {
+				u = "/tokenreview"
+			}
+			w := httptest.NewRecorder()
+			h.TokenReview(w, httptest.NewRequest("POST", u, strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("w.Code: want %v, got %v", tt.wantStatus, w.Code)
+			}
+			if tt.want == nil {
+				return
+			}
+
+			// Responses are at the API version of the request.
+			in := &authenticationv1.TokenReview{}
+			json.Unmarshal([]byte(tt.body), in) // nolint: errcheck
+			tt.want.APIVersion, tt.want.Kind = in.APIVersion, tokenReviewKind
+
+			got := &authenticationv1.TokenReview{}
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("json.Unmarshal(...): %v", err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("h.TokenReview(...): got != want: %v", diff)
+			}
+		})
+	}
+}